@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+//// Author identities
+
+// splitAuthor splits an hg author like "Name <email>" into its name and
+// email, the same way migrations split authors already stored. An author
+// without an email is all name.
+func splitAuthor(author string) (string, string) {
+	i := strings.IndexByte(author, '<')
+	if i == -1 || !strings.HasSuffix(author, ">") {
+		return strings.TrimSpace(author), ""
+	}
+
+	return strings.TrimSpace(author[:i]), author[i+1 : len(author)-1]
+}
+
+// Mailmap merges the identities of authors into canonical ones, as given by
+// a file in the format of git's .mailmap:
+//
+//	Proper Name <commit@email>
+//	<proper@email> <commit@email>
+//	Proper Name <proper@email> <commit@email>
+//	Proper Name <proper@email> Commit Name <commit@email>
+//
+// Commit names and emails match regardless of case. A nil Mailmap maps every
+// identity to itself.
+type Mailmap struct {
+	byEmail map[string]identity    // of entries without a commit name
+	byName  map[[2]string]identity // of entries with one, by name and email
+}
+
+// identity is an author name and email, either of which may be empty.
+type identity struct {
+	Name  string
+	Email string
+}
+
+// LoadMailmap reads the mailmap file at path.
+func LoadMailmap(path string) (*Mailmap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mm, err := ParseMailmap(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w - parsing mailmap: %v", err, path)
+	}
+
+	return mm, nil
+}
+
+// ParseMailmap reads mailmap entries, skipping blank lines and # comments.
+func ParseMailmap(r io.Reader) (*Mailmap, error) {
+	mm := &Mailmap{
+		byEmail: map[string]identity{},
+		byName:  map[[2]string]identity{},
+	}
+
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		ids, err := parseMailmapLine(sc.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%w - line %v", err, ln)
+		}
+
+		switch len(ids) {
+		case 0:
+		case 1:
+			// Proper Name <commit@email>
+			mm.byEmail[strings.ToLower(ids[0].Email)] = identity{Name: ids[0].Name}
+		case 2:
+			commit := ids[1]
+			if commit.Name == "" {
+				mm.byEmail[strings.ToLower(commit.Email)] = ids[0]
+			} else {
+				mm.byName[[2]string{strings.ToLower(commit.Name), strings.ToLower(commit.Email)}] = ids[0]
+			}
+		default:
+			return nil, fmt.Errorf("too many emails - line %v", ln)
+		}
+	}
+
+	return mm, sc.Err()
+}
+
+// parseMailmapLine reads the names and emails of a line, each name given
+// before its email.
+func parseMailmapLine(line string) ([]identity, error) {
+	if i := strings.IndexByte(line, '#'); i != -1 {
+		line = line[:i]
+	}
+
+	var ids []identity
+	for {
+		open := strings.IndexByte(line, '<')
+		if open == -1 {
+			if strings.TrimSpace(line) != "" {
+				return nil, fmt.Errorf("name without an email: %#v", strings.TrimSpace(line))
+			}
+			return ids, nil
+		}
+		end := strings.IndexByte(line[open:], '>')
+		if end == -1 {
+			return nil, fmt.Errorf("unclosed email: %#v", line[open:])
+		}
+
+		ids = append(ids, identity{
+			Name:  strings.TrimSpace(line[:open]),
+			Email: line[open+1 : open+end],
+		})
+		line = line[open+end+1:]
+	}
+}
+
+// Map returns the canonical name and email of an author. Entries matching
+// both the name and email take precedence over those matching the email.
+func (mm *Mailmap) Map(name, email string) (string, string) {
+	if mm == nil {
+		return name, email
+	}
+
+	canon, ok := mm.byName[[2]string{strings.ToLower(name), strings.ToLower(email)}]
+	if !ok {
+		canon, ok = mm.byEmail[strings.ToLower(email)]
+	}
+	if !ok {
+		return name, email
+	}
+
+	if canon.Name != "" {
+		name = canon.Name
+	}
+	if canon.Email != "" {
+		email = canon.Email
+	}
+
+	return name, email
+}
+
+// RemapAuthors re-applies mm to the canonical identities of all authors in a
+// database, reporting how many changed. Identities mm does not map are made
+// their own canonical identity again.
+func RemapAuthors(ctx context.Context, db *sql.DB, d dialect, mm *Mailmap) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	type author struct {
+		id           int64
+		alias, canon identity
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT id, name, email, canonical_name, canonical_email FROM authors`)
+	if err != nil {
+		return 0, fmt.Errorf("%w - reading authors", err)
+	}
+	var changed []author
+	for rows.Next() {
+		var a author
+		if err := rows.Scan(&a.id, &a.alias.Name, &a.alias.Email, &a.canon.Name, &a.canon.Email); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("%w - reading authors", err)
+		}
+		var canon identity
+		canon.Name, canon.Email = mm.Map(a.alias.Name, a.alias.Email)
+		if canon != a.canon {
+			a.canon = canon
+			changed = append(changed, a)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("%w - reading authors", err)
+	}
+
+	uSQL := d.SQL(`UPDATE authors SET canonical_name = ?, canonical_email = ? WHERE id = ?`)
+	for _, a := range changed {
+		if _, err := tx.ExecContext(ctx, uSQL, a.canon.Name, a.canon.Email, a.id); err != nil {
+			return 0, fmt.Errorf("%w - remapping author: %v <%v>", err, a.alias.Name, a.alias.Email)
+		}
+	}
+
+	return len(changed), tx.Commit()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSplitAuthor(t *testing.T) {
+	for author, want := range map[string][2]string{
+		"Some User <some.user@email.com>": {"Some User", "some.user@email.com"},
+		"<some.user@email.com>":           {"", "some.user@email.com"},
+		" Some User ":                     {"Some User", ""},
+		"Some User <unclosed":             {"Some User <unclosed", ""},
+		"":                                {"", ""},
+	} {
+		t.Run("can split "+author, func(t *testing.T) {
+			// SUT
+			name, email := splitAuthor(author)
+
+			assertDeep(t, [2]string{name, email}, want)
+		})
+	}
+}
+
+const testMailmap = `# merged identities
+Some User <some.user@email.com>
+<some@user.org> <SOME@old.example.com>
+Some User <some@user.org> <su@laptop.local> # from a laptop
+Other User <other@user.org> some user <shared@example.com>
+`
+
+func TestMailmap(t *testing.T) {
+	mm, err := ParseMailmap(strings.NewReader(testMailmap))
+	if err != nil {
+		t.Fatalf("unexpected mailmap error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		alias, want identity
+	}{
+		{"name by email", identity{"some", "some.user@email.com"}, identity{"Some User", "some.user@email.com"}},
+		{"email by email ignoring case", identity{"some", "some@OLD.example.com"}, identity{"some", "some@user.org"}},
+		{"name and email by email", identity{"su", "su@laptop.local"}, identity{"Some User", "some@user.org"}},
+		{"by name and email", identity{"Some User", "shared@example.com"}, identity{"Other User", "other@user.org"}},
+		{"nothing without a name match", identity{"Another", "shared@example.com"}, identity{"Another", "shared@example.com"}},
+		{"nothing unknown", identity{"Nobody", "nobody@example.com"}, identity{"Nobody", "nobody@example.com"}},
+	} {
+		t.Run("can map "+tc.name, func(t *testing.T) {
+			// SUT
+			name, email := mm.Map(tc.alias.Name, tc.alias.Email)
+
+			assertDeep(t, identity{name, email}, tc.want)
+		})
+	}
+
+	t.Run("can map nothing when nil", func(t *testing.T) {
+		var mm *Mailmap
+
+		// SUT
+		name, email := mm.Map("Some User", "some.user@email.com")
+
+		assertDeep(t, identity{name, email}, identity{"Some User", "some.user@email.com"})
+	})
+
+	for name, line := range map[string]string{
+		"a name without an email": "Some User",
+		"an unclosed email":       "Some User <some@user.org",
+		"too many emails":         "<a@b> <c@d> <e@f>",
+	} {
+		t.Run("can reject "+name, func(t *testing.T) {
+			// SUT
+			_, err := ParseMailmap(strings.NewReader("# ok\n" + line))
+
+			if err == nil || !strings.Contains(err.Error(), "line 2") {
+				t.Errorf("got error %v, want an error on line 2", err)
+			}
+		})
+	}
+}
+
+func TestRemapAuthors(t *testing.T) {
+	t.Run("can re-apply a mailmap to stored authors", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+		st := NewStore(db)
+		laptop := testLogRecord
+		laptop.NodeID, laptop.AuthorName, laptop.AuthorEmail = "d3adb33f", "su", "su@laptop.local"
+		if err := st.Persist(context.Background(), Results{Repo: testRepo, LogRecs: []LogRecord{testLogRecord, laptop}}); err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+		st.Close()
+		mm, err := ParseMailmap(strings.NewReader(testMailmap))
+		if err != nil {
+			t.Fatalf("unexpected mailmap error: %v", err)
+		}
+
+		// SUT
+		n, err := RemapAuthors(context.Background(), db, sqliteDialect, mm)
+
+		assert(t, err, nil)
+		assert(t, n, 1)
+		var cnt int
+		if err := db.QueryRow(`
+			SELECT COUNT(DISTINCT a.canonical_email) FROM logs l
+			JOIN authors a ON a.name = l.author_name AND a.email = l.author_email`,
+		).Scan(&cnt); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		assert(t, cnt, 2)
+
+		// SUT
+		n, err = RemapAuthors(context.Background(), db, sqliteDialect, nil)
+
+		assert(t, err, nil)
+		assert(t, n, 1)
+	})
+
+	t.Run("can persist new authors mapped", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+		st := NewStore(db)
+		defer st.Close()
+		mm, err := ParseMailmap(strings.NewReader(testMailmap))
+		if err != nil {
+			t.Fatalf("unexpected mailmap error: %v", err)
+		}
+		st.Mailmap = mm
+		r := testLogRecord
+		r.AuthorName, r.AuthorEmail = "su", "su@laptop.local"
+
+		// SUT
+		err = st.Persist(context.Background(), Results{Repo: testRepo, LogRecs: []LogRecord{r}})
+
+		assert(t, err, nil)
+		var got identity
+		if err := db.QueryRow(`SELECT canonical_name, canonical_email FROM authors`).Scan(&got.Name, &got.Email); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		assertDeep(t, got, identity{"Some User", "some@user.org"})
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//// SQL differences between supported databases
+
+// dialect is how SQL shared by the Store and migrations, written for SQLite,
+// is adapted to a database.
+type dialect struct {
+	Name    string
+	Driver  string
+	MaxVars int  // bound parameter limit of a single statement
+	Legacy  bool // databases may predate versioned migrations
+
+	// TableSQL counts the tables named by its single parameter
+	TableSQL string
+
+	numbered bool                // placeholders are $1, $2, etc.
+	ddl      func(string) string // adapts migration DDL
+}
+
+var sqliteDialect = dialect{
+	Name:     "sqlite",
+	Driver:   "sqlite3",
+	MaxVars:  maxSQLVars,
+	Legacy:   true,
+	TableSQL: `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`,
+	ddl:      func(s string) string { return s },
+}
+
+// maxPostgresVars is the bound parameter limit of the Postgres protocol.
+const maxPostgresVars = 65535
+
+var postgresDialect = dialect{
+	Name:    "postgres",
+	Driver:  "postgres",
+	MaxVars: maxPostgresVars,
+	TableSQL: `SELECT COUNT(*) FROM information_schema.tables
+		WHERE table_schema = current_schema() AND table_name = ?`,
+	numbered: true,
+	ddl:      postgresDDL,
+}
+
+var (
+	autoIncrRE = regexp.MustCompile(`(?i)INTEGER PRIMARY KEY AUTOINCREMENT`)
+	charRE     = regexp.MustCompile(`(?i)\bCHAR\(\d+\)`)
+	epochRE    = regexp.MustCompile(`(?i)\bstrftime\('%s', ([^()]*(?:\([^()]*\))?)\)`)
+	instrRE    = regexp.MustCompile(`(?i)\binstr\(`)
+)
+
+// postgresDDL adapts SQLite DDL to Postgres. CHAR(n) columns become TEXT,
+// since Postgres would pad them with blanks and enforce their length where
+// SQLite does neither. Of SQLite's functions, only those used by migrations
+// to backfill columns are translated.
+func postgresDDL(s string) string {
+	s = autoIncrRE.ReplaceAllString(s, "BIGSERIAL PRIMARY KEY")
+	s = charRE.ReplaceAllString(s, "TEXT")
+	s = epochRE.ReplaceAllString(s, "EXTRACT(EPOCH FROM CAST($1 AS TIMESTAMP))")
+	s = instrRE.ReplaceAllString(s, "strpos(")
+	return s
+}
+
+// SQL rewrites the ? placeholders of a query for the database. Queries must
+// not contain a literal ?, values are always bound as parameters.
+func (d dialect) SQL(q string) string {
+	if !d.numbered {
+		return q
+	}
+
+	var sb strings.Builder
+	n := 0
+	for {
+		i := strings.IndexByte(q, '?')
+		if i == -1 {
+			break
+		}
+		n++
+		sb.WriteString(q[:i])
+		sb.WriteString("$" + strconv.Itoa(n))
+		q = q[i+1:]
+	}
+	sb.WriteString(q)
+
+	return sb.String()
+}
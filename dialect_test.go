@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestDialectSQL(t *testing.T) {
+	q := `UPDATE repos SET last_error = ?, last_error_ts = ? WHERE repo_path = ?`
+
+	t.Run("can keep sqlite placeholders", func(t *testing.T) {
+		// SUT
+		got := sqliteDialect.SQL(q)
+
+		assert(t, got, q)
+	})
+
+	t.Run("can number postgres placeholders", func(t *testing.T) {
+		// SUT
+		got := postgresDialect.SQL(q)
+
+		assert(t, got, `UPDATE repos SET last_error = $1, last_error_ts = $2 WHERE repo_path = $3`)
+	})
+
+	t.Run("can number postgres placeholders of multi-row inserts", func(t *testing.T) {
+		is := insertSQL{Prefix: `INSERT INTO t (a, b)`}
+
+		// SUT
+		got := postgresDialect.SQL(is.query(2, 2))
+
+		assert(t, got, `INSERT INTO t (a, b) VALUES ($1, $2), ($3, $4)`)
+	})
+}
+
+func TestPostgresDDL(t *testing.T) {
+	t.Run("can adapt sqlite DDL", func(t *testing.T) {
+		ddl := `CREATE TABLE errs(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    ts CHAR(100) NOT NULL,
+    err TEXT,
+    attempt INTEGER
+);`
+
+		// SUT
+		got := postgresDDL(ddl)
+
+		assert(t, got, `CREATE TABLE errs(
+    id BIGSERIAL PRIMARY KEY,
+    ts TEXT NOT NULL,
+    err TEXT,
+    attempt INTEGER
+);`)
+	})
+}
+
+func TestPostgresBackfill(t *testing.T) {
+	t.Run("can adapt sqlite functions used by backfills", func(t *testing.T) {
+		ddl := `UPDATE logs SET ts_epoch = CAST(strftime('%s', substr(ts, 1, 19)) AS BIGINT) - ts_offset,
+    files_changed = CAST(substr(diffstat, 1, instr(diffstat, ':') - 1) AS INTEGER);`
+
+		// SUT
+		got := postgresDDL(ddl)
+
+		assert(t, got, `UPDATE logs SET ts_epoch = CAST(EXTRACT(EPOCH FROM CAST(substr(ts, 1, 19) AS TIMESTAMP)) AS BIGINT) - ts_offset,
+    files_changed = CAST(substr(diffstat, 1, strpos(diffstat, ':') - 1) AS INTEGER);`)
+	})
+}
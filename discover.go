@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+//// Repo discovery
+
+// Discovery finds the Mercurial and Git repos in a directory tree, as told
+// apart by repoVCS. Symlinked directories are followed, but none is searched
+// twice, so symlink loops end and no repo is listed twice.
+type Discovery struct {
+	// MaxDepth is how many levels of directories below the root are
+	// searched, 1 for only its children. 0 means no limit.
+	MaxDepth int
+
+	// Subrepos searches inside repos for repos nested in them, which are
+	// otherwise not descended into.
+	Subrepos bool
+
+	// Filter decides which directories are searched and which repos are
+	// listed, all are if nil.
+	Filter *RepoFilter
+}
+
+// Discovered is what a Discovery found.
+type Discovered struct {
+	Repos    RepoList
+	Skipped  []string // topmost directories outside repos with no repo found in them
+	Excluded []Exclusion
+}
+
+// Exclusion is a directory the rules of a RepoFilter kept from being
+// searched, or a repo kept from being listed, and why.
+type Exclusion struct {
+	Path string
+	Rule string
+}
+
+// notIncluded is the Exclusion rule of repos no include rule matched.
+const notIncluded = "no include rule matched"
+
+// Discover searches the directories below root. Only failing to read root
+// is an error, other directories that cannot be read are logged and skipped.
+func (d Discovery) Discover(root string) (Discovered, error) {
+	var found Discovered
+	visited := map[string]bool{}
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		visited[resolved] = true
+	}
+
+	_, err := d.search(root, "", 1, false, visited, &found)
+
+	return found, err
+}
+
+// search looks for repos among the children of dir, at depth below the root,
+// reporting whether any were found.
+func (d Discovery) search(dir, rel string, depth int, inRepo bool, visited map[string]bool, found *Discovered) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+
+	var has bool
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		pRel := path.Join(rel, e.Name())
+		if e.Name() == ".hg" || e.Name() == ".git" || !isDir(p, e) {
+			continue
+		}
+		if rule, excluded := d.Filter.Excludes(pRel); excluded {
+			found.Excluded = append(found.Excluded, Exclusion{Path: p, Rule: rule.String()})
+			continue
+		}
+
+		resolved, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			Log.Infof("ERROR resolving directory %#v: %v", p, err)
+			continue
+		}
+		if visited[resolved] {
+			Log.Debugf("directory already searched: %#v", p)
+			continue
+		}
+		visited[resolved] = true
+
+		repo := isRepo(p)
+		switch {
+		case repo && d.Filter.Includes(pRel):
+			found.Repos = append(found.Repos, p)
+		case repo:
+			found.Excluded = append(found.Excluded, Exclusion{Path: p, Rule: notIncluded})
+		}
+
+		var below bool
+		skipped := len(found.Skipped)
+		if (!repo || d.Subrepos) && (d.MaxDepth == 0 || depth < d.MaxDepth) {
+			below, err = d.search(p, pRel, depth+1, inRepo || repo, visited, found)
+			if err != nil {
+				Log.Infof("ERROR reading directory %#v: %v", p, err)
+			}
+		}
+
+		if !repo && !below && !inRepo {
+			found.Skipped = append(found.Skipped[:skipped], p)
+		}
+		has = has || repo || below
+	}
+
+	return has, nil
+}
+
+// printDryRun lists the repos found and each directory skipped, with why.
+func printDryRun(w io.Writer, found Discovered) {
+	for _, r := range found.Repos {
+		fmt.Fprintf(w, "collect\t%v\n", r)
+	}
+	for _, ex := range found.Excluded {
+		fmt.Fprintf(w, "exclude\t%v\t%v\n", ex.Path, ex.Rule)
+	}
+	for _, s := range found.Skipped {
+		fmt.Fprintf(w, "skip\t%v\tno repo found\n", s)
+	}
+}
+
+// isDir reports whether a directory entry is a directory or a symlink to one,
+// stating p if there is no entry.
+func isDir(p string, e os.DirEntry) bool {
+	if e != nil && e.Type()&os.ModeSymlink == 0 {
+		return e.IsDir()
+	}
+	fi, err := os.Stat(p)
+
+	return err == nil && fi.IsDir()
+}
+
+// Version control systems of repos, as recorded for their logs.
+const (
+	vcsHg  = "hg"
+	vcsGit = "git"
+)
+
+func isRepo(dir string) bool {
+	return repoVCS(dir) != ""
+}
+
+// repoVCS tells the version control system of a repo, empty if dir is not
+// one. Mercurial repos have a .hg/requires file. Git repos have a .git
+// directory, or a .git file pointing to one as worktrees and submodules do,
+// unless bare, in which case dir itself has HEAD, objects and refs.
+func repoVCS(dir string) string {
+	if isFile(filepath.Join(dir, ".hg", "requires")) {
+		return vcsHg
+	}
+	if isFile(filepath.Join(dir, ".git", "HEAD")) || isFile(filepath.Join(dir, ".git")) {
+		return vcsGit
+	}
+	if isFile(filepath.Join(dir, "HEAD")) &&
+		isDir(filepath.Join(dir, "objects"), nil) && isDir(filepath.Join(dir, "refs"), nil) {
+		return vcsGit
+	}
+
+	return ""
+}
+
+func isFile(p string) bool {
+	fi, err := os.Stat(p)
+
+	return err == nil && fi.Mode().IsRegular()
+}
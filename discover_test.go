@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiscover(t *testing.T) {
+	root := t.TempDir()
+	for _, repo := range []string{"a", "a/lib/sub", "omitted", "team/project/repo"} {
+		if err := os.MkdirAll(filepath.Join(root, repo, ".hg"), 0o755); err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(root, repo, ".hg", "requires"), []byte("revlogv1\n"), 0o644); err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+	}
+	for _, dir := range []string{"notes", "team/empty", "nohg/.hg"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "file.txt"), nil, 0o644); err != nil {
+		t.Fatalf("unexpected setup error: %v", err)
+	}
+	for name, target := range map[string]string{"loop": ".", "link": "a", "team/up": ".."} {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skipf("symlinks unsupported: %v", err)
+		}
+	}
+	omit := &RepoFilter{}
+	if err := omit.AddRule(false, "-x", "omitted"); err != nil {
+		t.Fatalf("unexpected setup error: %v", err)
+	}
+	omitted := []Exclusion{{Path: filepath.Join(root, "omitted"), Rule: "-x: omitted"}}
+	included := &RepoFilter{}
+	if err := included.AddRule(true, "-i", "team/**"); err != nil {
+		t.Fatalf("unexpected setup error: %v", err)
+	}
+	paths := func(rels ...string) []string {
+		var ps []string
+		for _, r := range rels {
+			ps = append(ps, filepath.Join(root, r))
+		}
+		return ps
+	}
+
+	for _, tc := range []struct {
+		name string
+		disc Discovery
+		want Discovered
+	}{
+		{
+			"only children",
+			Discovery{MaxDepth: 1, Filter: omit},
+			Discovered{Repos: paths("a"), Skipped: paths("nohg", "notes", "team"), Excluded: omitted},
+		},
+		{
+			"nested repos",
+			Discovery{Filter: omit},
+			Discovered{Repos: paths("a", "team/project/repo"), Skipped: paths("nohg", "notes", "team/empty"), Excluded: omitted},
+		},
+		{
+			"subrepos",
+			Discovery{Subrepos: true, Filter: omit},
+			Discovered{Repos: paths("a", "a/lib/sub", "team/project/repo"), Skipped: paths("nohg", "notes", "team/empty"), Excluded: omitted},
+		},
+		{
+			"all repos",
+			Discovery{MaxDepth: 2},
+			Discovered{Repos: paths("a", "omitted"), Skipped: paths("nohg", "notes", "team")},
+		},
+		{
+			"included repos",
+			Discovery{Filter: included},
+			Discovered{
+				Repos:   paths("team/project/repo"),
+				Skipped: paths("nohg", "notes", "team/empty"),
+				Excluded: []Exclusion{
+					{Path: filepath.Join(root, "a"), Rule: notIncluded},
+					{Path: filepath.Join(root, "omitted"), Rule: notIncluded},
+				},
+			},
+		},
+	} {
+		t.Run("can discover "+tc.name, func(t *testing.T) {
+			// SUT
+			got, err := tc.disc.Discover(root)
+
+			assert(t, err, nil)
+			assertDeep(t, got, tc.want)
+		})
+	}
+
+	t.Run("can discover git repos alongside hg repos", func(t *testing.T) {
+		root := t.TempDir()
+		for _, p := range []string{
+			"hg/.hg/requires",
+			"git/.git/HEAD",
+			"git/.git/modules/lib/HEAD", "git/.git/modules/lib/objects/", "git/.git/modules/lib/refs/",
+			"git/vendor/.hg/requires",
+			"bare.git/HEAD", "bare.git/objects/", "bare.git/refs/",
+			"worktree/.git",
+			"notes/HEAD",
+		} {
+			if err := os.MkdirAll(filepath.Join(root, filepath.Dir(p)), 0o755); err != nil {
+				t.Fatalf("unexpected setup error: %v", err)
+			}
+			if !strings.HasSuffix(p, "/") {
+				if err := os.WriteFile(filepath.Join(root, p), nil, 0o644); err != nil {
+					t.Fatalf("unexpected setup error: %v", err)
+				}
+			}
+		}
+
+		// SUT
+		got, err := Discovery{Subrepos: true}.Discover(root)
+
+		assert(t, err, nil)
+		assertDeep(t, got.Repos, RepoList{
+			filepath.Join(root, "bare.git"),
+			filepath.Join(root, "git"),
+			filepath.Join(root, "git", "vendor"),
+			filepath.Join(root, "hg"),
+			filepath.Join(root, "worktree"),
+		})
+		assertDeep(t, got.Skipped, []string{filepath.Join(root, "notes")})
+		assert(t, repoVCS(filepath.Join(root, "git", "vendor")), vcsHg)
+		assert(t, repoVCS(filepath.Join(root, "bare.git")), vcsGit)
+	})
+
+	t.Run("can print a dry run", func(t *testing.T) {
+		var buf bytes.Buffer
+		found := Discovered{
+			Repos:    RepoList{"/repos/a"},
+			Skipped:  []string{"/repos/notes"},
+			Excluded: []Exclusion{{Path: "/repos/omitted", Rule: "-x: omitted"}},
+		}
+
+		// SUT
+		printDryRun(&buf, found)
+
+		assert(t, buf.String(), "collect\t/repos/a\nexclude\t/repos/omitted\t-x: omitted\nskip\t/repos/notes\tno repo found\n")
+	})
+
+	t.Run("can fail on an unreadable root", func(t *testing.T) {
+		// SUT
+		_, err := Discovery{}.Discover(filepath.Join(root, "missing"))
+
+		assert(t, os.IsNotExist(err), true)
+	})
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//// Flat-file output
+
+// FileStore is a Persister writing Results to flat files in a directory, one
+// per table. Files are written under a .partial name and only renamed into
+// place by Close, so a run that dies never leaves a file that looks complete.
+type FileStore struct {
+	Dir    string
+	format fileFormat
+
+	// Mailmap gives the canonical identities of authors, and must be set
+	// before the first Persist.
+	Mailmap *Mailmap
+
+	mu      sync.Mutex
+	tables  map[string]*tableFile
+	tips    map[string]Tip
+	authors map[identity]bool // written to the authors table
+	closed  bool
+}
+
+// fileFormat is how each table of a FileStore is encoded.
+type fileFormat struct {
+	Ext string
+
+	// Nested formats keep file changes and parents in their log records
+	// instead of writing them to changeset_files and changeset_parents tables.
+	Nested bool
+
+	open func(w io.Writer, row interface{}) (rowWriter, error)
+}
+
+// rowWriter encodes the rows of a table. Close completes the encoding
+// without closing the underlying writer.
+type rowWriter interface {
+	Write(row interface{}) error
+	Close() error
+}
+
+var fileFormats = map[string]fileFormat{
+	"jsonl":   {Ext: ".jsonl", Nested: true, open: newJSONLWriter},
+	"csv":     {Ext: ".csv", open: newCSVWriter},
+	"parquet": {Ext: ".parquet", open: newParquetWriter},
+}
+
+// fileFormatNames lists the formats of fileFormats, for flag usage.
+func fileFormatNames() string {
+	var fns []string
+	for n := range fileFormats {
+		fns = append(fns, n)
+	}
+	sort.Strings(fns)
+
+	return strings.Join(fns, ", ")
+}
+
+var errFileStoreClosed = errors.New("file store is closed")
+
+// NewFileStore creates the partial files of each table of a format in dir,
+// creating dir if needed.
+func NewFileStore(dir, format string) (*FileStore, error) {
+	ff, ok := fileFormats[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown file format: %#v", format)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	fs := &FileStore{
+		Dir:     dir,
+		format:  ff,
+		tables:  map[string]*tableFile{},
+		tips:    map[string]Tip{},
+		authors: map[identity]bool{},
+	}
+	tables := map[string]interface{}{
+		"logs":          &logRow{},
+		"errs":          &errRow{},
+		"authors":       &authorRow{},
+		"repo_metadata": &metaRow{},
+	}
+	if ff.Nested {
+		tables["logs"] = &nestedLogRow{}
+	} else {
+		tables["changeset_files"] = &fileRow{}
+		tables["changeset_parents"] = &parentRow{}
+	}
+	for name, row := range tables {
+		tf, err := openTableFile(filepath.Join(dir, name+ff.Ext), ff, row)
+		if err != nil {
+			fs.abort()
+			return nil, fmt.Errorf("%w - creating %v table file", err, name)
+		}
+		fs.tables[name] = tf
+	}
+
+	return fs, nil
+}
+
+// LastTip reports the highest revision written for a repo by this FileStore,
+// so a retried repo resumes where its failed attempt stopped instead of
+// writing its logs twice. Earlier runs are not known.
+func (fs *FileStore) LastTip(ctx context.Context, repo string) (Tip, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.tips[repo], nil
+}
+
+// Persist appends the log records and error events of res to their table
+// files. Repo statuses are not written.
+func (fs *FileStore) Persist(ctx context.Context, res Results) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return errFileStoreClosed
+	}
+
+	if res.Rewritten {
+		Log.Infof("ERROR history of repo %#v was rewritten, its logs already written are stale", res.Repo)
+	}
+
+	for _, r := range res.LogRecs {
+		var frs []fileRow
+		for _, fc := range r.FileChanges {
+			frs = append(frs, fileRow{
+				RepoPath:     r.RepoPath,
+				NodeID:       r.NodeID,
+				Path:         fc.Path,
+				Action:       fc.Action,
+				LinesAdded:   int64(fc.Added),
+				LinesRemoved: int64(fc.Removed),
+			})
+		}
+
+		var prs []parentRow
+		for i, p := range []string{r.P1Node, r.P2Node} {
+			if p != "" {
+				prs = append(prs, parentRow{
+					RepoPath:    r.RepoPath,
+					NodeID:      r.NodeID,
+					ParentIndex: int64(i + 1),
+					ParentNode:  p,
+				})
+			}
+		}
+
+		lr := newLogRow(r)
+		if fs.format.Nested {
+			if err := fs.tables["logs"].Write(&nestedLogRow{logRow: lr, FileChanges: frs, Parents: prs}); err != nil {
+				return fmt.Errorf("%w - writing log: %v", err, res.Repo)
+			}
+		} else {
+			if err := fs.tables["logs"].Write(&lr); err != nil {
+				return fmt.Errorf("%w - writing log: %v", err, res.Repo)
+			}
+			for i := range frs {
+				if err := fs.tables["changeset_files"].Write(&frs[i]); err != nil {
+					return fmt.Errorf("%w - writing changeset file: %v", err, res.Repo)
+				}
+			}
+			for i := range prs {
+				if err := fs.tables["changeset_parents"].Write(&prs[i]); err != nil {
+					return fmt.Errorf("%w - writing changeset parent: %v", err, res.Repo)
+				}
+			}
+		}
+
+		if alias := (identity{Name: r.AuthorName, Email: r.AuthorEmail}); !fs.authors[alias] {
+			ar := authorRow{Name: alias.Name, Email: alias.Email}
+			ar.CanonicalName, ar.CanonicalEmail = fs.Mailmap.Map(alias.Name, alias.Email)
+			if err := fs.tables["authors"].Write(&ar); err != nil {
+				return fmt.Errorf("%w - writing author: %v", err, res.Repo)
+			}
+			fs.authors[alias] = true
+		}
+
+		if rev, err := strconv.Atoi(r.RevID); err == nil && rev >= fs.tips[res.Repo].Rev {
+			fs.tips[res.Repo] = Tip{Rev: rev, Node: r.NodeID}
+		}
+	}
+
+	for _, e := range res.ErrEvents {
+		er := errRow{
+			TS:       e.TS,
+			Err:      e.Err.Error(),
+			RepoPath: e.Path,
+			Kind:     e.Kind,
+			Attempt:  int64(e.Attempt),
+		}
+		if err := fs.tables["errs"].Write(&er); err != nil {
+			return fmt.Errorf("%w - writing error event: %v", err, res.Repo)
+		}
+	}
+
+	return nil
+}
+
+// PersistManifest writes the metadata of the repos of a manifest.
+func (fs *FileStore) PersistManifest(ctx context.Context, m Manifest) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return errFileStoreClosed
+	}
+
+	for _, r := range m {
+		for _, nv := range r.metaRows() {
+			if err := fs.tables["repo_metadata"].Write(&metaRow{RepoPath: r.Path, Name: nv[0], Value: nv[1]}); err != nil {
+				return fmt.Errorf("%w - writing repo metadata: %v", err, r.Path)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Close completes each table file and renames it into place. Files that
+// cannot be completed are left with their .partial name.
+func (fs *FileStore) Close() error {
+	return fs.close(true)
+}
+
+// CloseIncomplete completes each table file like Close but leaves it with its
+// .partial name, for a run cancelled before all its repos were collected, so
+// the files obtained so far are readable but never look like a full run.
+func (fs *FileStore) CloseIncomplete() error {
+	return fs.close(false)
+}
+
+func (fs *FileStore) close(rename bool) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return errFileStoreClosed
+	}
+	fs.closed = true
+
+	var errs []string
+	for _, name := range fs.tableNames() {
+		if err := fs.tables[name].Complete(rename); err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("completing table files - %v", strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// abort closes the table files opened so far, leaving them partial.
+func (fs *FileStore) abort() {
+	for _, tf := range fs.tables {
+		tf.file.Close()
+	}
+}
+
+func (fs *FileStore) tableNames() []string {
+	var names []string
+	for n := range fs.tables {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// tableFile is a table being written to the partial file of its path.
+type tableFile struct {
+	rowWriter
+	path string
+	file *os.File
+	buf  *bufio.Writer
+}
+
+const partialExt = ".partial"
+
+func openTableFile(path string, ff fileFormat, row interface{}) (*tableFile, error) {
+	f, err := os.OpenFile(path+partialExt, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(f)
+	rw, err := ff.open(buf, row)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &tableFile{rowWriter: rw, path: path, file: f, buf: buf}, nil
+}
+
+// Complete finishes writing the table and syncs it to disk, then renames it
+// from its partial file to its path if rename is set.
+func (tf *tableFile) Complete(rename bool) error {
+	defer tf.file.Close()
+
+	if err := tf.rowWriter.Close(); err != nil {
+		return err
+	}
+	if err := tf.buf.Flush(); err != nil {
+		return err
+	}
+	if err := tf.file.Sync(); err != nil {
+		return err
+	}
+	if err := tf.file.Close(); err != nil {
+		return err
+	}
+	if !rename {
+		return nil
+	}
+
+	return os.Rename(tf.path+partialExt, tf.path)
+}
+
+//// Table rows, columns named as in the database
+
+type logRow struct {
+	TS          string `json:"ts"`
+	NodeID      string `json:"node_id"`
+	RevID       string `json:"rev_id"`
+	ParentIDs   string `json:"parent_ids"`
+	Author      string `json:"author"`
+	Tags        string `json:"tags"`
+	Branch      string `json:"branch"`
+	DiffStat    string `json:"diffstat"`
+	Files       string `json:"files"`
+	GraphNode   string `json:"graph_node"`
+	RepoPath    string `json:"repo_path"`
+	Description string `json:"description"`
+
+	TSEpoch      int64 `json:"ts_epoch"`
+	TSOffset     int64 `json:"ts_offset"`
+	Rev          int64 `json:"rev"`
+	FilesChanged int64 `json:"files_changed"`
+	LinesAdded   int64 `json:"lines_added"`
+	LinesRemoved int64 `json:"lines_removed"`
+
+	AuthorName  string `json:"author_name"`
+	AuthorEmail string `json:"author_email"`
+
+	VCS string `json:"vcs"`
+}
+
+// newLogRow converts a LogRecord, with an unknown Time written as zero.
+func newLogRow(r LogRecord) logRow {
+	tsEpoch, tsOffset := r.epoch()
+
+	return logRow{
+		TS:          r.TS,
+		NodeID:      r.NodeID,
+		RevID:       r.RevID,
+		ParentIDs:   r.ParentIDs,
+		Author:      r.Author,
+		Tags:        r.Tags,
+		Branch:      r.Branch,
+		DiffStat:    r.DiffStat,
+		Files:       r.Files,
+		GraphNode:   r.GraphNode,
+		RepoPath:    r.RepoPath,
+		Description: r.Description,
+
+		TSEpoch:      tsEpoch.Int64,
+		TSOffset:     tsOffset.Int64,
+		Rev:          int64(r.Rev),
+		FilesChanged: int64(r.FilesChanged),
+		LinesAdded:   int64(r.LinesAdded),
+		LinesRemoved: int64(r.LinesRemoved),
+
+		AuthorName:  r.AuthorName,
+		AuthorEmail: r.AuthorEmail,
+
+		VCS: r.VCS,
+	}
+}
+
+type nestedLogRow struct {
+	logRow
+	FileChanges []fileRow   `json:"file_changes"`
+	Parents     []parentRow `json:"parents"`
+}
+
+type fileRow struct {
+	RepoPath     string `json:"repo_path"`
+	NodeID       string `json:"node_id"`
+	Path         string `json:"path"`
+	Action       string `json:"action"`
+	LinesAdded   int64  `json:"lines_added"`
+	LinesRemoved int64  `json:"lines_removed"`
+}
+
+type parentRow struct {
+	RepoPath    string `json:"repo_path"`
+	NodeID      string `json:"node_id"`
+	ParentIndex int64  `json:"parent_index"`
+	ParentNode  string `json:"parent_node"`
+}
+
+type authorRow struct {
+	Name           string `json:"name"`
+	Email          string `json:"email"`
+	CanonicalName  string `json:"canonical_name"`
+	CanonicalEmail string `json:"canonical_email"`
+}
+
+type metaRow struct {
+	RepoPath string `json:"repo_path"`
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+}
+
+type errRow struct {
+	TS       string `json:"ts"`
+	Err      string `json:"err"`
+	RepoPath string `json:"repo_path"`
+	Kind     string `json:"kind"`
+	Attempt  int64  `json:"attempt"`
+}
+
+//// Row writers
+
+type jsonlWriter struct {
+	enc *json.Encoder
+}
+
+func newJSONLWriter(w io.Writer, row interface{}) (rowWriter, error) {
+	return jsonlWriter{json.NewEncoder(w)}, nil
+}
+
+func (jw jsonlWriter) Write(row interface{}) error { return jw.enc.Encode(row) }
+func (jw jsonlWriter) Close() error                { return nil }
+
+// csvWriter writes the string and integer fields of flat row structs, with a
+// header of their json names.
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(w io.Writer, row interface{}) (rowWriter, error) {
+	cw := csvWriter{csv.NewWriter(w)}
+
+	t := reflect.TypeOf(row).Elem()
+	header := make([]string, t.NumField())
+	for i := range header {
+		header[i] = t.Field(i).Tag.Get("json")
+	}
+
+	return cw, cw.w.Write(header)
+}
+
+func (cw csvWriter) Write(row interface{}) error {
+	v := reflect.ValueOf(row).Elem()
+	rec := make([]string, v.NumField())
+	for i := range rec {
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			rec[i] = f.String()
+		case reflect.Int64:
+			rec[i] = strconv.FormatInt(f.Int(), 10)
+		default:
+			return fmt.Errorf("unsupported csv column type: %v", f.Type())
+		}
+	}
+
+	return cw.w.Write(rec)
+}
+
+func (cw csvWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
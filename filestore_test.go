@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	res := Results{
+		Repo:      testRepo,
+		LogRecs:   []LogRecord{testLogRecord},
+		ErrEvents: []ErrorEvent{testErrEvent},
+	}
+	wantFile := fileRow{
+		RepoPath:   testRepo,
+		NodeID:     testLogRecord.NodeID,
+		Path:       "hi.txt",
+		Action:     "added",
+		LinesAdded: 1,
+	}
+
+	for _, format := range []string{"jsonl", "csv", "parquet"} {
+		t.Run("can write "+format+" files only once closed", func(t *testing.T) {
+			dir := t.TempDir()
+			fs, err := NewFileStore(dir, format)
+			if err != nil {
+				t.Fatalf("unexpected file store error: %v", err)
+			}
+
+			// SUT
+			err = fs.Persist(context.Background(), res)
+			assert(t, err, nil)
+
+			logs := filepath.Join(dir, "logs."+format)
+			_, err = os.Stat(logs)
+			assert(t, os.IsNotExist(err), true)
+			_, err = os.Stat(logs + partialExt)
+			assert(t, err, nil)
+
+			err = fs.Close()
+			assert(t, err, nil)
+
+			_, err = os.Stat(logs)
+			assert(t, err, nil)
+			_, err = os.Stat(logs + partialExt)
+			assert(t, os.IsNotExist(err), true)
+			err = fs.Persist(context.Background(), res)
+			assert(t, err, errFileStoreClosed)
+		})
+	}
+
+	t.Run("can leave files partial when closed incomplete", func(t *testing.T) {
+		dir := t.TempDir()
+		fs, err := NewFileStore(dir, "jsonl")
+		if err != nil {
+			t.Fatalf("unexpected file store error: %v", err)
+		}
+		if err := fs.Persist(context.Background(), res); err != nil {
+			t.Fatalf("unexpected persist error: %v", err)
+		}
+
+		// SUT
+		err = fs.CloseIncomplete()
+
+		assert(t, err, nil)
+		logs := filepath.Join(dir, "logs.jsonl")
+		_, err = os.Stat(logs)
+		assert(t, os.IsNotExist(err), true)
+		b, err := os.ReadFile(logs + partialExt)
+		assert(t, err, nil)
+		assert(t, strings.Count(string(b), "\n"), 1)
+		err = fs.Persist(context.Background(), res)
+		assert(t, err, errFileStoreClosed)
+	})
+
+	t.Run("can write jsonl with nested file changes", func(t *testing.T) {
+		dir := t.TempDir()
+		fs, err := NewFileStore(dir, "jsonl")
+		if err != nil {
+			t.Fatalf("unexpected file store error: %v", err)
+		}
+
+		// SUT
+		err = fs.Persist(context.Background(), res)
+		assert(t, err, nil)
+		err = fs.Close()
+		assert(t, err, nil)
+
+		var gotLogs []nestedLogRow
+		readJSONL(t, filepath.Join(dir, "logs.jsonl"), func(dec *json.Decoder) error {
+			var r nestedLogRow
+			err := dec.Decode(&r)
+			gotLogs = append(gotLogs, r)
+			return err
+		})
+		assertDeep(t, gotLogs, []nestedLogRow{{newLogRow(testLogRecord), []fileRow{wantFile}, nil}})
+
+		var gotErrs []errRow
+		readJSONL(t, filepath.Join(dir, "errs.jsonl"), func(dec *json.Decoder) error {
+			var r errRow
+			err := dec.Decode(&r)
+			gotErrs = append(gotErrs, r)
+			return err
+		})
+		assertDeep(t, gotErrs, []errRow{{TS: testErrEvent.TS, Err: errTest.Error(), RepoPath: testErrorRepo}})
+	})
+
+	t.Run("can write csv with a file per table", func(t *testing.T) {
+		dir := t.TempDir()
+		fs, err := NewFileStore(dir, "csv")
+		if err != nil {
+			t.Fatalf("unexpected file store error: %v", err)
+		}
+
+		// SUT
+		err = fs.Persist(context.Background(), res)
+		assert(t, err, nil)
+		err = fs.Close()
+		assert(t, err, nil)
+
+		assertDeep(t, readCSV(t, filepath.Join(dir, "logs.csv")), [][]string{
+			{"ts", "node_id", "rev_id", "parent_ids", "author", "tags", "branch", "diffstat", "files", "graph_node", "repo_path", "description",
+				"ts_epoch", "ts_offset", "rev", "files_changed", "lines_added", "lines_removed", "author_name", "author_email", "vcs"},
+			{testLogRecord.TS, testLogRecord.NodeID, "0", "", testLogRecord.Author, "tip", "default", "1: +1/-0", "hi.txt", "@", testRepo, "initial commit",
+				"1654904627", "0", "0", "1", "1", "0", "Some User", "some.user@email.com", "hg"},
+		})
+		assertDeep(t, readCSV(t, filepath.Join(dir, "authors.csv")), [][]string{
+			{"name", "email", "canonical_name", "canonical_email"},
+			{"Some User", "some.user@email.com", "Some User", "some.user@email.com"},
+		})
+		assertDeep(t, readCSV(t, filepath.Join(dir, "changeset_files.csv")), [][]string{
+			{"repo_path", "node_id", "path", "action", "lines_added", "lines_removed"},
+			{testRepo, testLogRecord.NodeID, "hi.txt", "added", "1", "0"},
+		})
+		assertDeep(t, readCSV(t, filepath.Join(dir, "errs.csv")), [][]string{
+			{"ts", "err", "repo_path", "kind", "attempt"},
+			{testErrEvent.TS, errTest.Error(), testErrorRepo, "", "0"},
+		})
+	})
+
+	t.Run("can write changeset parents", func(t *testing.T) {
+		merge := testLogRecord
+		merge.NodeID, merge.P1Node, merge.P2Node = "d3adb33f", "71efee29", "5ca1ab1e"
+		wantParents := []parentRow{
+			{RepoPath: testRepo, NodeID: "d3adb33f", ParentIndex: 1, ParentNode: "71efee29"},
+			{RepoPath: testRepo, NodeID: "d3adb33f", ParentIndex: 2, ParentNode: "5ca1ab1e"},
+		}
+
+		for _, format := range []string{"jsonl", "csv"} {
+			dir := t.TempDir()
+			fs, err := NewFileStore(dir, format)
+			if err != nil {
+				t.Fatalf("unexpected file store error: %v", err)
+			}
+
+			// SUT
+			err = fs.Persist(context.Background(), Results{Repo: testRepo, LogRecs: []LogRecord{testLogRecord, merge}})
+			assert(t, err, nil)
+			err = fs.Close()
+			assert(t, err, nil)
+
+			if format == "csv" {
+				assertDeep(t, readCSV(t, filepath.Join(dir, "changeset_parents.csv")), [][]string{
+					{"repo_path", "node_id", "parent_index", "parent_node"},
+					{testRepo, "d3adb33f", "1", "71efee29"},
+					{testRepo, "d3adb33f", "2", "5ca1ab1e"},
+				})
+				continue
+			}
+			var got [][]parentRow
+			readJSONL(t, filepath.Join(dir, "logs.jsonl"), func(dec *json.Decoder) error {
+				var r nestedLogRow
+				err := dec.Decode(&r)
+				got = append(got, r.Parents)
+				return err
+			})
+			assertDeep(t, got, [][]parentRow{nil, wantParents})
+		}
+	})
+
+	t.Run("can write each author once with a mailmap", func(t *testing.T) {
+		dir := t.TempDir()
+		fs, err := NewFileStore(dir, "jsonl")
+		if err != nil {
+			t.Fatalf("unexpected file store error: %v", err)
+		}
+		fs.Mailmap, err = ParseMailmap(strings.NewReader("Some User <some@user.org> <some.user@email.com>"))
+		if err != nil {
+			t.Fatalf("unexpected mailmap error: %v", err)
+		}
+
+		// SUT
+		for i := 0; i < 2; i++ {
+			err = fs.Persist(context.Background(), res)
+			assert(t, err, nil)
+		}
+		err = fs.Close()
+		assert(t, err, nil)
+
+		var got []authorRow
+		readJSONL(t, filepath.Join(dir, "authors.jsonl"), func(dec *json.Decoder) error {
+			var r authorRow
+			err := dec.Decode(&r)
+			got = append(got, r)
+			return err
+		})
+		assertDeep(t, got, []authorRow{{"Some User", "some.user@email.com", "Some User", "some@user.org"}})
+	})
+
+	t.Run("can write repo metadata", func(t *testing.T) {
+		dir := t.TempDir()
+		fs, err := NewFileStore(dir, "csv")
+		if err != nil {
+			t.Fatalf("unexpected file store error: %v", err)
+		}
+
+		// SUT
+		err = fs.PersistManifest(context.Background(), Manifest{
+			{Path: testRepo, Meta: map[string][]string{"team": {"frontend"}, "tags": {"public", "js"}}},
+			{Path: testErrorRepo},
+		})
+		assert(t, err, nil)
+		err = fs.Close()
+		assert(t, err, nil)
+
+		assertDeep(t, readCSV(t, filepath.Join(dir, "repo_metadata.csv")), [][]string{
+			{"repo_path", "name", "value"},
+			{testRepo, "tags", "public"},
+			{testRepo, "tags", "js"},
+			{testRepo, "team", "frontend"},
+		})
+	})
+
+	t.Run("can persist from concurrent workers", func(t *testing.T) {
+		dir := t.TempDir()
+		fs, err := NewFileStore(dir, "jsonl")
+		if err != nil {
+			t.Fatalf("unexpected file store error: %v", err)
+		}
+
+		// SUT
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					if err := fs.Persist(context.Background(), res); err != nil {
+						t.Errorf("unexpected persist error: %v", err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		err = fs.Close()
+		assert(t, err, nil)
+
+		var cnt int
+		readJSONL(t, filepath.Join(dir, "logs.jsonl"), func(dec *json.Decoder) error {
+			var r nestedLogRow
+			cnt++
+			return dec.Decode(&r)
+		})
+		assert(t, cnt, 400)
+	})
+
+	t.Run("can report the tip written for a repo", func(t *testing.T) {
+		fs, err := NewFileStore(t.TempDir(), "csv")
+		if err != nil {
+			t.Fatalf("unexpected file store error: %v", err)
+		}
+		defer fs.Close()
+		next := testLogRecord
+		next.RevID, next.NodeID = "1", "d3adb33f"
+
+		// SUT
+		err = fs.Persist(context.Background(), Results{Repo: testRepo, LogRecs: []LogRecord{testLogRecord, next}})
+		assert(t, err, nil)
+		got, err := fs.LastTip(context.Background(), testRepo)
+
+		assert(t, err, nil)
+		assertDeep(t, got, Tip{Rev: 1, Node: "d3adb33f"})
+	})
+}
+
+// readJSONL calls decode for each line of a JSON Lines file.
+func readJSONL(t *testing.T, path string, decode func(*json.Decoder) error) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected open error: %v", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if err := decode(json.NewDecoder(strings.NewReader(sc.Text()))); err != nil {
+			t.Fatalf("unexpected decode error: %v", err)
+		}
+	}
+}
+
+func readCSV(t *testing.T, path string) [][]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected open error: %v", err)
+	}
+	defer f.Close()
+
+	recs, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("unexpected csv error: %v", err)
+	}
+
+	return recs
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//// Repos of either version control system
+
+// VCSQueryer queries each repo with the LogQueryer of its version control
+// system as told by repoVCS, with anything not a Git repo left to Hg.
+type VCSQueryer struct {
+	Hg  LogQueryer
+	Git LogQueryer
+}
+
+func (vq VCSQueryer) QueryLogs(ctx context.Context, repo string, since Tip) (io.ReadCloser, error) {
+	return vq.queryer(repo).QueryLogs(ctx, repo, since)
+}
+
+func (vq VCSQueryer) LookupRev(ctx context.Context, repo, node string) (int, bool, error) {
+	return vq.queryer(repo).LookupRev(ctx, repo, node)
+}
+
+func (vq VCSQueryer) queryer(repo string) LogQueryer {
+	if repoVCS(repo) == vcsGit {
+		return vq.Git
+	}
+
+	return vq.Hg
+}
+
+//// Access Git process infrastructure
+
+// GitProc is a LogQueryer of Git repos, giving commits as the same log
+// entries hg gives changesets, with diffstats from numstat and tags and a
+// best effort branch from refs.
+//
+// Git has no revision numbers, so commits are numbered in a listing of all
+// commits reachable from refs, parents before children and otherwise oldest
+// first by commit date. A listing shifts as commits are fetched with older
+// dates, so when collecting after a tip, commits keep the revs stored for
+// them by Revs and only the rest are numbered, after the highest of those.
+// Without Revs, listing positions are used throughout, and commits fetched
+// with older dates are handled as rewritten history.
+type GitProc struct {
+	Revs RevFinder
+}
+
+func NewGitProc() GitProc {
+	return GitProc{}
+}
+
+// gitLogFormat renders each commit as a record of NUL separated fields,
+// followed by its numstat and summary lines.
+const gitLogFormat = `%x1e%H%x00%an <%ae>%x00%ai%x00%B%x00`
+
+// gitRecordSep starts each commit rendered by gitLogFormat.
+const gitRecordSep = '\x1e'
+
+// gitArgs runs git in repo, with paths in output quoted only if they must be.
+func gitArgs(repo string, args ...string) []string {
+	return append([]string{"-C", repo, "-c", "core.quotePath=false"}, args...)
+}
+
+func (g GitProc) QueryLogs(ctx context.Context, repo string, since Tip) (io.ReadCloser, error) {
+	commits, err := g.list(ctx, repo, since.Node != "")
+	if err != nil {
+		return nil, err
+	}
+
+	// only the commits after the tip are logged, in the order given
+	var nodes strings.Builder
+	for _, c := range commits {
+		if since.Node == "" || c.Rev > since.Rev {
+			nodes.WriteString(c.Node + "\n")
+		}
+	}
+	if nodes.Len() == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	po, err := startProc(ctx, "git", strings.NewReader(nodes.String()), gitArgs(repo,
+		"log", "--no-walk=unsorted", "--stdin", "--no-renames", "--numstat", "--summary",
+		"--diff-merges=first-parent", "--format="+gitLogFormat,
+	)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gitLogReader{po: po, out: bufio.NewReader(po), commits: commits, index: gitIndex(commits)}, nil
+}
+
+// LookupRev finds the rev of a stored tip commit, reporting whether the
+// commit is still reachable from the refs of the repo at all.
+func (g GitProc) LookupRev(ctx context.Context, repo, node string) (int, bool, error) {
+	commits, err := g.list(ctx, repo, true)
+	if err != nil {
+		return 0, false, err
+	}
+	i, found := gitIndex(commits)[node]
+	if !found {
+		return 0, false, nil
+	}
+
+	return commits[i].Rev, true, nil
+}
+
+// gitCommit is a commit as listed by GitProc, before its log entry is known.
+type gitCommit struct {
+	Rev     int
+	Node    string
+	Parents []string
+	Branch  string // best effort, see gitBranches
+	Tags    []string
+	Head    bool // checked out
+}
+
+// list lists the commits reachable from refs in rev order, with the revs
+// stored for them if stored is set. An empty repo has none. Stashes, notes,
+// replacements and the originals kept by filter-branch are not history of
+// the repo, so the refs holding them are left out.
+func (g GitProc) list(ctx context.Context, repo string, stored bool) ([]gitCommit, error) {
+	out, err := runProc(ctx, "git", gitArgs(repo,
+		"log", "--exclude=refs/stash", "--exclude=refs/notes/*", "--exclude=refs/original/*", "--exclude=refs/replace/*", "--all",
+		"--reverse", "--date-order", "--decorate=full", "--format=%H%x00%P%x00%D",
+	)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var commits []gitCommit
+	for _, l := range strings.Split(out, "\n") {
+		if l == "" {
+			continue
+		}
+		f := strings.Split(l, "\x00")
+		if len(f) != 3 {
+			return nil, fmt.Errorf("unexpected git log output: %#v", l)
+		}
+		c := gitCommit{Rev: len(commits), Node: f[0], Parents: strings.Fields(f[1])}
+		c.decorate(f[2])
+		commits = append(commits, c)
+	}
+	if stored && g.Revs != nil {
+		revs, err := g.Revs.StoredRevs(ctx, repo)
+		if err != nil {
+			return nil, err
+		}
+		renumber(commits, revs)
+	}
+	gitBranches(commits)
+
+	return commits, nil
+}
+
+// renumber gives listed commits their stored revs and the rest new revs after
+// the highest stored, in listing order, then sorts them by rev. Stored
+// commits that are no longer listed leave gaps.
+func renumber(commits []gitCommit, revs map[string]int) {
+	next := 0
+	for _, r := range revs {
+		if r >= next {
+			next = r + 1
+		}
+	}
+	for i, c := range commits {
+		if r, ok := revs[c.Node]; ok {
+			commits[i].Rev = r
+			continue
+		}
+		commits[i].Rev = next
+		next++
+	}
+	// parents were stored before their children, or are listed before them
+	sort.SliceStable(commits, func(i, j int) bool { return commits[i].Rev < commits[j].Rev })
+}
+
+// decorate takes the branch, tags and checkout of a commit from the full
+// refs decorating it, as shown like:
+//
+//	HEAD -> refs/heads/main, refs/remotes/origin/main, tag: refs/tags/v1.0
+//
+// A local branch is preferred, and otherwise a remote one is taken without
+// the name of its remote, so the branch is the same in clones.
+func (c *gitCommit) decorate(refs string) {
+	if refs == "" {
+		return
+	}
+	var remote string
+	for _, ref := range strings.Split(refs, ", ") {
+		switch {
+		case ref == "HEAD":
+			c.Head = true
+		case strings.HasPrefix(ref, "HEAD -> refs/heads/"):
+			c.Head = true
+			c.Branch = strings.TrimPrefix(ref, "HEAD -> refs/heads/")
+		case strings.HasPrefix(ref, "tag: refs/tags/"):
+			c.Tags = append(c.Tags, strings.TrimPrefix(ref, "tag: refs/tags/"))
+		case strings.HasPrefix(ref, "refs/heads/"):
+			if c.Branch == "" {
+				c.Branch = strings.TrimPrefix(ref, "refs/heads/")
+			}
+		case strings.HasPrefix(ref, "refs/remotes/") && !strings.HasSuffix(ref, "/HEAD"):
+			// remote default branches are not branches of their own
+			if i := strings.Index(ref[len("refs/remotes/"):], "/"); i >= 0 && remote == "" {
+				remote = ref[len("refs/remotes/")+i+1:]
+			}
+		}
+	}
+	if c.Branch == "" {
+		c.Branch = remote
+	}
+}
+
+// gitBranches gives commits not at the tip of a branch the branch of their
+// newest child having them as first parent, as git itself records no branch
+// for commits. Commits only reached through merges of deleted branches are
+// left without one.
+func gitBranches(commits []gitCommit) {
+	index := gitIndex(commits)
+	for i := len(commits) - 1; i >= 0; i-- {
+		c := commits[i]
+		if c.Branch == "" || len(c.Parents) == 0 {
+			continue
+		}
+		// children come after parents, so the newest is seen first
+		if p, ok := index[c.Parents[0]]; ok && commits[p].Branch == "" {
+			commits[p].Branch = c.Branch
+		}
+	}
+}
+
+// gitIndex maps the nodes of listed commits to their index in the listing.
+func gitIndex(commits []gitCommit) map[string]int {
+	index := make(map[string]int, len(commits))
+	for i, c := range commits {
+		index[c.Node] = i
+	}
+
+	return index
+}
+
+// gitLogReader converts git log output to a log entry per line of JSON as it
+// is read.
+type gitLogReader struct {
+	po      procOutput
+	out     *bufio.Reader
+	commits []gitCommit
+	index   map[string]int
+	buf     bytes.Buffer
+}
+
+func (lr *gitLogReader) Read(p []byte) (int, error) {
+	for lr.buf.Len() == 0 {
+		rec, err := lr.out.ReadString(gitRecordSep)
+		if rec = strings.TrimSuffix(rec, string(gitRecordSep)); rec != "" {
+			le, perr := lr.entry(rec)
+			if perr != nil {
+				return 0, perr
+			}
+			if perr := json.NewEncoder(&lr.buf).Encode(le); perr != nil {
+				return 0, perr
+			}
+		}
+		if err != nil {
+			if lr.buf.Len() > 0 {
+				break // the error is returned once the entry is read
+			}
+			return 0, err
+		}
+	}
+
+	return lr.buf.Read(p)
+}
+
+func (lr *gitLogReader) Close() error {
+	return lr.po.Close()
+}
+
+// entry parses a commit as rendered by gitLogFormat into a log entry, with
+// what is known of it from its listing.
+func (lr *gitLogReader) entry(rec string) (logEntry, error) {
+	f := strings.SplitN(rec, "\x00", 5)
+	if len(f) != 5 {
+		return logEntry{}, fmt.Errorf("unexpected git log record: %#v", rec)
+	}
+	i, ok := lr.index[f[0]]
+	if !ok {
+		return logEntry{}, fmt.Errorf("unexpected git log commit: %#v", f[0])
+	}
+	c := lr.commits[i]
+	rev := c.Rev
+
+	le := logEntry{
+		TS:        f[2],
+		Node:      c.Node,
+		Rev:       rev,
+		Author:    f[1],
+		Tags:      strings.Join(c.Tags, " "),
+		Branch:    c.Branch,
+		GraphNode: "o",
+		Desc:      strings.TrimRight(f[3], " \t\r\n"),
+		Numstat:   map[string][2]int{},
+		VCS:       vcsGit,
+	}
+	if c.Head {
+		le.GraphNode = "@"
+	}
+
+	// like hg, parents are only given when not just the previous rev
+	var parents []string
+	for i, p := range c.Parents {
+		switch i {
+		case 0:
+			le.P1Node = p
+		case 1:
+			le.P2Node = p
+		}
+		parents = append(parents, fmt.Sprintf("%d:%.12s", lr.rev(p), p))
+	}
+	if len(c.Parents) > 1 || (len(c.Parents) == 1 && lr.rev(c.Parents[0]) != rev-1) {
+		le.Parents = strings.Join(parents, " ")
+	}
+
+	// numstat lines are like: 1<tab>0<tab>path, with - for binary files, and
+	// summary lines like: create mode 100644 path
+	actions := map[string]string{}
+	var added, removed int
+	for _, l := range strings.Split(f[4], "\n") {
+		if s := strings.SplitN(strings.TrimSpace(l), " ", 4); len(s) == 4 && s[1] == "mode" {
+			actions[unquoteGitPath(s[3])] = s[0]
+			continue
+		}
+		n := strings.SplitN(l, "\t", 3)
+		if len(n) != 3 {
+			continue
+		}
+		path := unquoteGitPath(n[2])
+		a, _ := strconv.Atoi(n[0])
+		r, _ := strconv.Atoi(n[1])
+		le.Files = append(le.Files, path)
+		le.Numstat[path] = [2]int{a, r}
+		added += a
+		removed += r
+	}
+	for _, p := range le.Files {
+		switch actions[p] {
+		case "create":
+			le.FileAdds = append(le.FileAdds, p)
+		case "delete":
+			le.FileDels = append(le.FileDels, p)
+		default:
+			le.FileMods = append(le.FileMods, p)
+		}
+	}
+	le.DiffStat = fmt.Sprintf("%d: +%d/-%d", len(le.Files), added, removed)
+
+	return le, nil
+}
+
+// rev is the rev of a listed commit.
+func (lr *gitLogReader) rev(node string) int {
+	return lr.commits[lr.index[node]].Rev
+}
+
+// unquoteGitPath unquotes a path git quoted for having special characters.
+func unquoteGitPath(p string) string {
+	if !strings.HasPrefix(p, `"`) {
+		return p
+	}
+	if u, err := strconv.Unquote(p); err == nil {
+		return u
+	}
+
+	return p
+}
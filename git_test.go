@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestGitRepo creates a Git repo with commits on main and a merged feat
+// branch, committed at fixed times so their nodes never change.
+func newTestGitRepo(t *testing.T) (string, func(args ...string) string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	var commits int
+	git := func(args ...string) string {
+		t.Helper()
+		if args[0] == "commit" || args[0] == "merge" {
+			commits++
+		}
+		ts := time.Date(2022, 6, 10, 23, 43, commits, 0, time.FixedZone("", 2*3600)).Format(time.RFC3339)
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1",
+			"GIT_AUTHOR_NAME=Some User", "GIT_AUTHOR_EMAIL=some.user@email.com", "GIT_AUTHOR_DATE="+ts,
+			"GIT_COMMITTER_NAME=Some User", "GIT_COMMITTER_EMAIL=some.user@email.com", "GIT_COMMITTER_DATE="+ts,
+		)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("unexpected git %v error: %v - %s", args[0], err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+	}
+
+	git("init", "--quiet", "--initial-branch=main")
+	write("hi.txt", "hello world\n")
+	write("logo.bin", "\x00\x01")
+	git("add", ".")
+	git("commit", "--quiet", "--message=initial commit\n\nwith a body\n")
+	git("checkout", "--quiet", "-b", "feat")
+	write("hi.txt", "hello world\nhello again\n")
+	git("commit", "--quiet", "--all", "--message=feature")
+	git("tag", "--annotate", "v1.0", "--message=release")
+	git("checkout", "--quiet", "main")
+	git("rm", "--quiet", "logo.bin")
+	write("spaced out.txt", "one\ntwo\n")
+	git("add", ".")
+	git("commit", "--quiet", "--message=second")
+	git("merge", "--quiet", "--no-edit", "feat")
+
+	return dir, git
+}
+
+func TestGitQueryLogs(t *testing.T) {
+	t.Run("can be obtained like hg output", func(t *testing.T) {
+		repo, git := newTestGitRepo(t)
+		nodes := strings.Fields(git("log", "--reverse", "--date-order", "--all", "--format=%H"))
+
+		// SUT
+		res, err := NewDataReader(NewGitProc()).Obtain(context.Background(), repo, Tip{})
+
+		assert(t, err, nil)
+		assert(t, len(res.ErrEvents), 0)
+		assert(t, len(res.LogRecs), 4)
+		first, feat, second, merge := res.LogRecs[0], res.LogRecs[1], res.LogRecs[2], res.LogRecs[3]
+		for i, r := range res.LogRecs {
+			assert(t, r.NodeID, nodes[i])
+			assert(t, r.Rev, i)
+			assert(t, r.VCS, vcsGit)
+			assert(t, r.AuthorEmail, "some.user@email.com")
+		}
+
+		assert(t, first.TS, "2022-06-10 23:43:01 +0200")
+		assert(t, first.Time.Unix(), time.Date(2022, 6, 10, 21, 43, 1, 0, time.UTC).Unix())
+		assert(t, first.Description, "initial commit\n\nwith a body")
+		assert(t, first.Branch, "main")
+		assert(t, first.DiffStat, "2: +1/-0")
+		assertDeep(t, first.FileChanges, []FileChange{
+			{Path: "hi.txt", Action: "added", Added: 1},
+			{Path: "logo.bin", Action: "added"},
+		})
+
+		assert(t, feat.Branch, "feat")
+		assert(t, feat.Tags, "v1.0")
+		assert(t, feat.P1Node, first.NodeID)
+		assert(t, feat.ParentIDs, "")
+		assertDeep(t, feat.FileChanges, []FileChange{{Path: "hi.txt", Action: "modified", Added: 1}})
+
+		assert(t, second.ParentIDs, "0:"+first.NodeID[:12])
+		assertDeep(t, second.FileChanges, []FileChange{
+			{Path: "spaced out.txt", Action: "added", Added: 2},
+			{Path: "logo.bin", Action: "removed"},
+		})
+		assert(t, second.Files, "logo.bin spaced out.txt")
+
+		assert(t, merge.Branch, "main")
+		assert(t, merge.GraphNode, "@")
+		assert(t, merge.P1Node, second.NodeID)
+		assert(t, merge.P2Node, feat.NodeID)
+		assert(t, merge.DiffStat, "1: +1/-0") // against the first parent
+	})
+
+	t.Run("can query only commits after a tip", func(t *testing.T) {
+		repo, _ := newTestGitRepo(t)
+		dr := NewDataReader(NewGitProc())
+		all, err := dr.Obtain(context.Background(), repo, Tip{})
+		if err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+		tip := Tip{Rev: 1, Node: all.LogRecs[1].NodeID}
+
+		// SUT
+		res, err := dr.Obtain(context.Background(), repo, tip)
+
+		assert(t, err, nil)
+		assert(t, res.Rewritten, false)
+		assertDeep(t, res.LogRecs, all.LogRecs[2:])
+	})
+
+	t.Run("can keep stored revs when older commits are fetched", func(t *testing.T) {
+		repo, git := newTestGitRepo(t)
+		all, err := NewDataReader(NewGitProc()).Obtain(context.Background(), repo, Tip{})
+		if err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+		stored := mockRevFinder{}
+		for _, r := range all.LogRecs {
+			stored[r.NodeID] = r.Rev
+		}
+		// a branch off the first commit, dated before all the others so it
+		// is listed right after it
+		first := all.LogRecs[0].NodeID
+		git("checkout", "--quiet", "-b", "old", first)
+		cmd := exec.Command("git", "-C", repo, "commit", "--quiet", "--allow-empty", "--message=old")
+		cmd.Env = append(os.Environ(),
+			"GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1",
+			"GIT_AUTHOR_NAME=Some User", "GIT_AUTHOR_EMAIL=some.user@email.com", "GIT_AUTHOR_DATE=2000-01-01T00:00:00Z",
+			"GIT_COMMITTER_NAME=Some User", "GIT_COMMITTER_EMAIL=some.user@email.com", "GIT_COMMITTER_DATE=2000-01-01T00:00:00Z",
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("unexpected git commit error: %v - %s", err, out)
+		}
+		gp := NewGitProc()
+		gp.Revs = stored
+		tip := Tip{Rev: 3, Node: all.LogRecs[3].NodeID}
+
+		// SUT
+		res, err := NewDataReader(gp).Obtain(context.Background(), repo, tip)
+
+		assert(t, err, nil)
+		assert(t, res.Rewritten, false)
+		assert(t, len(res.LogRecs), 1)
+		assert(t, res.LogRecs[0].Description, "old")
+		assert(t, res.LogRecs[0].Rev, 4)
+		assert(t, res.LogRecs[0].ParentIDs, "0:"+first[:12])
+	})
+
+	t.Run("can detect rewritten history", func(t *testing.T) {
+		repo, git := newTestGitRepo(t)
+		dr := NewDataReader(NewGitProc())
+		all, err := dr.Obtain(context.Background(), repo, Tip{})
+		if err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+		git("commit", "--quiet", "--amend", "--message=amended merge")
+		tip := Tip{Rev: 3, Node: all.LogRecs[3].NodeID}
+
+		// SUT
+		res, err := dr.Obtain(context.Background(), repo, tip)
+
+		assert(t, err, nil)
+		assert(t, res.Rewritten, true)
+		assert(t, len(res.LogRecs), 4)
+		assert(t, res.LogRecs[3].Description, "amended merge")
+	})
+
+	t.Run("can leave out commits only reachable from notes and originals", func(t *testing.T) {
+		repo, git := newTestGitRepo(t)
+		merge := git("rev-parse", "HEAD")
+		git("notes", "add", "--message=reviewed", merge)
+		git("commit", "--quiet", "--amend", "--message=amended merge")
+		git("update-ref", "refs/original/refs/heads/main", merge)
+		nodes := strings.Fields(git("log", "--reverse", "--date-order", "--branches", "--tags", "--format=%H"))
+
+		// SUT
+		res, err := NewDataReader(NewGitProc()).Obtain(context.Background(), repo, Tip{})
+
+		assert(t, err, nil)
+		assert(t, len(res.LogRecs), len(nodes))
+		for i, r := range res.LogRecs {
+			assert(t, r.NodeID, nodes[i])
+		}
+	})
+
+	t.Run("can take branches of clones from their remote", func(t *testing.T) {
+		origin, git := newTestGitRepo(t)
+		repo := t.TempDir()
+		git("clone", "--quiet", origin, repo)
+
+		// SUT
+		res, err := NewDataReader(NewGitProc()).Obtain(context.Background(), repo, Tip{})
+
+		assert(t, err, nil)
+		assert(t, len(res.LogRecs), 4)
+		assert(t, res.LogRecs[1].Branch, "feat")
+		assert(t, res.LogRecs[3].Branch, "main")
+	})
+
+	t.Run("can prefer local branches to remote ones", func(t *testing.T) {
+		repo, git := newTestGitRepo(t)
+		git("update-ref", "refs/remotes/origin/upstream", git("rev-parse", "feat"))
+
+		// SUT
+		res, err := NewDataReader(NewGitProc()).Obtain(context.Background(), repo, Tip{})
+
+		assert(t, err, nil)
+		assert(t, len(res.LogRecs), 4)
+		assert(t, res.LogRecs[1].Branch, "feat")
+	})
+
+	t.Run("can query an empty repo", func(t *testing.T) {
+		_, git := newTestGitRepo(t)
+		repo := t.TempDir()
+		git("init", "--quiet", repo)
+
+		// SUT
+		res, err := NewDataReader(NewGitProc()).Obtain(context.Background(), repo, Tip{})
+
+		assert(t, err, nil)
+		assert(t, len(res.ErrEvents), 0)
+		assert(t, len(res.LogRecs), 0)
+	})
+
+	t.Run("can report git missing from the path", func(t *testing.T) {
+		t.Setenv("PATH", t.TempDir())
+
+		// SUT
+		res, err := NewDataReader(NewGitProc()).Obtain(context.Background(), t.TempDir(), Tip{})
+
+		assert(t, err, nil)
+		assert(t, len(res.ErrEvents), 1)
+		assert(t, res.ErrEvents[0].Err, exec.ErrNotFound)
+	})
+
+	t.Run("can report a directory that is no repo", func(t *testing.T) {
+		_, _ = newTestGitRepo(t)
+
+		// SUT
+		res, err := NewDataReader(NewGitProc()).Obtain(context.Background(), t.TempDir(), Tip{})
+
+		assert(t, err, nil)
+		assert(t, len(res.ErrEvents), 1)
+	})
+}
+
+// mockRevFinder holds the stored revs of a single repo.
+type mockRevFinder map[string]int
+
+func (m mockRevFinder) StoredRevs(ctx context.Context, repo string) (map[string]int, error) {
+	return m, nil
+}
+
+// mockVCSQry answers with the name of the queryer asked.
+type mockVCSQry string
+
+func (m mockVCSQry) QueryLogs(ctx context.Context, repo string, since Tip) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(string(m))), nil
+}
+
+func (m mockVCSQry) LookupRev(ctx context.Context, repo, node string) (int, bool, error) {
+	return 0, string(m) == vcsGit, nil
+}
+
+func TestVCSQueryer(t *testing.T) {
+	t.Run("can query each repo by its version control system", func(t *testing.T) {
+		root := t.TempDir()
+		for _, p := range []string{"hg/.hg/requires", "git/.git/HEAD", "bare.git/HEAD", "bare.git/objects/", "bare.git/refs/"} {
+			if err := os.MkdirAll(filepath.Join(root, filepath.Dir(p)), 0o755); err != nil {
+				t.Fatalf("unexpected setup error: %v", err)
+			}
+			if !strings.HasSuffix(p, "/") {
+				if err := os.WriteFile(filepath.Join(root, p), nil, 0o644); err != nil {
+					t.Fatalf("unexpected setup error: %v", err)
+				}
+			}
+		}
+		vq := VCSQueryer{Hg: mockVCSQry(vcsHg), Git: mockVCSQry(vcsGit)}
+
+		for repo, want := range map[string]string{"hg": vcsHg, "git": vcsGit, "bare.git": vcsGit, "none": vcsHg} {
+			// SUT
+			rc, err := vq.QueryLogs(context.Background(), filepath.Join(root, repo), Tip{})
+			assert(t, err, nil)
+			got, _ := io.ReadAll(rc)
+			_, found, _ := vq.LookupRev(context.Background(), filepath.Join(root, repo), "")
+
+			assert(t, string(got), want)
+			assert(t, found, want == vcsGit)
+		}
+	})
+}
@@ -3,6 +3,8 @@ module github.com/cybertooth-systems/merc-log-collect
 go 1.18
 
 require (
-	github.com/DATA-DOG/go-sqlmock v1.5.0 // indirect
-	github.com/mattn/go-sqlite3 v1.14.13 // indirect
+	github.com/DATA-DOG/go-sqlmock v1.5.0
+	github.com/klauspost/compress v1.15.15
+	github.com/lib/pq v1.9.0
+	github.com/mattn/go-sqlite3 v1.14.13
 )
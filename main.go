@@ -1,108 +1,140 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"database/sql"
-	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 func main() {
+	// subcommands are given before any of their flags
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			migrateMain(os.Args[2:])
+			return
+		case "remap":
+			remapMain(os.Args[2:])
+			return
+		}
+	}
+
 	// handle flags
 	var (
-		debug  = flag.Bool("D", false, "enable debug logging")
-		repos  = flag.String("R", "", "parent directory containing repos in separate child directories (if set, will ignore -r)")
-		repo   = flag.String("r", "", "a single repo directory (will be ignored if -R is set)")
-		dbFile = flag.String("d", "", "file path for SQLite database file of the results")
-		n      = flag.Int("n", 1, "parallel workers to process repo directories (only works when -R is used)")
-		omit   = flag.String("o", "", "list of repos to omit (only works when -R is used)")
+		debug    = flag.Bool("D", false, "enable debug logging")
+		manifest = flag.String("M", "", "manifest file listing repos by path, one per line or as JSON or CSV with metadata, - for stdin (if set, will ignore -R and -r)")
+		repos    = flag.String("R", "", "parent directory searched for repos, see -L (if set, will ignore -r)")
+		repo     = flag.String("r", "", "a single repo directory (will be ignored if -R is set)")
+		dbFile   = flag.String("d", "", "file path for SQLite database file of the results")
+		pgDSN    = flag.String("p", "", "PostgreSQL connection string for the results (if set, will ignore -d)")
+		sqlSync  = flag.String("S", defaultSQLiteSync, "SQLite synchronous level, one of: OFF, NORMAL, FULL, EXTRA (only works when -d is used)")
+		format   = flag.String("f", "", "write the results to flat files of this format instead of a database, one of: "+fileFormatNames())
+		outDir   = flag.String("O", ".", "directory for the flat files of the results (only works when -f is used)")
+		n        = flag.Int("n", 1, "parallel workers to process repo directories (only works when -R or -M is used)")
+		tmout    = flag.Duration("t", 0, "timeout for querying each repo, e.g. 30m (0 means no timeout)")
+		tries    = flag.Int("a", defaultRetryPolicy.Attempts, "attempts at collecting a repo with transient errors (1 disables retries)")
+		wait     = flag.Duration("w", defaultRetryPolicy.Base, "wait before the first retry, doubling for each one after")
+		dryRun   = flag.Bool("N", false, "print the repos that would be collected and the directories skipped, then exit (only works when -R is used)")
+		depth    = flag.Int("L", 1, "levels of directories below -R searched for repos, 1 for only its children (0 means no limit)")
+		subrepos = flag.Bool("U", false, "also search inside repos for subrepos (only works when -R is used)")
+		bknd     = flag.String("b", "hg", "log query backend of Mercurial repos, either \"hg\" processes or \"native\" revlog reading (Git repos are queried with git)")
+		mirrors  = flag.String("C", "", "directory caching local mirrors of repos given by URL, cloned when first seen and pulled on each run (needs hg, even with -b native)")
+		batch    = flag.Int("s", defaultBatchSize, "log records persisted per batch while a repo is still being queried (0 persists each repo at once)")
+		mailmap  = flag.String("m", "", "mailmap file merging author identities for authors not yet collected (use the remap command for the rest)")
 	)
 
+	var omitFiles, excludes, includeFiles, includes ruleFlag
+	flag.Var(&omitFiles, "o", "file of rules excluding directories by their path relative to -R, repeatable (only works when -R is used)")
+	flag.Var(&excludes, "x", "rule excluding directories by their path relative to -R, e.g. 'team/*-old', repeatable (only works when -R is used)")
+	flag.Var(&includeFiles, "I", "file of rules including repos by their path relative to -R, repeatable (only works when -R is used)")
+	flag.Var(&includes, "i", "rule including repos by their path relative to -R, e.g. 're:^team/', repeatable (only works when -R is used)")
+
 	flag.Parse()
 
 	// setup global logging
 	Log = newAppLog(logConfig{debug: *debug})
 
-	// setup database
-	Log.Infof("using dbFile: %#v", *dbFile)
-	db, err := sql.Open("sqlite3", *dbFile)
-	if err != nil {
-		panic(fmt.Sprintf("fatal database open error: %v", err))
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		panic(fmt.Sprintf("fatal database txn begin error: %v", err))
-	}
-	defer tx.Rollback()
-	sqlB, err := ioutil.ReadFile("./db-migration.sql")
-	if err != nil {
-		panic(err)
-	}
-	if _, err := tx.Exec(string(sqlB)); err != nil {
-		panic(err)
-	}
-	if err := tx.Commit(); err != nil {
-		panic(err)
-	}
-	defer db.Close()
-
-	// setup injected dependencies
-	store := NewStore(db)
-	drdr := NewDataReader(NewProc())
-
 	// setup workload
 	rl := RepoList{}
+	var man Manifest
 	var jobs int
 	switch {
+	case *manifest != "":
+		jobs = *n
+		Log.Infof("using repo manifest: %#v", *manifest)
+
+		var err error
+		if man, err = LoadManifest(*manifest); err != nil {
+			panic(fmt.Sprintf("fatal manifest error: %v", err))
+		}
+		rl = man.RepoList()
 	case *repos != "":
 		jobs = *n
 		Log.Infof("using repos dir: %#v", *repos)
 
-		// make a map of omitted repos for quick lookup to omit from repo list
-		oMap := map[string]struct{}{}
-		if *omit != "" {
-			ob, err := ioutil.ReadFile(*omit)
-			if err != nil {
-				panic(fmt.Sprintf("fatal omit file read error: %v", err))
-			}
-			Log.Infof("processing repo omit file: %v", *omit)
-
-			oSplit := strings.Split(string(ob), "\n")
-			for _, o := range oSplit {
-				oStr := strings.TrimSpace(o)
-				if oStr != "" {
-					oMap[oStr] = struct{}{}
+		filter := &RepoFilter{}
+		for _, rules := range []struct {
+			include bool
+			files   ruleFlag
+			flags   ruleFlag
+			flag    string
+		}{{false, omitFiles, excludes, "-x"}, {true, includeFiles, includes, "-i"}} {
+			for _, f := range rules.files {
+				if err := filter.AddFile(rules.include, f); err != nil {
+					panic(fmt.Sprintf("fatal rule file error: %v", err))
 				}
+				Log.Infof("processing rule file: %v", f)
 			}
-			if len(oMap) == 0 {
-				panic(fmt.Sprintf("fatal omit file resulted in nothing: %v", *omit))
+			for _, r := range rules.flags {
+				if err := filter.AddRule(rules.include, rules.flag, r); err != nil {
+					panic(fmt.Sprintf("fatal rule error: %v", err))
+				}
 			}
-
-			Log.Infof("count of repos to omit: %v", len(oMap))
 		}
+		Log.Infof("count of include rules: %v, exclude rules: %v", len(filter.Include), len(filter.Exclude))
 
-		dir, err := os.ReadDir(filepath.Clean(*repos))
+		disc := Discovery{MaxDepth: *depth, Subrepos: *subrepos, Filter: filter}
+		found, err := disc.Discover(filepath.Clean(*repos))
 		if err != nil {
 			panic(fmt.Sprintf("fatal repo directory read error: %v", err))
 		}
+		for _, s := range found.Skipped {
+			Log.Infof("non-repo directory skipped: %#v", s)
+		}
+		for _, ex := range found.Excluded {
+			Log.Debugf("directory excluded: %#v by %v", ex.Path, ex.Rule)
+		}
+		Log.Infof(
+			"count of non-repo directories skipped: %v, directories excluded: %v",
+			len(found.Skipped), len(found.Excluded),
+		)
+		rl = found.Repos
 
-		for _, r := range dir {
-			if r.IsDir() {
-				if _, omitted := oMap[r.Name()]; !omitted {
-					path := filepath.Join(filepath.Clean(*repos), r.Name())
-					rl = append(rl, path)
-				}
-			}
+		if *dryRun {
+			printDryRun(os.Stdout, found)
+			return
 		}
 	case *repo != "":
 		jobs = 1
@@ -115,16 +147,306 @@ func main() {
 
 	Log.Infof("count of repos to be processed: %v", len(rl))
 
+	var mm *Mailmap
+	if *mailmap != "" {
+		var err error
+		if mm, err = LoadMailmap(*mailmap); err != nil {
+			panic(fmt.Sprintf("fatal mailmap error: %v", err))
+		}
+		Log.Infof("using mailmap: %#v", *mailmap)
+	}
+
+	// setup persistence, runs are only recorded in a database
+	var (
+		per   Persister
+		store *Store
+		files *FileStore
+	)
+	if *format != "" {
+		var err error
+		files, err = NewFileStore(*outDir, *format)
+		if err != nil {
+			panic(fmt.Sprintf("fatal output file error: %v", err))
+		}
+		files.Mailmap = mm
+		Log.Infof("using %v files in: %#v", *format, *outDir)
+		per = files
+	} else {
+		db, d := openDB(*dbFile, *pgDSN, *sqlSync)
+		defer db.Close()
+		if err := CheckSchema(context.Background(), db, d); err != nil {
+			panic(fmt.Sprintf("fatal database schema error: %v", err))
+		}
+
+		store = NewStore(db)
+		if d.Name == postgresDialect.Name {
+			store = NewPostgresStore(db)
+		}
+		store.Mailmap = mm
+		defer store.Close()
+		per = store
+	}
+
+	if mp, ok := per.(ManifestPersister); ok && man != nil {
+		if err := mp.PersistManifest(context.Background(), man); err != nil {
+			panic(fmt.Sprintf("fatal manifest persist error: %v", err))
+		}
+	}
+
+	// setup injected dependencies
+	var lq LogQueryer
+	switch *bknd {
+	case "hg":
+		lq = NewProc()
+	case "native":
+		lq = NewRevlogReader()
+	default:
+		panic(fmt.Sprintf("unknown log query backend: %#v", *bknd))
+	}
+	gp := NewGitProc()
+	if rf, ok := per.(RevFinder); ok {
+		gp.Revs = rf
+	}
+	lq = VCSQueryer{Hg: lq, Git: gp}
+	if *mirrors != "" {
+		// mirrors are cloned and pulled with hg whatever the backend
+		if _, err := exec.LookPath("hg"); err != nil {
+			panic(fmt.Sprintf("fatal mirror error, hg is needed to sync mirrors: %v", err))
+		}
+		mq, err := NewMirrorQueryer(lq, *mirrors)
+		if err != nil {
+			panic(fmt.Sprintf("fatal mirror directory error: %v", err))
+		}
+		Log.Infof("using mirror directory: %#v", *mirrors)
+		lq = mq
+	}
+	drdr := NewDataReader(lq)
+
+	// stop gracefully on the first signal, a second one exits immediately
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		signal.Stop(sigs)
+		Log.Infof("STOPPING on %v. Waiting for in-flight repos to persist, signal again to quit now", sig)
+		cancel()
+	}()
+
 	// begin execution
 	start := time.Now()
-	cs := NewCollSrvc(drdr, store, jobs)
-	Log.Infof("STARTING. Worker pool size: %v", cap(cs.WorkerPool))
-	cs.CollectLogs(rl)
+	cs := NewCollSrvc(drdr, per, jobs)
+	cs.BatchSize = *batch
+	cs.Timeout = *tmout
+	cs.Retry.Attempts = *tries
+	cs.Retry.Base = *wait
+	host, err := os.Hostname()
+	if err != nil {
+		Log.Infof("ERROR getting hostname for run: %v", err)
+	}
+	run := &Run{
+		StartedAt: start.Format(Log.tsfmt),
+		Flags:     setFlags(),
+		Host:      host,
+		Version:   toolVersion(),
+	}
+	if store != nil {
+		if err := store.StartRun(ctx, run); err != nil {
+			panic(fmt.Sprintf("fatal run start error: %v", err))
+		}
+	}
+	Log.Infof("STARTING run %v. Worker pool size: %v", run.ID, cap(cs.WorkerPool))
+	cs.CollectLogs(ctx, rl)
 
 	cs.WG.Wait()
+	sum := cs.Summary()
+	Log.Infof(
+		"SUMMARY. collected: %v, failed: %v, interrupted: %v, skipped: %v",
+		len(sum.Collected), len(sum.Failed), len(sum.Interrupted), len(sum.Skipped),
+	)
+	for _, r := range sum.Failed {
+		Log.Infof("failed repo: %#v", r)
+	}
+	for _, r := range sum.Interrupted {
+		Log.Infof("interrupted repo: %#v", r)
+	}
+	for _, r := range sum.Skipped {
+		Log.Infof("skipped repo: %#v", r)
+	}
+
+	if files != nil {
+		// output of a cancelled run keeps its partial names, as some repos
+		// are missing from it or only partly in it
+		closeFiles := files.Close
+		if ctx.Err() != nil || len(sum.Interrupted) > 0 || len(sum.Skipped) > 0 {
+			Log.Infof("leaving output files of the cancelled run partial in: %v", *outDir)
+			closeFiles = files.CloseIncomplete
+		}
+		if err := closeFiles(); err != nil {
+			Log.Infof("ERROR completing output files: %v", err)
+		}
+	}
+	if store != nil {
+		run.EndedAt = time.Now().Format(Log.tsfmt)
+		run.ReposAttempted = len(sum.Collected) + len(sum.Failed) + len(sum.Interrupted)
+		run.ReposSucceeded = len(sum.Collected)
+		run.ReposFailed = len(sum.Failed)
+		if err := store.EndRun(context.Background(), run); err != nil {
+			Log.Infof("ERROR recording end of run: %v", err)
+		}
+	}
 	Log.Infof("DONE. Time elapsed: %v", time.Since(start).String())
 }
 
+// version is set at build time with -ldflags "-X main.version=...",
+// otherwise it is taken from the module build info.
+var version string
+
+func toolVersion() string {
+	if version != "" {
+		return version
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	v := bi.Main.Version
+	for _, s := range bi.Settings {
+		if s.Key == "vcs.revision" {
+			v += " " + s.Value
+		}
+	}
+
+	return v
+}
+
+// setFlags lists the flags given on the command line, as recorded for a run.
+// The password of the -p connection string is redacted.
+func setFlags() string {
+	var fl []string
+	flag.Visit(func(f *flag.Flag) {
+		v := f.Value.String()
+		if f.Name == "p" {
+			v = redactDSN(v)
+		}
+		fl = append(fl, fmt.Sprintf("-%s=%s", f.Name, v))
+	})
+
+	return strings.Join(fl, " ")
+}
+
+// dsnPasswordRE matches the password of a key/value connection string, or
+// of a URL query parameter, quoted or not.
+var dsnPasswordRE = regexp.MustCompile(`(?i)(\bpassword\s*=\s*)('(?:\\.|[^'])*'|[^\s&]*)`)
+
+// redactDSN masks any password in a PostgreSQL connection string, given
+// either as a URL or as key/value pairs.
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		}
+		dsn = u.String()
+	}
+
+	return dsnPasswordRE.ReplaceAllString(dsn, "${1}xxxxx")
+}
+
+// migrateMain upgrades the schema of an existing database in place.
+func migrateMain(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	var (
+		debug  = fs.Bool("D", false, "enable debug logging")
+		dbFile = fs.String("d", "", "file path for SQLite database file to upgrade")
+		pgDSN  = fs.String("p", "", "PostgreSQL connection string of the database to upgrade (if set, will ignore -d)")
+	)
+	fs.Parse(args)
+
+	Log = newAppLog(logConfig{debug: *debug})
+
+	if *dbFile == "" && *pgDSN == "" {
+		panic("no database specified, aborting")
+	}
+	db, d := openDB(*dbFile, *pgDSN, defaultSQLiteSync)
+	defer db.Close()
+
+	from, to, err := Migrate(context.Background(), db, d)
+	if err != nil {
+		panic(fmt.Sprintf("fatal migration error at version %v: %v", to, err))
+	}
+	Log.Infof("DONE. Database schema migrated from version %v to %v", from, to)
+}
+
+// remapMain re-applies a mailmap to the authors of an existing database.
+func remapMain(args []string) {
+	fs := flag.NewFlagSet("remap", flag.ExitOnError)
+	var (
+		debug   = fs.Bool("D", false, "enable debug logging")
+		dbFile  = fs.String("d", "", "file path for SQLite database file to remap")
+		pgDSN   = fs.String("p", "", "PostgreSQL connection string of the database to remap (if set, will ignore -d)")
+		mailmap = fs.String("m", "", "mailmap file merging author identities (if not set, all merges are undone)")
+	)
+	fs.Parse(args)
+
+	Log = newAppLog(logConfig{debug: *debug})
+
+	if *dbFile == "" && *pgDSN == "" {
+		panic("no database specified, aborting")
+	}
+	var mm *Mailmap
+	if *mailmap != "" {
+		var err error
+		if mm, err = LoadMailmap(*mailmap); err != nil {
+			panic(fmt.Sprintf("fatal mailmap error: %v", err))
+		}
+	}
+	db, d := openDB(*dbFile, *pgDSN, defaultSQLiteSync)
+	defer db.Close()
+	if err := CheckSchema(context.Background(), db, d); err != nil {
+		panic(fmt.Sprintf("fatal database schema error: %v", err))
+	}
+
+	n, err := RemapAuthors(context.Background(), db, d, mm)
+	if err != nil {
+		panic(fmt.Sprintf("fatal remap error: %v", err))
+	}
+	Log.Infof("DONE. Canonical identities of %v authors changed", n)
+}
+
+// openDB opens the Postgres database of a DSN if given, otherwise the
+// SQLite database file with the synchronous level of sqliteSync.
+func openDB(dbFile, pgDSN, sqliteSync string) (*sql.DB, dialect) {
+	d, src := sqliteDialect, sqliteDSN(dbFile, sqliteSync)
+	if pgDSN != "" {
+		d, src = postgresDialect, pgDSN
+		Log.Infof("using PostgreSQL database")
+	} else {
+		Log.Infof("using dbFile: %#v", dbFile)
+	}
+
+	db, err := sql.Open(d.Driver, src)
+	if err != nil {
+		panic(fmt.Sprintf("fatal database open error: %v", err))
+	}
+	if err := db.Ping(); err != nil {
+		panic(fmt.Sprintf("fatal database connection error: %v", err))
+	}
+
+	return db, d
+}
+
+// defaultSQLiteSync cannot corrupt a database in WAL mode, a power failure
+// only loses the last commits, which the next run collects again.
+const defaultSQLiteSync = "NORMAL"
+
+// sqliteDSN opens a SQLite database file in WAL mode, so reads such as
+// LastTip are not blocked by the writer's transactions.
+func sqliteDSN(file, sync string) string {
+	return file + "?_journal_mode=WAL&_busy_timeout=5000&_synchronous=" + url.QueryEscape(sync)
+}
+
 var Log appLog
 
 func (l appLog) Infof(format string, v ...interface{}) {
@@ -149,7 +471,7 @@ type logConfig struct {
 const debugPrefix string = "DEBUG "
 
 func newAppLog(lc logConfig) appLog {
-	tf := "2006-01-02 03:04:05 -0700" // match mercurial '{date|isodatesec}'
+	tf := hgDateFmt // match mercurial '{date|isodatesec}'
 	switch {
 	case lc.debug:
 		return appLog{
@@ -169,8 +491,27 @@ func newAppLog(lc logConfig) appLog {
 }
 
 type Results struct {
+	Repo      string
+	Rewritten bool // history was rewritten, stored logs for Repo are stale
 	LogRecs   []LogRecord
 	ErrEvents []ErrorEvent
+	Status    *RepoStatus // how collecting Repo is going, nil if untracked
+}
+
+// RepoStatus is the progress of collecting a repo, persisted along with the
+// Results it belongs to.
+type RepoStatus struct {
+	Started  time.Time   // start of collecting the repo
+	Finished time.Time   // zero if collecting the repo was cancelled
+	Failed   bool        // once finished, whether the last attempt had errors
+	LastErr  *ErrorEvent // the last error event of the last attempt, if any
+}
+
+// Tip is the highest revision already collected for a repo. The zero value
+// means nothing has been collected yet, so all logs should be queried.
+type Tip struct {
+	Rev  int
+	Node string
 }
 
 type LogRecord struct {
@@ -185,12 +526,80 @@ type LogRecord struct {
 	Files     string
 	GraphNode string
 	RepoPath  string
+
+	Description string
+	FileChanges []FileChange
+
+	// typed values of TS, RevID and DiffStat
+	Time         time.Time // zero if TS could not be parsed
+	Rev          int
+	FilesChanged int
+	LinesAdded   int
+	LinesRemoved int
+
+	// full nodes of the first and second parents, empty for none
+	P1Node string
+	P2Node string
+
+	// Author split into its name and email, as committed
+	AuthorName  string
+	AuthorEmail string
+
+	VCS string // version control system of the repo, vcsHg or vcsGit
+}
+
+// nullNode is the parent node hg gives a changeset without that parent.
+const nullNode = "0000000000000000000000000000000000000000"
+
+// hgDateFmt is the format of '{date|isodatesec}', as LogRecord TS.
+const hgDateFmt = "2006-01-02 15:04:05 -0700"
+
+// epoch is Time as stored, in seconds since the Unix epoch and the offset of
+// its zone in seconds east of UTC, both invalid if Time is unknown.
+func (r LogRecord) epoch() (sql.NullInt64, sql.NullInt64) {
+	if r.Time.IsZero() {
+		return sql.NullInt64{}, sql.NullInt64{}
+	}
+	_, off := r.Time.Zone()
+
+	return sql.NullInt64{Int64: r.Time.Unix(), Valid: true}, sql.NullInt64{Int64: int64(off), Valid: true}
+}
+
+// FileChange is a file added, modified or removed by a changeset, with the
+// lines changed in it.
+type FileChange struct {
+	Path    string
+	Action  string
+	Added   int
+	Removed int
 }
 
 type ErrorEvent struct {
-	TS   string
-	Err  error
-	Path string
+	TS      string
+	Err     error
+	Path    string
+	Kind    string
+	Attempt int // collection attempt of the repo, counting from 1
+}
+
+// ErrorEvent kinds, so distinct failures can be told apart in storage.
+const (
+	ErrKindError   = "error"
+	ErrKindTimeout = "timeout"
+	ErrKindPull    = "pull" // the mirror of a remote repo could not be synced
+)
+
+// errKind is the ErrorEvent kind of an error.
+func errKind(err error) string {
+	var pe *PullError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrKindTimeout
+	case errors.As(err, &pe):
+		return ErrKindPull
+	}
+
+	return ErrKindError
 }
 
 //// USECASE: LogCollection
@@ -208,16 +617,53 @@ type CollSrvc struct {
 	Persister
 	WorkerPool chan struct{}
 	WG         sync.WaitGroup
+	BatchSize  int           // log records per streamed batch, 0 disables streaming
+	Timeout    time.Duration // limit on obtaining each repo, 0 means none
+	Retry      RetryPolicy
+
+	mu      sync.Mutex
+	summary Summary
 }
 
+// defaultBatchSize bounds the log records each worker holds in memory when
+// the Obtainer can stream them.
+const defaultBatchSize = 500
+
 type RepoList []string
 
 type Obtainer interface {
-	Obtain(string) (Results, error)
+	Obtain(context.Context, string, Tip) (Results, error)
 }
 
 type Persister interface {
-	Persist(Results) error
+	Persist(context.Context, Results) error
+}
+
+// StreamObtainer is optionally implemented by an Obtainer that can deliver a
+// repo's Results in batches of at most the given number of log records while
+// logs are still being queried. Only the first batch may be Rewritten, and
+// the channel is closed once the last batch is sent.
+type StreamObtainer interface {
+	ObtainStream(context.Context, string, Tip, int, chan<- Results) error
+}
+
+// TipFinder is optionally implemented by a Persister that can report what
+// it already holds for a repo, allowing only newer logs to be collected.
+type TipFinder interface {
+	LastTip(context.Context, string) (Tip, error)
+}
+
+// RevFinder is optionally implemented by a Persister that can report the
+// revs it holds for the nodes of a repo, for repos that have no revision
+// numbers of their own.
+type RevFinder interface {
+	StoredRevs(context.Context, string) (map[string]int, error)
+}
+
+// ManifestPersister is optionally implemented by a Persister that can store
+// the metadata of repos listed by a manifest.
+type ManifestPersister interface {
+	PersistManifest(context.Context, Manifest) error
 }
 
 func NewCollSrvc(o Obtainer, p Persister, n int) *CollSrvc {
@@ -225,252 +671,1358 @@ func NewCollSrvc(o Obtainer, p Persister, n int) *CollSrvc {
 		Obtainer:   o,
 		Persister:  p,
 		WorkerPool: make(chan struct{}, n),
+		BatchSize:  defaultBatchSize,
+		Retry:      defaultRetryPolicy,
 	}
 }
 
-func (cs *CollSrvc) CollectLogs(rl RepoList) {
+// CollectLogs dispatches each repo to a worker until all are dispatched or
+// ctx is cancelled. Cancelling stops in-flight queries, but whatever they
+// obtained is still persisted.
+func (cs *CollSrvc) CollectLogs(ctx context.Context, rl RepoList) {
 	var cnt int
-	for _, r := range rl {
+	for i, r := range rl {
 		cnt++
+		if !cs.acquire(ctx) {
+			Log.Infof("collection cancelled, skipping %v remaining repos", len(rl)-i)
+			cs.record(&cs.summary.Skipped, rl[i:]...)
+			return
+		}
 		Log.Infof("processing repo %v of %v: %#v", cnt, len(rl), r)
 		// Log.Debugf("goroutine count: %v", runtime.NumGoroutine())
 		cs.WG.Add(1)
-		cs.WorkerPool <- struct{}{}
 		Log.Infof("pool worker %v started...", cnt)
 
 		go func(repo string, count int) {
+			// release the worker even if collecting panics, or WG.Wait
+			// never returns
 			defer func() {
 				if r := recover(); r != nil {
 					Log.Infof("PANIC RECOVERY: %v", r)
+					cs.record(&cs.summary.Failed, repo)
 				}
+				<-cs.WorkerPool
+				cs.WG.Done()
+				Log.Infof("completed repo %v", count)
 			}()
 
-			res, err := cs.Obtain(repo)
-			if err != nil {
-				Log.Infof("ERROR EVENT LOGGED - %v", err)
-				e := ErrorEvent{
-					TS:   time.Now().Format(Log.tsfmt),
-					Err:  err,
-					Path: repo,
-				}
-				res.ErrEvents = append(res.ErrEvents, e)
-			}
+			failed := cs.collectRetry(ctx, repo)
 
-			if err := cs.Persist(res); err != nil {
-				Log.Infof("ERROR in persisting logs: %v", err)
+			switch {
+			case ctx.Err() != nil:
+				cs.record(&cs.summary.Interrupted, repo)
+			case failed:
+				cs.record(&cs.summary.Failed, repo)
+			default:
+				cs.record(&cs.summary.Collected, repo)
 			}
-
-			<-cs.WorkerPool
-			cs.WG.Done()
-			Log.Infof("completed repo %v", count)
 		}(r, cnt)
 	}
 }
 
-//// Adapt data from query process
-
-type DataReader struct {
-	LogQueryer
+// acquire takes a worker from the pool, unless ctx is cancelled first.
+func (cs *CollSrvc) acquire(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	select {
+	case cs.WorkerPool <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
-func NewDataReader(lq LogQueryer) DataReader {
-	return DataReader{lq}
-}
+// collectRetry collects a repo, starting again from the last stored tip
+// after transient errors until the retry policy gives up. It reports whether
+// the final attempt had any errors.
+func (cs *CollSrvc) collectRetry(ctx context.Context, repo string) bool {
+	started := time.Now()
+	for n := 1; ; n++ {
+		var since Tip
+		if tf, ok := cs.Persister.(TipFinder); ok {
+			t, err := tf.LastTip(ctx, repo)
+			if err != nil {
+				Log.Infof("ERROR finding last tip, collecting all logs: %v", err)
+			}
+			since = t
+		}
 
-type LogQueryer interface {
-	QueryLogs(string) (string, error)
-}
+		var failed, transient bool
+		at := &attempt{num: n, started: started}
+		if so, ok := cs.Obtainer.(StreamObtainer); ok && cs.BatchSize > 0 {
+			failed, transient = cs.collectStream(ctx, so, repo, since, at)
+		} else {
+			failed, transient = cs.collect(ctx, repo, since, at)
+		}
 
-func (dr DataReader) Obtain(repo string) (Results, error) {
-	res := Results{LogRecs: []LogRecord{}, ErrEvents: []ErrorEvent{}}
-	str, err := dr.QueryLogs(repo)
-	if err != nil {
-		Log.Infof("ERROR EVENT LOGGED - %v", err)
-		e := ErrorEvent{
-			TS:   time.Now().Format(Log.tsfmt),
-			Err:  err,
-			Path: repo,
+		if !transient || n >= cs.Retry.Attempts || ctx.Err() != nil {
+			cs.finish(ctx, repo, at, failed)
+			return failed
 		}
-		res.ErrEvents = append(res.ErrEvents, e)
-	}
 
-	ss := strings.Split(str, "\n")
-	Log.Debugf("ss: %#v", ss)
-	for _, rec := range ss {
-		if rec != "\"" { // omit empty record (due to newline)
-			clean := strings.Trim(rec, "'") // record returns with quotes
-			Log.Debugf("clean: %v", clean)
-			c := csv.NewReader(strings.NewReader(clean))
-			c.Comma = '\t'
-			cres, err := c.ReadAll()
-			if err != nil {
-				Log.Infof("ERROR EVENT LOGGED - %v", err)
-				e := ErrorEvent{
-					TS:   time.Now().Format(Log.tsfmt),
-					Err:  err,
-					Path: repo,
-				}
-				res.ErrEvents = append(res.ErrEvents, e)
-			}
-			if len(cres) != 0 {
-				Log.Debugf("cres: %#v", cres)
-				r := LogRecord{
-					TS:        cres[0][0],
-					NodeID:    cres[0][1],
-					RevID:     cres[0][2],
-					ParentIDs: cres[0][3],
-					Author:    cres[0][4],
-					Tags:      cres[0][5],
-					Branch:    cres[0][6],
-					DiffStat:  cres[0][7],
-					Files:     cres[0][8],
-					GraphNode: cres[0][9],
-					RepoPath:  repo,
-				}
-				Log.Debugf("r: %#v", r)
-				res.LogRecs = append(res.LogRecs, r)
-			}
+		wait := cs.Retry.backoff(n)
+		Log.Infof(
+			"retrying repo %#v in %v after transient error (attempt %v of %v)",
+			repo, wait, n, cs.Retry.Attempts,
+		)
+		if !sleepCtx(ctx, wait) {
+			cs.finish(ctx, repo, at, failed)
+			return failed
 		}
 	}
-	Log.Debugf("Results: %#v", res)
-	return res, nil
 }
 
-//// Access Mercurial process infrastructure
+// attempt is one try at collecting a repo.
+type attempt struct {
+	num     int         // counting from 1
+	started time.Time   // start of the first attempt at the repo
+	lastErr *ErrorEvent // the last error event marked
+}
 
-type Proc struct{}
+// mark numbers the error events of res with the attempt, keeping the last
+// for the repo status, and reports whether any of the errors are transient.
+func (at *attempt) mark(res *Results) bool {
+	transient := markAttempt(res.ErrEvents, at.num)
+	if n := len(res.ErrEvents); n > 0 {
+		e := res.ErrEvents[n-1]
+		at.lastErr = &e
+	}
+	return transient
+}
 
-func NewProc() Proc {
-	return Proc{}
+// finish persists the status of a repo once all attempts are done, which is
+// left unfinished if collecting the repo was cancelled. The status is only
+// persisted here, as the tip and changeset count are found from the logs
+// already stored.
+func (cs *CollSrvc) finish(ctx context.Context, repo string, at *attempt, failed bool) {
+	res := Results{
+		Repo: repo,
+		Status: &RepoStatus{
+			Started: at.started,
+			Failed:  failed,
+			LastErr: at.lastErr,
+		},
+	}
+	if ctx.Err() == nil {
+		res.Status.Finished = time.Now()
+	}
+	if err := cs.Persist(detach(ctx), res); err != nil {
+		Log.Infof("ERROR in persisting repo status: %v", err)
+	}
 }
 
-func (p Proc) QueryLogs(repo string) (string, error) {
-	hg, err := exec.LookPath("hg")
-	if err != nil {
-		panic(err)
+// collect persists all of a repo's logs at once, reporting whether there
+// were any errors and if they are worth retrying.
+func (cs *CollSrvc) collect(ctx context.Context, repo string, since Tip, at *attempt) (bool, bool) {
+	octx, cancel := cs.withTimeout(ctx)
+	defer cancel()
+
+	res, err := cs.Obtain(octx, repo, since)
+	if err != nil && ctx.Err() == nil {
+		res.ErrEvents = append(res.ErrEvents, cs.obtainErrEvent(repo, err))
 	}
-	t := `'{date|isodatesec}\t{node}\t{rev}\t{parents}\t{author}\t{tags}\t{branch}\t{diffstat}\t{files}\t{graphnode}\n'`
-	args := []string{"log", repo, "--template", t}
+	transient := at.mark(&res)
 
-	cmd := exec.Command(hg, args...)
-	var outB, errB strings.Builder
-	cmd.Stdout = &outB
-	cmd.Stderr = &errB
+	if err := cs.Persist(detach(ctx), res); err != nil {
+		Log.Infof("ERROR in persisting logs: %v", err)
+		return true, false
+	}
 
-	if err := cmd.Start(); err != nil {
-		return "", fmt.Errorf("%w - %v", err, errB.String())
+	return len(res.ErrEvents) > 0, transient
+}
+
+// errObtainPanic is the error of a stream producer that panicked.
+var errObtainPanic = errors.New("panic obtaining logs")
+
+// collectStream persists each batch of a repo's logs as it is obtained,
+// reporting whether there were any errors and if they are worth retrying.
+// Once a batch fails to persist the rest are discarded, since persisting
+// later ones would leave a gap behind the stored tip that is never filled in.
+func (cs *CollSrvc) collectStream(ctx context.Context, so StreamObtainer, repo string, since Tip, at *attempt) (bool, bool) {
+	octx, cancel := cs.withTimeout(ctx)
+	defer cancel()
+
+	// a panicking producer still closes batches on its way out, so the
+	// panic is sent back as its error rather than taking down the process
+	batches := make(chan Results)
+	errc := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				errc <- fmt.Errorf("%w: %v", errObtainPanic, r)
+			}
+		}()
+		errc <- so.ObtainStream(octx, repo, since, cs.BatchSize, batches)
+	}()
+
+	var failed, transient, discard bool
+	for res := range batches {
+		failed = failed || len(res.ErrEvents) > 0
+		transient = at.mark(&res) || transient
+		if discard {
+			continue
+		}
+		if err := cs.Persist(detach(ctx), res); err != nil {
+			Log.Infof("ERROR in persisting logs, discarding remaining batches: %v", err)
+			failed, discard = true, true
+		}
 	}
-	if err := cmd.Wait(); err != nil {
-		return "", fmt.Errorf("%w - %v", err, errB.String())
+
+	if err := <-errc; err != nil && ctx.Err() == nil {
+		failed = true
+		res := Results{Repo: repo, ErrEvents: []ErrorEvent{cs.obtainErrEvent(repo, err)}}
+		transient = at.mark(&res) || transient
+		if err := cs.Persist(detach(ctx), res); err != nil {
+			Log.Infof("ERROR in persisting logs: %v", err)
+			discard = true
+		}
 	}
 
-	Log.Debugf("Total captured string bytes: %v", outB.Len())
+	return failed, transient && !discard
+}
 
-	return outB.String(), nil
+// Summary is what became of each repo given to CollectLogs.
+type Summary struct {
+	Collected   RepoList
+	Failed      RepoList // finished with error events or persist errors
+	Interrupted RepoList // cancelled part way, with logs obtained so far kept
+	Skipped     RepoList // never started due to cancellation
 }
 
-//// Adapt data to persistent storage
+// Summary reports the repos collected so far, it is complete once all
+// workers are done.
+func (cs *CollSrvc) Summary() Summary {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	return Summary{
+		Collected:   append(RepoList{}, cs.summary.Collected...),
+		Failed:      append(RepoList{}, cs.summary.Failed...),
+		Interrupted: append(RepoList{}, cs.summary.Interrupted...),
+		Skipped:     append(RepoList{}, cs.summary.Skipped...),
+	}
+}
 
-type Store struct {
-	DB   *sql.DB
-	Lock chan struct{}
+func (cs *CollSrvc) record(rl *RepoList, repos ...string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	*rl = append(*rl, repos...)
 }
 
-func NewStore(db *sql.DB) *Store {
-	return &Store{
-		DB:   db,
-		Lock: make(chan struct{}, 1),
-	}
+// detachedCtx keeps the values of a context but not its cancellation, so
+// persisting what was obtained still commits after collection is cancelled.
+type detachedCtx struct {
+	context.Context
 }
 
-func (st *Store) Persist(res Results) error {
-	st.Lock <- struct{}{}
-	defer func() {
-		<-st.Lock
-	}()
+func detach(ctx context.Context) context.Context {
+	return detachedCtx{ctx}
+}
 
-	Log.Debugf("persisting results: %#v", res)
+func (detachedCtx) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedCtx) Done() <-chan struct{}       { return nil }
+func (detachedCtx) Err() error                  { return nil }
 
-	tx, err := st.DB.Begin()
-	if err != nil {
-		return err
+// withTimeout limits obtaining a single repo to the configured Timeout.
+func (cs *CollSrvc) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if cs.Timeout <= 0 {
+		return context.WithCancel(ctx)
 	}
-	defer tx.Rollback()
-
-	var toCommit bool
+	return context.WithTimeout(ctx, cs.Timeout)
+}
 
-	if len(res.LogRecs) > 0 {
-		var rv []string
-		for _, r := range res.LogRecs {
-			rv = append(
-				rv,
-				fmt.Sprintf(
-					"('%s','%s','%s','%s','%s','%s','%s','%s','%s','%s','%s')",
-					r.TS,
-					r.NodeID,
-					r.RevID,
-					r.ParentIDs,
-					r.Author,
-					r.Tags,
-					r.Branch,
-					r.DiffStat,
-					r.Files,
-					r.GraphNode,
-					r.RepoPath,
-				),
-			)
-		}
-		rSQL := fmt.Sprintf(
-			`INSERT INTO logs (ts, node_id, rev_id, parent_ids, author, tags, branch, diffstat, files, graph_node, repo_path)
-			VALUES %s`,
-			strings.Join(rv, ", "),
-		)
-		Log.Debugf("rSQL: %#v", rSQL)
-		rStmt, err := tx.Prepare(rSQL)
-		if err != nil {
-			return fmt.Errorf("%w - preparing SQL: %v", err, rSQL)
-		}
-		if _, err := rStmt.Exec(); err != nil {
-			return fmt.Errorf("%w - executing SQL: %v", err, rSQL)
-		}
+func (cs *CollSrvc) obtainErrEvent(repo string, err error) ErrorEvent {
+	kind := errKind(err)
+	if kind == ErrKindTimeout {
+		err = fmt.Errorf("%w - repo not obtained within %v", err, cs.Timeout)
+	}
 
-		toCommit = true
+	Log.Infof("ERROR EVENT LOGGED - %v", err)
+	return ErrorEvent{
+		TS:   time.Now().Format(Log.tsfmt),
+		Err:  err,
+		Path: repo,
+		Kind: kind,
 	}
+}
 
-	if len(res.ErrEvents) > 0 {
-		var ev []string
-		for _, e := range res.ErrEvents {
-			// normalize for sql strings
-			eStr := strings.ReplaceAll(e.Err.Error(), "'", "\"")
-			ev = append(
-				ev,
-				fmt.Sprintf(
-					"('%s','%s','%s')",
-					e.TS, eStr, e.Path,
-				),
-			)
-		}
-		eSQL := fmt.Sprintf(
-			`INSERT INTO errs (ts, err, repo_path) VALUES %s`,
-			strings.Join(ev, ", "),
-		)
-		Log.Debugf("eSQL: %#v", eSQL)
-		eStmt, err := tx.Prepare(eSQL)
+//// Adapt data from query process
+
+type DataReader struct {
+	LogQueryer
+}
+
+func NewDataReader(lq LogQueryer) DataReader {
+	return DataReader{lq}
+}
+
+// LogQueryer provides a stream of JSON log entries for a repo, which must
+// be closed to release the underlying process or files.
+type LogQueryer interface {
+	QueryLogs(context.Context, string, Tip) (io.ReadCloser, error)
+	LookupRev(context.Context, string, string) (int, bool, error)
+}
+
+func (dr DataReader) Obtain(ctx context.Context, repo string, since Tip) (Results, error) {
+	all := Results{Repo: repo, LogRecs: []LogRecord{}, ErrEvents: []ErrorEvent{}}
+	err := dr.obtain(ctx, repo, since, 0, func(res Results) {
+		all.Rewritten = all.Rewritten || res.Rewritten
+		all.LogRecs = append(all.LogRecs, res.LogRecs...)
+		all.ErrEvents = append(all.ErrEvents, res.ErrEvents...)
+	})
+
+	Log.Debugf("Results: %#v", all)
+	return all, err
+}
+
+func (dr DataReader) ObtainStream(ctx context.Context, repo string, since Tip, size int, out chan<- Results) error {
+	defer close(out)
+	return dr.obtain(ctx, repo, since, size, func(res Results) {
+		Log.Debugf("Results batch: %v log records, %v errors", len(res.LogRecs), len(res.ErrEvents))
+		out <- res
+	})
+}
+
+// obtain decodes a repo's logs, emitting them in batches of size log records
+// followed by a final batch with the remainder and any error events. A size
+// of 0 emits everything in a single batch.
+func (dr DataReader) obtain(ctx context.Context, repo string, since Tip, size int, emit func(Results)) error {
+	res := Results{Repo: repo, LogRecs: []LogRecord{}, ErrEvents: []ErrorEvent{}}
+
+	// verify the stored tip still exists at the same revision, otherwise
+	// history was rewritten (strip, rebase, etc.) and all logs are needed
+	if since.Node != "" {
+		rev, found, err := dr.LookupRev(ctx, repo, since.Node)
 		if err != nil {
-			return fmt.Errorf("%w - preparing SQL: %v", err, eSQL)
+			return err
 		}
-		if _, err := eStmt.Exec(); err != nil {
-			return fmt.Errorf("%w - executing SQL: %v", err, eSQL)
+		if !found || rev != since.Rev {
+			Log.Infof("history rewrite detected, collecting all logs: %#v", repo)
+			since = Tip{}
+			res.Rewritten = true
 		}
+	}
 
-		toCommit = true
+	logErr := func(err error) {
+		Log.Infof("ERROR EVENT LOGGED - %v", err)
+		e := ErrorEvent{
+			TS:   time.Now().Format(Log.tsfmt),
+			Err:  err,
+			Path: repo,
+			Kind: errKind(err),
+		}
+		res.ErrEvents = append(res.ErrEvents, e)
+	}
+
+	rc, err := dr.QueryLogs(ctx, repo, since)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logErr(err)
+		emit(res)
+		return nil
+	}
+
+	// decode entries as they are produced, a decoding error leaves the
+	// stream unusable so only the entries before it are kept
+	var emitted bool
+	dec := json.NewDecoder(rc)
+	for {
+		var le logEntry
+		err := dec.Decode(&le)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				logErr(fmt.Errorf("%w - decoding log entry %v", err, len(res.LogRecs)+1))
+			}
+			break
+		}
+		r := le.record(repo)
+		Log.Debugf("r: %#v", r)
+		res.LogRecs = append(res.LogRecs, r)
+
+		if size > 0 && len(res.LogRecs) == size {
+			emit(res)
+			emitted = true
+			res = Results{Repo: repo, LogRecs: []LogRecord{}, ErrEvents: []ErrorEvent{}}
+		}
+	}
+	if err := rc.Close(); err != nil && ctx.Err() == nil {
+		logErr(err)
+	}
+
+	if !emitted || len(res.LogRecs) > 0 || len(res.ErrEvents) > 0 {
+		emit(res)
+	}
+
+	// entries read before a cancellation are complete and still returned,
+	// but errors from the interrupted query are not worth recording
+	return ctx.Err()
+}
+
+// logEntry is a single changeset as JSON encoded by a LogQueryer.
+type logEntry struct {
+	TS        string   `json:"ts"`
+	Node      string   `json:"node"`
+	Rev       int      `json:"rev"`
+	Parents   string   `json:"parents"`
+	P1Node    string   `json:"p1node"`
+	P2Node    string   `json:"p2node"`
+	Author    string   `json:"author"`
+	Tags      string   `json:"tags"`
+	Branch    string   `json:"branch"`
+	DiffStat  string   `json:"diffstat"`
+	Files     []string `json:"files"`
+	GraphNode string   `json:"graphnode"`
+	FileAdds  []string `json:"file_adds"`
+	FileMods  []string `json:"file_mods"`
+	FileDels  []string `json:"file_dels"`
+	Desc      string   `json:"desc"`
+
+	// lines added and removed per file
+	Numstat map[string][2]int `json:"numstat"`
+
+	VCS string `json:"vcs"` // vcsHg if not given
+}
+
+func (le logEntry) record(repo string) LogRecord {
+	r := LogRecord{
+		TS:          le.TS,
+		NodeID:      le.Node,
+		RevID:       strconv.Itoa(le.Rev),
+		ParentIDs:   le.Parents,
+		Author:      le.Author,
+		Tags:        le.Tags,
+		Branch:      le.Branch,
+		DiffStat:    le.DiffStat,
+		Files:       strings.Join(le.Files, " "),
+		GraphNode:   le.GraphNode,
+		RepoPath:    repo,
+		Description: le.Desc,
+		Rev:         le.Rev,
+		VCS:         le.VCS,
+	}
+	if r.VCS == "" {
+		r.VCS = vcsHg
+	}
+	r.AuthorName, r.AuthorEmail = splitAuthor(le.Author)
+	if t, err := time.Parse(hgDateFmt, le.TS); err == nil {
+		// hg dates have no zone names, only offsets
+		_, off := t.Zone()
+		r.Time = t.In(time.FixedZone("", off))
+	}
+	fmt.Sscanf(le.DiffStat, "%d: +%d/-%d", &r.FilesChanged, &r.LinesAdded, &r.LinesRemoved)
+	if le.P1Node != nullNode {
+		r.P1Node = le.P1Node
+	}
+	if le.P2Node != nullNode {
+		r.P2Node = le.P2Node
+	}
+
+	for _, fl := range []struct {
+		action string
+		paths  []string
+	}{{"added", le.FileAdds}, {"modified", le.FileMods}, {"removed", le.FileDels}} {
+		for _, p := range fl.paths {
+			n := le.Numstat[p]
+			r.FileChanges = append(r.FileChanges, FileChange{
+				Path:    p,
+				Action:  fl.action,
+				Added:   n[0],
+				Removed: n[1],
+			})
+		}
+	}
+
+	return r
+}
+
+//// Access Mercurial process infrastructure
+
+type Proc struct{}
+
+func NewProc() Proc {
+	return Proc{}
+}
+
+// logTemplate renders each changeset as a line of JSON, with fields
+// matching logEntry other than numstat, which hgLogReader adds from the
+// patch hg writes after it.
+const logTemplate = `{dict(` +
+	`ts=date|isodatesec, node, rev, parents=join(parents, " "), p1node, p2node, author, ` +
+	`tags=join(tags, " "), branch, diffstat, files, graphnode, ` +
+	`file_adds, file_mods, file_dels, desc` +
+	`)|json}\n`
+
+func (p Proc) QueryLogs(ctx context.Context, repo string, since Tip) (io.ReadCloser, error) {
+	// query in ascending rev order, so logs persisted in batches always end
+	// at a tip with everything before it stored
+	args := []string{"log", repo, "--template", logTemplate, "--patch", "--config", "diff.git=false"}
+	switch {
+	case since.Node != "":
+		args = append(args, "--rev", fmt.Sprintf("%d:tip and not %d", since.Rev, since.Rev))
+	default:
+		args = append(args, "--rev", "all()")
+	}
+
+	po, err := startProc(ctx, "hg", nil, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hgLogReader{po: po, out: bufio.NewReaderSize(po, hgLineBufSize)}, nil
+}
+
+// hgLineBufSize fits the longest patch file header, which gives a path.
+const hgLineBufSize = 64 << 10
+
+// hgLogReader converts hg log output, a line of JSON per changeset followed
+// by its patch, to a line of JSON per changeset with the lines added and
+// removed per file as its numstat. Patches are counted as they are read, so
+// none is held in memory whole.
+type hgLogReader struct {
+	po    io.ReadCloser
+	out   *bufio.Reader
+	entry []byte // changeset whose patch is being counted
+	dc    diffCounter
+	buf   bytes.Buffer
+}
+
+func (lr *hgLogReader) Read(p []byte) (int, error) {
+	for lr.buf.Len() == 0 {
+		line, err := lr.out.ReadSlice('\n')
+		switch {
+		case len(line) > 0 && line[0] == '{':
+			// patch lines never start with a brace, changeset lines always do
+			lr.flush()
+			lr.entry = append(lr.entry, line...)
+			for errors.Is(err, bufio.ErrBufferFull) {
+				line, err = lr.out.ReadSlice('\n')
+				lr.entry = append(lr.entry, line...)
+			}
+		case len(line) > 0:
+			// only the start of a patch line is needed to count it
+			lr.dc.line(strings.TrimSuffix(string(line), "\n"))
+			for errors.Is(err, bufio.ErrBufferFull) {
+				_, err = lr.out.ReadSlice('\n')
+			}
+		}
+		if err != nil {
+			lr.flush()
+			if lr.buf.Len() > 0 {
+				break // the error is returned once the entry is read
+			}
+			return 0, err
+		}
+	}
+
+	return lr.buf.Read(p)
+}
+
+// flush writes the changeset being counted with its numstat added.
+func (lr *hgLogReader) flush() {
+	entry := bytes.TrimRight(lr.entry, "\n")
+	if len(entry) == 0 {
+		return
+	}
+	ns, _ := json.Marshal(lr.dc.numstat())
+	if entry[len(entry)-1] == '}' {
+		lr.buf.Write(entry[:len(entry)-1])
+		lr.buf.WriteString(`, "numstat": `)
+		lr.buf.Write(ns)
+		lr.buf.WriteString("}\n")
+	} else {
+		// not a changeset after all, left for the decoder to reject
+		lr.buf.Write(entry)
+		lr.buf.WriteString("\n")
+	}
+	lr.entry, lr.dc = lr.entry[:0], diffCounter{}
+}
+
+func (lr *hgLogReader) Close() error {
+	return lr.po.Close()
+}
+
+// diffCounter counts the lines added and removed per file in a plain
+// (non-git) diff given a line at a time, skipping file headers the same way
+// hg's diffstat does.
+type diffCounter struct {
+	stats    map[string][2]int
+	path     string
+	inHeader bool
+}
+
+func (dc *diffCounter) line(l string) {
+	if dc.stats == nil {
+		dc.stats = map[string][2]int{}
+	}
+	switch {
+	case strings.HasPrefix(l, "diff -r "):
+		// diff -r <node> [-r <node>] <path>
+		path := strings.TrimPrefix(l, "diff ")
+		for strings.HasPrefix(path, "-r ") {
+			if i := strings.IndexByte(path[3:], ' '); i != -1 {
+				path = path[3+i+1:]
+			} else {
+				break
+			}
+		}
+		dc.path, dc.inHeader = path, true
+		if _, ok := dc.stats[path]; !ok {
+			dc.stats[path] = [2]int{} // binary files have no lines
+		}
+	case strings.HasPrefix(l, "@@"):
+		dc.inHeader = false
+	case strings.HasPrefix(l, "+") && !dc.inHeader:
+		n := dc.stats[dc.path]
+		n[0]++
+		dc.stats[dc.path] = n
+	case strings.HasPrefix(l, "-") && !dc.inHeader:
+		n := dc.stats[dc.path]
+		n[1]++
+		dc.stats[dc.path] = n
+	}
+}
+
+// numstat is the lines added and removed per file counted so far.
+func (dc *diffCounter) numstat() map[string][2]int {
+	if dc.stats == nil {
+		return map[string][2]int{}
+	}
+
+	return dc.stats
+}
+
+// startProc starts a command with stdin, if not nil, streaming its stdout.
+func startProc(ctx context.Context, name string, stdin io.Reader, args ...string) (procOutput, error) {
+	bin, err := exec.LookPath(name)
+	if err != nil {
+		return procOutput{}, err
+	}
+
+	cmd := exec.CommandContext(ctx, bin, args...)
+	setProcGroup(cmd)
+	cmd.Stdin = stdin
+	errB := &strings.Builder{}
+	cmd.Stderr = errB
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return procOutput{}, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return procOutput{}, fmt.Errorf("%w - %v", err, errB.String())
+	}
+
+	return procOutput{ReadCloser: out, cmd: cmd, errB: errB, release: killOnDone(ctx, cmd)}, nil
+}
+
+// procOutput is the stdout of a running hg or git process, closing it waits
+// for the process to exit.
+type procOutput struct {
+	io.ReadCloser
+	cmd     *exec.Cmd
+	errB    *strings.Builder
+	release func()
+}
+
+func (po procOutput) Close() error {
+	// drain unread output so the process is not blocked writing it
+	n, _ := io.Copy(io.Discard, po.ReadCloser)
+	if n > 0 {
+		Log.Debugf("discarded unread output bytes: %v", n)
+	}
+	defer po.release()
+	if err := po.cmd.Wait(); err != nil {
+		return fmt.Errorf("%w - %v", err, po.errB.String())
+	}
+
+	return nil
+}
+
+// killOnDone kills the process group of a started cmd if ctx is done before
+// the returned release func is called. Killing only hg or git itself could
+// leave children it spawned running and holding its output open.
+func killOnDone(ctx context.Context, cmd *exec.Cmd) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			Log.Debugf("killing process group %v: %v", cmd.Process.Pid, ctx.Err())
+			if err := killProcGroup(cmd); err != nil {
+				Log.Infof("ERROR killing process group %v: %v", cmd.Process.Pid, err)
+			}
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// LookupRev finds the local revision number of a node, reporting whether the
+// node exists in the repo at all.
+func (p Proc) LookupRev(ctx context.Context, repo, node string) (int, bool, error) {
+	args := []string{"log", "--repository", repo, "--rev", fmt.Sprintf("id(%s)", node), "--template", "{rev}"}
+
+	out, err := p.run(ctx, args...)
+	if err != nil {
+		return 0, false, err
+	}
+	if out == "" {
+		return 0, false, nil
+	}
+	rev, err := strconv.Atoi(out)
+	if err != nil {
+		return 0, false, fmt.Errorf("%w - unexpected rev output: %#v", err, out)
+	}
+
+	return rev, true, nil
+}
+
+func (p Proc) run(ctx context.Context, args ...string) (string, error) {
+	return runProc(ctx, "hg", args...)
+}
+
+// runProc runs a command to completion, giving its stdout.
+func runProc(ctx context.Context, name string, args ...string) (string, error) {
+	bin, err := exec.LookPath(name)
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.CommandContext(ctx, bin, args...)
+	setProcGroup(cmd)
+	var outB, errB strings.Builder
+	cmd.Stdout = &outB
+	cmd.Stderr = &errB
+
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("%w - %v", err, errB.String())
+	}
+	release := killOnDone(ctx, cmd)
+	defer release()
+	if err := cmd.Wait(); err != nil {
+		return "", fmt.Errorf("%w - %v", err, errB.String())
+	}
+
+	Log.Debugf("Total captured string bytes: %v", outB.Len())
+
+	return outB.String(), nil
+}
+
+//// Adapt data to persistent storage
+
+type Store struct {
+	DB *sql.DB
+
+	// GroupSize is the most Results committed together in one transaction,
+	// and must be set before the first Persist.
+	GroupSize int
+
+	// Mailmap gives the canonical identities of authors first persisted,
+	// and must be set before the first Persist.
+	Mailmap *Mailmap
+
+	dialect dialect
+	writes  chan storeWrite
+	start   sync.Once
+	done    chan struct{} // closed once the writer has stopped
+
+	// logs committed per repo until its status is, only used by the writer
+	repoLogs map[string]logCounts
+
+	mu       sync.Mutex
+	runID    sql.NullInt64 // run persisted logs and errors are attributed to
+	inserted int           // logs newly inserted during the run
+}
+
+// logCounts is how many of the logs persisted for a repo were new.
+type logCounts struct {
+	inserted, present int
+}
+
+// storeWrite is Results queued for the writer by Persist, which waits for
+// the outcome on errc.
+type storeWrite struct {
+	ctx  context.Context
+	res  Results
+	errc chan error
+}
+
+// defaultGroupSize is enough Results per transaction for every worker to
+// share the fsync of each commit, while keeping transactions short.
+const defaultGroupSize = 64
+
+// NewStore persists to a SQLite database.
+func NewStore(db *sql.DB) *Store {
+	return newStore(db, sqliteDialect)
+}
+
+// NewPostgresStore persists to a PostgreSQL database, with the same schema
+// and behavior as a SQLite one.
+func NewPostgresStore(db *sql.DB) *Store {
+	return newStore(db, postgresDialect)
+}
+
+func newStore(db *sql.DB, d dialect) *Store {
+	return &Store{
+		DB:        db,
+		GroupSize: defaultGroupSize,
+		dialect:   d,
+		writes:    make(chan storeWrite),
+		done:      make(chan struct{}),
+		repoLogs:  map[string]logCounts{},
+	}
+}
+
+// Close stops the writer once the Results already queued are committed.
+// Persist must not be called after Close.
+func (st *Store) Close() error {
+	st.start.Do(func() { close(st.done) }) // the writer never started
+	close(st.writes)
+	<-st.done
+
+	return nil
+}
+
+// tipSQL selects the rev and node of the highest stored rev of a repo.
+const tipSQL = `SELECT rev, node_id FROM logs WHERE repo_path = ?
+	ORDER BY rev DESC LIMIT 1`
+
+func (st *Store) LastTip(ctx context.Context, repo string) (Tip, error) {
+	var tip Tip
+	row := st.DB.QueryRowContext(ctx, st.dialect.SQL(tipSQL), repo)
+	switch err := row.Scan(&tip.Rev, &tip.Node); {
+	case errors.Is(err, sql.ErrNoRows):
+		return Tip{}, nil
+	case err != nil:
+		return Tip{}, err
+	}
+
+	return tip, nil
+}
+
+// storedRevsSQL selects the rev of every stored node of a repo.
+const storedRevsSQL = `SELECT node_id, rev FROM logs WHERE repo_path = ?`
+
+func (st *Store) StoredRevs(ctx context.Context, repo string) (map[string]int, error) {
+	rows, err := st.DB.QueryContext(ctx, st.dialect.SQL(storedRevsSQL), repo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revs := map[string]int{}
+	for rows.Next() {
+		var node string
+		var rev int
+		if err := rows.Scan(&node, &rev); err != nil {
+			return nil, err
+		}
+		revs[node] = rev
+	}
+
+	return revs, rows.Err()
+}
+
+// Persist queues res for the writer and waits until it is committed, likely
+// in the same transaction as the Results of other workers.
+func (st *Store) Persist(ctx context.Context, res Results) error {
+	st.start.Do(func() { go st.write() })
+
+	w := storeWrite{ctx: ctx, res: res, errc: make(chan error, 1)}
+	select {
+	case st.writes <- w:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return <-w.errc
+}
+
+// write is the single writer of the Store, committing each group of Results
+// that queued up while the previous group was being committed.
+func (st *Store) write() {
+	defer close(st.done)
+
+	for w := range st.writes {
+		group := []storeWrite{w}
+	queued:
+		for len(group) < st.GroupSize {
+			select {
+			case w, ok := <-st.writes:
+				if !ok {
+					break queued
+				}
+				group = append(group, w)
+			default:
+				break queued
+			}
+		}
+
+		st.commit(group)
+	}
+}
+
+// commit persists a group of Results in one transaction. If that fails, each
+// is persisted in a transaction of its own, so only bad Results fail.
+func (st *Store) commit(group []storeWrite) {
+	if len(group) > 1 {
+		err := st.persistGroup(group)
+		if err == nil {
+			for _, w := range group {
+				w.errc <- nil
+			}
+			return
+		}
+		Log.Debugf("persisting %v results one at a time after group error: %v", len(group), err)
+	}
+
+	for i := range group {
+		group[i].errc <- st.persistGroup(group[i : i+1])
+	}
+}
+
+func (st *Store) persistGroup(group []storeWrite) error {
+	// the transaction outlives the context of any one Persist
+	tx, err := st.DB.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	st.mu.Lock()
+	runID := st.runID
+	st.mu.Unlock()
+
+	var toCommit bool
+	var inserted int
+	counts := make([]int, len(group))
+	for i, w := range group {
+		n, wrote, err := st.persistTx(w.ctx, tx, w.res, runID)
+		if err != nil {
+			return err
+		}
+		counts[i] = n
+		inserted += n
+		toCommit = toCommit || wrote
 	}
 
 	if toCommit {
 		if err := tx.Commit(); err != nil {
 			return err
 		}
+		st.mu.Lock()
+		st.inserted += inserted
+		st.mu.Unlock()
+		for i, w := range group {
+			st.countLogs(w.res, counts[i])
+		}
+	}
+
+	return nil
+}
+
+// countLogs adds up the committed logs of a repo across its Results, and
+// reports them once its status is committed.
+func (st *Store) countLogs(res Results, inserted int) {
+	c, ok := st.repoLogs[res.Repo]
+	if len(res.LogRecs) > 0 {
+		c.inserted += inserted
+		c.present += len(res.LogRecs) - inserted
+		st.repoLogs[res.Repo], ok = c, true
+	}
+	if res.Status == nil || !ok {
+		return
+	}
+
+	Log.Infof("logs for repo %#v: %v inserted, %v already present", res.Repo, c.inserted, c.present)
+	delete(st.repoLogs, res.Repo)
+}
+
+// persistTx writes res in tx, reporting the logs newly inserted and whether
+// anything was written at all.
+func (st *Store) persistTx(ctx context.Context, tx *sql.Tx, res Results, runID sql.NullInt64) (int, bool, error) {
+	Log.Debugf("persisting results: %#v", res)
+
+	var toCommit bool
+	var inserted int
+
+	if res.Rewritten {
+		Log.Infof("removing stale logs for rewritten repo: %#v", res.Repo)
+		if _, err := tx.ExecContext(ctx, st.dialect.SQL(`DELETE FROM logs WHERE repo_path = ?`), res.Repo); err != nil {
+			return 0, false, fmt.Errorf("%w - deleting stale logs: %v", err, res.Repo)
+		}
+		if _, err := tx.ExecContext(ctx, st.dialect.SQL(`DELETE FROM changeset_files WHERE repo_path = ?`), res.Repo); err != nil {
+			return 0, false, fmt.Errorf("%w - deleting stale changeset files: %v", err, res.Repo)
+		}
+		if _, err := tx.ExecContext(ctx, st.dialect.SQL(`DELETE FROM changeset_parents WHERE repo_path = ?`), res.Repo); err != nil {
+			return 0, false, fmt.Errorf("%w - deleting stale changeset parents: %v", err, res.Repo)
+		}
+
+		toCommit = true
+	}
+
+	if len(res.LogRecs) > 0 {
+		rows := make([][]interface{}, 0, len(res.LogRecs))
+		for _, r := range res.LogRecs {
+			tsEpoch, tsOffset := r.epoch()
+			rows = append(rows, []interface{}{
+				r.TS,
+				r.NodeID,
+				r.RevID,
+				r.ParentIDs,
+				r.Author,
+				r.Tags,
+				r.Branch,
+				r.DiffStat,
+				r.Files,
+				r.GraphNode,
+				r.RepoPath,
+				r.Description,
+				runID,
+				tsEpoch,
+				tsOffset,
+				r.Rev,
+				r.FilesChanged,
+				r.LinesAdded,
+				r.LinesRemoved,
+				r.AuthorName,
+				r.AuthorEmail,
+				r.VCS,
+			})
+		}
+		// the rows affected by DO NOTHING are the logs that are new, those
+		// already present only have what may change between runs refreshed
+		rPrefix := `INSERT INTO logs (ts, node_id, rev_id, parent_ids, author, tags, branch, diffstat, files, graph_node, repo_path, description, run_id,
+			ts_epoch, ts_offset, rev, files_changed, lines_added, lines_removed, author_name, author_email, vcs)`
+		rSQL := insertSQL{
+			Prefix: rPrefix,
+			Suffix: `ON CONFLICT (repo_path, node_id) DO NOTHING`,
+		}
+		n, err := rSQL.exec(ctx, st.dialect, tx, rows)
+		if err != nil {
+			return 0, false, err
+		}
+		inserted = n
+		if inserted < len(rows) {
+			uSQL := insertSQL{
+				Prefix: rPrefix,
+				Suffix: `ON CONFLICT (repo_path, node_id) DO UPDATE SET
+					rev_id = excluded.rev_id,
+					rev = excluded.rev,
+					tags = excluded.tags,
+					graph_node = excluded.graph_node`,
+			}
+			if _, err := uSQL.exec(ctx, st.dialect, tx, rows); err != nil {
+				return 0, false, err
+			}
+		}
+
+		var fRows [][]interface{}
+		for _, r := range res.LogRecs {
+			for _, fc := range r.FileChanges {
+				fRows = append(fRows, []interface{}{
+					r.RepoPath, r.NodeID, fc.Path, fc.Action, fc.Added, fc.Removed,
+				})
+			}
+		}
+		fSQL := insertSQL{
+			Prefix: `INSERT INTO changeset_files (repo_path, node_id, path, action, lines_added, lines_removed)`,
+			Suffix: `ON CONFLICT (repo_path, node_id, path) DO NOTHING`,
+		}
+		if _, err := fSQL.exec(ctx, st.dialect, tx, fRows); err != nil {
+			return 0, false, err
+		}
+
+		var pRows [][]interface{}
+		for _, r := range res.LogRecs {
+			for i, p := range []string{r.P1Node, r.P2Node} {
+				if p != "" {
+					pRows = append(pRows, []interface{}{r.RepoPath, r.NodeID, i + 1, p})
+				}
+			}
+		}
+		pSQL := insertSQL{
+			Prefix: `INSERT INTO changeset_parents (repo_path, node_id, parent_index, parent_node)`,
+			Suffix: `ON CONFLICT (repo_path, node_id, parent_index) DO NOTHING`,
+		}
+		if _, err := pSQL.exec(ctx, st.dialect, tx, pRows); err != nil {
+			return 0, false, err
+		}
+
+		// identities already stored keep their canonical identity until
+		// remapped, as the Mailmap may differ between runs
+		var aRows [][]interface{}
+		seen := map[identity]bool{}
+		for _, r := range res.LogRecs {
+			alias := identity{Name: r.AuthorName, Email: r.AuthorEmail}
+			if seen[alias] {
+				continue
+			}
+			seen[alias] = true
+			name, email := st.Mailmap.Map(alias.Name, alias.Email)
+			aRows = append(aRows, []interface{}{alias.Name, alias.Email, name, email})
+		}
+		aSQL := insertSQL{
+			Prefix: `INSERT INTO authors (name, email, canonical_name, canonical_email)`,
+			Suffix: `ON CONFLICT (name, email) DO NOTHING`,
+		}
+		if _, err := aSQL.exec(ctx, st.dialect, tx, aRows); err != nil {
+			return 0, false, err
+		}
+
+		toCommit = true
+	}
+
+	if len(res.ErrEvents) > 0 {
+		rows := make([][]interface{}, 0, len(res.ErrEvents))
+		for _, e := range res.ErrEvents {
+			rows = append(rows, []interface{}{e.TS, e.Err.Error(), e.Path, e.Kind, e.Attempt, runID})
+		}
+		eSQL := insertSQL{
+			Prefix: `INSERT INTO errs (ts, err, repo_path, kind, attempt, run_id)`,
+		}
+		if _, err := eSQL.exec(ctx, st.dialect, tx, rows); err != nil {
+			return 0, false, err
+		}
+
+		toCommit = true
+	}
+
+	if res.Status != nil {
+		if err := st.persistStatus(ctx, tx, res); err != nil {
+			return 0, false, err
+		}
+
+		toCommit = true
+	}
+
+	return inserted, toCommit, nil
+}
+
+// persistStatus updates the repos row of a repo from its Results, with the
+// tip and changeset count as stored once they are persisted.
+func (st *Store) persistStatus(ctx context.Context, tx *sql.Tx, res Results) error {
+	var tipRev, tipNode sql.NullString
+	err := tx.QueryRowContext(ctx, st.dialect.SQL(tipSQL), res.Repo).Scan(&tipRev, &tipNode)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w - finding tip: %v", err, res.Repo)
+	}
+	var cnt int
+	if err := tx.QueryRowContext(ctx, st.dialect.SQL(`SELECT COUNT(*) FROM logs WHERE repo_path = ?`), res.Repo).Scan(&cnt); err != nil {
+		return fmt.Errorf("%w - counting logs: %v", err, res.Repo)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		st.dialect.SQL(`INSERT INTO repos (repo_path, last_attempted, tip_rev, tip_node, changesets)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (repo_path) DO UPDATE SET
+			last_attempted = excluded.last_attempted,
+			tip_rev = excluded.tip_rev,
+			tip_node = excluded.tip_node,
+			changesets = excluded.changesets`),
+		res.Repo, res.Status.Started.Format(Log.tsfmt), tipRev, tipNode, cnt,
+	)
+	if err != nil {
+		return fmt.Errorf("%w - updating repo status: %v", err, res.Repo)
+	}
+
+	if e := res.Status.LastErr; e != nil {
+		_, err := tx.ExecContext(ctx,
+			st.dialect.SQL(`UPDATE repos SET last_error = ?, last_error_ts = ? WHERE repo_path = ?`),
+			e.Err.Error(), e.TS, res.Repo,
+		)
+		if err != nil {
+			return fmt.Errorf("%w - updating repo last error: %v", err, res.Repo)
+		}
+	}
+
+	if fin := res.Status.Finished; !fin.IsZero() {
+		_, err := tx.ExecContext(ctx,
+			st.dialect.SQL(`UPDATE repos SET duration_ms = ? WHERE repo_path = ?`),
+			fin.Sub(res.Status.Started).Milliseconds(), res.Repo,
+		)
+		if err != nil {
+			return fmt.Errorf("%w - updating repo duration: %v", err, res.Repo)
+		}
+	}
+
+	// a success clears the last error, which is only of the failures since
+	if fin := res.Status.Finished; !fin.IsZero() && !res.Status.Failed {
+		_, err := tx.ExecContext(ctx,
+			st.dialect.SQL(`UPDATE repos SET last_success = ?, last_error = NULL, last_error_ts = NULL WHERE repo_path = ?`),
+			fin.Format(Log.tsfmt), res.Repo,
+		)
+		if err != nil {
+			return fmt.Errorf("%w - updating repo last success: %v", err, res.Repo)
+		}
+	}
+
+	return nil
+}
+
+// Run is a single invocation of the collector, recorded so runs can be
+// compared and what each produced audited.
+type Run struct {
+	ID        int64
+	StartedAt string
+	EndedAt   string
+	Flags     string
+	Host      string
+	Version   string
+
+	ReposAttempted int
+	ReposSucceeded int
+	ReposFailed    int
+	RowsInserted   int
+}
+
+// StartRun records the start of a run, attributing everything persisted
+// afterwards to it.
+func (st *Store) StartRun(ctx context.Context, run *Run) error {
+	var id int64
+	if err := st.DB.QueryRowContext(ctx,
+		st.dialect.SQL(`INSERT INTO runs (started_at, flags, host, version) VALUES (?, ?, ?, ?) RETURNING id`),
+		run.StartedAt, run.Flags, run.Host, run.Version,
+	).Scan(&id); err != nil {
+		return fmt.Errorf("%w - inserting run", err)
+	}
+
+	run.ID = id
+	st.mu.Lock()
+	st.runID = sql.NullInt64{Int64: id, Valid: true}
+	st.inserted = 0
+	st.mu.Unlock()
+
+	return nil
+}
+
+// EndRun records the outcome of a run started with StartRun, including the
+// logs inserted since.
+func (st *Store) EndRun(ctx context.Context, run *Run) error {
+	st.mu.Lock()
+	run.RowsInserted = st.inserted
+	st.mu.Unlock()
+
+	_, err := st.DB.ExecContext(ctx,
+		st.dialect.SQL(`UPDATE runs SET ended_at = ?, repos_attempted = ?, repos_succeeded = ?,
+		repos_failed = ?, rows_inserted = ? WHERE id = ?`),
+		run.EndedAt, run.ReposAttempted, run.ReposSucceeded,
+		run.ReposFailed, run.RowsInserted, run.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("%w - updating run: %v", err, run.ID)
 	}
 
 	return nil
 }
+
+// PersistManifest replaces the metadata stored for the repos of a manifest.
+// Repos without metadata given, as listed by plain paths, keep theirs.
+func (st *Store) PersistManifest(ctx context.Context, m Manifest) error {
+	tx, err := st.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var rows [][]interface{}
+	for _, r := range m {
+		if r.Meta == nil {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, st.dialect.SQL(`DELETE FROM repo_metadata WHERE repo_path = ?`), r.Path); err != nil {
+			return fmt.Errorf("%w - deleting repo metadata: %v", err, r.Path)
+		}
+		for _, nv := range r.metaRows() {
+			rows = append(rows, []interface{}{r.Path, nv[0], nv[1]})
+		}
+	}
+	mSQL := insertSQL{
+		Prefix: `INSERT INTO repo_metadata (repo_path, name, value)`,
+		Suffix: `ON CONFLICT (repo_path, name, value) DO NOTHING`,
+	}
+	if _, err := mSQL.exec(ctx, st.dialect, tx, rows); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// maxSQLVars is the default bound parameter limit of SQLite builds before
+// 3.32.0, which multi-row inserts are chunked to stay under.
+const maxSQLVars = 999
+
+// insertSQL is a multi-row INSERT statement with bound parameters, where the
+// VALUES list is generated between Prefix and Suffix.
+type insertSQL struct {
+	Prefix string
+	Suffix string
+}
+
+func (is insertSQL) query(rowCnt, colCnt int) string {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", colCnt), ", ") + ")"
+	vals := strings.TrimSuffix(strings.Repeat(row+", ", rowCnt), ", ")
+	return strings.TrimSpace(fmt.Sprintf("%s VALUES %s %s", is.Prefix, vals, is.Suffix))
+}
+
+// exec inserts all rows in chunks, preparing one statement per chunk size,
+// and reports the rows affected across the chunks.
+func (is insertSQL) exec(ctx context.Context, d dialect, tx *sql.Tx, rows [][]interface{}) (int, error) {
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	colCnt := len(rows[0])
+	chunk := d.MaxVars / colCnt
+
+	var affected int
+	stmts := map[int]*sql.Stmt{}
+	defer func() {
+		for _, s := range stmts {
+			s.Close()
+		}
+	}()
+
+	for i := 0; i < len(rows); i += chunk {
+		end := i + chunk
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		stmt, ok := stmts[end-i]
+		if !ok {
+			q := d.SQL(is.query(end-i, colCnt))
+			Log.Debugf("prepared SQL: %#v", q)
+			s, err := tx.PrepareContext(ctx, q)
+			if err != nil {
+				return 0, fmt.Errorf("%w - preparing SQL: %v", err, q)
+			}
+			stmts[end-i] = s
+			stmt = s
+		}
+
+		var args []interface{}
+		for _, r := range rows[i:end] {
+			args = append(args, r...)
+		}
+		r, err := stmt.ExecContext(ctx, args...)
+		if err != nil {
+			return 0, fmt.Errorf("%w - executing SQL: %v", err, is.Prefix)
+		}
+		n, err := r.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("%w - counting rows: %v", err, is.Prefix)
+		}
+		affected += int(n)
+	}
+
+	return affected, nil
+}
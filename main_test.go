@@ -1,14 +1,22 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"database/sql"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 )
@@ -47,23 +55,33 @@ func assertDeep(t *testing.T, got, want interface{}) {
 }
 
 const (
-	testRepoLog    string = "'2022-06-10 23:43:47 +0000\t71efee2949bd457bac92e3f21215a1bc310fd62f\t0\t\tSome User <some.user@email.com>\ttip\tdefault\t1: +1/-0\thi.txt\t@\n'"
-	testRepoLogDbl string = "'2022-06-10 23:43:47 +0000\t71efee2949bd457bac92e3f21215a1bc310fd62f\t0\t\tSome User <some.user@email.com>\ttip\tdefault\t1: +1/-0\thi.txt\t@\n''2022-06-13 03:33:33 +0000\t71efee2949bd457bac92e3f21215a1bc310fd62f\t0\t\tSome User <some.user@email.com>\ttip\tdefault\t1: +1/-0\thi.txt\t@\n'"
+	testRepoLog    string = `{"author": "Some User \u003csome.user@email.com\u003e", "branch": "default", "desc": "initial commit", "diffstat": "1: +1/-0", "file_adds": ["hi.txt"], "file_dels": [], "file_mods": [], "files": ["hi.txt"], "graphnode": "@", "node": "71efee2949bd457bac92e3f21215a1bc310fd62f", "p1node": "0000000000000000000000000000000000000000", "p2node": "0000000000000000000000000000000000000000", "parents": "", "rev": 0, "tags": "tip", "ts": "2022-06-10 23:43:47 +0000", "numstat": {"hi.txt":[1,0]}}` + "\n"
+	testRepoLogDbl string = testRepoLog + `{"author": "Some User \u003csome.user@email.com\u003e", "branch": "default", "desc": "initial commit", "diffstat": "1: +1/-0", "file_adds": ["hi.txt"], "file_dels": [], "file_mods": [], "files": ["hi.txt"], "graphnode": "@", "node": "71efee2949bd457bac92e3f21215a1bc310fd62f", "p1node": "0000000000000000000000000000000000000000", "p2node": "0000000000000000000000000000000000000000", "parents": "", "rev": 0, "tags": "tip", "ts": "2022-06-13 03:33:33 +0000", "numstat": {"hi.txt":[1,0]}}` + "\n"
 )
 
 var (
 	testRepo      = filepath.Clean("./testdata/golden_files/test_repo")
 	testLogRecord = LogRecord{
-		TS:        "2022-06-10 23:43:47 +0000",
-		NodeID:    "71efee2949bd457bac92e3f21215a1bc310fd62f",
-		RevID:     "0",
-		Author:    "Some User <some.user@email.com>",
-		Tags:      "tip",
-		Branch:    "default",
-		DiffStat:  "1: +1/-0",
-		Files:     "hi.txt",
-		GraphNode: "@",
-		RepoPath:  testRepo,
+		TS:          "2022-06-10 23:43:47 +0000",
+		NodeID:      "71efee2949bd457bac92e3f21215a1bc310fd62f",
+		RevID:       "0",
+		Author:      "Some User <some.user@email.com>",
+		Tags:        "tip",
+		Branch:      "default",
+		DiffStat:    "1: +1/-0",
+		Files:       "hi.txt",
+		GraphNode:   "@",
+		RepoPath:    testRepo,
+		Description: "initial commit",
+		FileChanges: []FileChange{
+			{Path: "hi.txt", Action: "added", Added: 1},
+		},
+		Time:         time.Date(2022, 6, 10, 23, 43, 47, 0, time.FixedZone("", 0)),
+		FilesChanged: 1,
+		LinesAdded:   1,
+		AuthorName:   "Some User",
+		AuthorEmail:  "some.user@email.com",
+		VCS:          "hg",
 	}
 	testErrorRepo = "/stub/repo_error"
 	errTest       = fmt.Errorf("simulated error in repo '/stub/repo_abc123'")
@@ -74,6 +92,22 @@ var (
 	}
 )
 
+// openTestDB opens an in-memory SQLite database with all migrations applied.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("unexpected database open error: %v", err)
+	}
+	db.SetMaxOpenConns(1) // every connection would be a separate database
+
+	if _, _, err := Migrate(context.Background(), db, sqliteDialect); err != nil {
+		t.Fatalf("unexpected migration error: %v", err)
+	}
+
+	return db
+}
+
 func makeSrvcMocks() (mockObt, mockPer) {
 	return mockObt{}, mockPer{}
 }
@@ -81,24 +115,47 @@ func makeSrvcMocks() (mockObt, mockPer) {
 type mockObt struct{}
 type mockPer struct{}
 
-func (m mockObt) Obtain(r string) (Results, error) {
+func (m mockObt) Obtain(ctx context.Context, r string, since Tip) (Results, error) {
 	return Results{}, nil
 }
 
-func (m mockPer) Persist(res Results) error {
+func (m mockPer) Persist(ctx context.Context, res Results) error {
 	return nil
 }
 
 type mockLogQry struct{}
 
-func (m mockLogQry) QueryLogs(repo string) (string, error) {
+func (m mockLogQry) QueryLogs(ctx context.Context, repo string, since Tip) (io.ReadCloser, error) {
 	switch {
+	case strings.HasPrefix(repo, testRepo) && since.Node != "":
+		return io.NopCloser(strings.NewReader("")), nil // nothing newer than the tip
 	case strings.HasPrefix(repo, testRepo):
-		return testRepoLog, nil
+		return io.NopCloser(strings.NewReader(testRepoLog)), nil
+	case strings.HasPrefix(repo, testErrorRepo):
+		return nil, errTest
+	default:
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+}
+
+// readAllClose reads and closes a log query stream.
+func readAllClose(t *testing.T, rc io.ReadCloser) (string, error) {
+	t.Helper()
+	b, err := io.ReadAll(rc)
+	if cErr := rc.Close(); err == nil {
+		err = cErr
+	}
+	return string(b), err
+}
+
+func (m mockLogQry) LookupRev(ctx context.Context, repo, node string) (int, bool, error) {
+	switch {
+	case node == testLogRecord.NodeID:
+		return 0, true, nil
 	case strings.HasPrefix(repo, testErrorRepo):
-		return "", errTest
+		return 0, false, errTest
 	default:
-		return "", nil
+		return 0, false, nil
 	}
 }
 
@@ -126,10 +183,209 @@ func TestCollectLogs(t *testing.T) {
 		rl := RepoList{testRepoLog}
 
 		// SUT
-		cs.CollectLogs(rl)
+		cs.CollectLogs(context.Background(), rl)
 
 		// NOTE: this test is rather anemic
 	})
+
+	t.Run("can summarize collected and failed repos", func(t *testing.T) {
+		o := DataReader{mockLogQry{}}
+		p := &mockRecPer{}
+		cs := NewCollSrvc(o, p, 2)
+
+		// SUT
+		cs.CollectLogs(context.Background(), RepoList{testRepo, testErrorRepo})
+		cs.WG.Wait()
+
+		got := cs.Summary()
+		assertDeep(t, got.Collected, RepoList{testRepo})
+		assertDeep(t, got.Failed, RepoList{testErrorRepo})
+		assert(t, len(got.Interrupted), 0)
+		assert(t, len(got.Skipped), 0)
+	})
+
+	t.Run("can release workers that panic", func(t *testing.T) {
+		o := DataReader{mockPanicQry{}}
+		p := &mockRecPer{}
+		cs := NewCollSrvc(o, p, 1)
+		cs.BatchSize = 0
+
+		// SUT
+		cs.CollectLogs(context.Background(), RepoList{testRepo, testErrorRepo})
+		cs.WG.Wait()
+
+		got := cs.Summary()
+		assertDeep(t, got.Failed, RepoList{testRepo, testErrorRepo})
+		assert(t, len(got.Collected), 0)
+	})
+
+	t.Run("can skip repos once cancelled", func(t *testing.T) {
+		o := DataReader{mockLogQry{}}
+		p := &mockRecPer{}
+		cs := NewCollSrvc(o, p, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		// SUT
+		cs.CollectLogs(ctx, RepoList{testRepo, testErrorRepo})
+		cs.WG.Wait()
+
+		got := cs.Summary()
+		assertDeep(t, got.Skipped, RepoList{testRepo, testErrorRepo})
+		assert(t, len(p.got), 0)
+	})
+
+	t.Run("can persist logs obtained before cancellation", func(t *testing.T) {
+		o := DataReader{mockStreamQry{out: testRepoLog, closeErr: errTest}}
+		p := &mockRecPer{}
+		cs := NewCollSrvc(o, p, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		// SUT
+		failed, _ := cs.collect(ctx, testRepo, Tip{}, &attempt{num: 1})
+
+		assert(t, failed, false)
+		assert(t, len(p.got), 1)
+		assert(t, len(p.got[0].LogRecs), 1)
+		assert(t, len(p.got[0].ErrEvents), 0)
+	})
+}
+
+func TestCollectStream(t *testing.T) {
+	t.Run("can persist streamed batches", func(t *testing.T) {
+		o := DataReader{mockStreamQry{out: testRepoLogDbl}}
+		p := &mockRecPer{}
+		cs := NewCollSrvc(o, p, 1)
+		cs.BatchSize = 1
+
+		// SUT
+		cs.CollectLogs(context.Background(), RepoList{testRepo})
+		cs.WG.Wait()
+
+		assert(t, len(p.got), 3) // both batches, then the final status
+		for _, res := range p.got[:2] {
+			assert(t, len(res.LogRecs), 1)
+			assert(t, res.Status == nil, true)
+		}
+		assert(t, p.got[2].Status.Failed, false)
+	})
+
+	t.Run("can discard batches after a persist error", func(t *testing.T) {
+		o := DataReader{mockStreamQry{out: testRepoLogDbl + testRepoLog}}
+		p := &mockRecPer{err: errTest}
+		cs := NewCollSrvc(o, p, 1)
+		cs.BatchSize = 1
+
+		// SUT
+		cs.CollectLogs(context.Background(), RepoList{testRepo})
+		cs.WG.Wait()
+
+		assert(t, len(p.got), 2) // the first batch, then the final status
+		assert(t, p.got[1].Status.Failed, true)
+	})
+
+	t.Run("can persist obtain errors", func(t *testing.T) {
+		o := DataReader{mockLogQry{}}
+		p := &mockRecPer{}
+		cs := NewCollSrvc(o, p, 1)
+		since := Tip{Rev: 1, Node: "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef"}
+
+		// SUT
+		cs.collectStream(context.Background(), o, testErrorRepo, since, &attempt{num: 1})
+
+		assert(t, len(p.got), 1)
+		assert(t, len(p.got[0].ErrEvents), 1)
+		assert(t, p.got[0].ErrEvents[0].Err, errTest)
+	})
+
+	t.Run("can persist a panicking producer as an error", func(t *testing.T) {
+		o := DataReader{mockPanicQry{}}
+		p := &mockRecPer{}
+		cs := NewCollSrvc(o, p, 1)
+
+		// SUT
+		failed, _ := cs.collectStream(context.Background(), o, testRepo, Tip{}, &attempt{num: 1})
+
+		assert(t, failed, true)
+		assert(t, len(p.got), 1)
+		assert(t, p.got[0].ErrEvents[0].Err, errObtainPanic)
+	})
+}
+
+// mockPanicQry panics instead of producing a log stream.
+type mockPanicQry struct {
+	mockLogQry
+}
+
+func (m mockPanicQry) QueryLogs(ctx context.Context, repo string, since Tip) (io.ReadCloser, error) {
+	panic("query failed")
+}
+
+func TestCollectTimeout(t *testing.T) {
+	t.Run("can record timeouts as a distinct kind", func(t *testing.T) {
+		o := DataReader{mockHungQry{}}
+		p := &mockRecPer{}
+		cs := NewCollSrvc(o, p, 1)
+		cs.Timeout = 10 * time.Millisecond
+
+		// SUT
+		cs.CollectLogs(context.Background(), RepoList{testRepo})
+		cs.WG.Wait()
+
+		assertDeep(t, cs.Summary().Failed, RepoList{testRepo})
+		var got []ErrorEvent
+		for _, res := range p.got {
+			got = append(got, res.ErrEvents...)
+		}
+		assert(t, len(got), 1)
+		assert(t, got[0].Kind, ErrKindTimeout)
+		assert(t, got[0].Err, context.DeadlineExceeded)
+	})
+
+	t.Run("can record timeouts without streaming", func(t *testing.T) {
+		o := DataReader{mockHungQry{}}
+		p := &mockRecPer{}
+		cs := NewCollSrvc(o, p, 1)
+		cs.Timeout = 10 * time.Millisecond
+
+		// SUT
+		failed, transient := cs.collect(context.Background(), testRepo, Tip{}, &attempt{num: 1})
+
+		assert(t, failed, true)
+		assert(t, transient, false)
+		assert(t, len(p.got), 1)
+		assert(t, len(p.got[0].ErrEvents), 1)
+		assert(t, p.got[0].ErrEvents[0].Kind, ErrKindTimeout)
+	})
+}
+
+// mockHungQry produces a log stream that never ends until cancelled.
+type mockHungQry struct {
+	mockLogQry
+}
+
+func (m mockHungQry) QueryLogs(ctx context.Context, repo string, since Tip) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		<-ctx.Done()
+		pw.CloseWithError(ctx.Err())
+	}()
+	return pr, nil
+}
+
+// mockRecPer records each persisted Results, failing with err if set.
+type mockRecPer struct {
+	mu  sync.Mutex
+	got []Results
+	err error
+}
+
+func (m *mockRecPer) Persist(ctx context.Context, res Results) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.got = append(m.got, res)
+	return m.err
 }
 
 func TestNewDataReader(t *testing.T) {
@@ -154,9 +410,10 @@ func TestObtainLogs(t *testing.T) {
 		}
 
 		// SUT
-		got, err := dr.Obtain(testRepo)
+		got, err := dr.Obtain(context.Background(), testRepo, Tip{})
 
 		assert(t, err, nil)
+		assert(t, got.Rewritten, false)
 		assert(t, len(got.LogRecs), 1)
 		assert(t, len(got.ErrEvents), 0)
 		gr := got.LogRecs[0]
@@ -172,9 +429,212 @@ func TestObtainLogs(t *testing.T) {
 		assert(t, gr.Files, wr.Files)
 		assert(t, gr.GraphNode, wr.GraphNode)
 		assert(t, gr.RepoPath, wr.RepoPath)
+		assert(t, gr.Description, wr.Description)
+		assertDeep(t, gr.FileChanges, wr.FileChanges)
+	})
+}
+
+func TestObtainStream(t *testing.T) {
+	t.Run("can obtain logs in batches", func(t *testing.T) {
+		dr := DataReader{mockStreamQry{out: testRepoLogDbl + testRepoLog}}
+		out := make(chan Results, 10)
+
+		// SUT
+		err := dr.ObtainStream(context.Background(), testRepo, Tip{}, 2, out)
+
+		assert(t, err, nil)
+		var got []int
+		for res := range out {
+			got = append(got, len(res.LogRecs))
+		}
+		assertDeep(t, got, []int{2, 1})
+	})
+
+	t.Run("can skip an empty final batch", func(t *testing.T) {
+		dr := DataReader{mockStreamQry{out: testRepoLogDbl}}
+		out := make(chan Results, 10)
+
+		// SUT
+		err := dr.ObtainStream(context.Background(), testRepo, Tip{}, 2, out)
+
+		assert(t, err, nil)
+		assert(t, len(out), 1)
+	})
+
+	t.Run("can mark only the first batch rewritten", func(t *testing.T) {
+		dr := DataReader{mockStreamQry{out: testRepoLogDbl}}
+		since := Tip{Rev: 3, Node: "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef"}
+		out := make(chan Results, 10)
+
+		// SUT
+		err := dr.ObtainStream(context.Background(), testRepo, since, 1, out)
+
+		assert(t, err, nil)
+		var got []bool
+		for res := range out {
+			got = append(got, res.Rewritten)
+		}
+		assertDeep(t, got, []bool{true, false})
+	})
+
+	t.Run("can close the stream on tip lookup errors", func(t *testing.T) {
+		dr := DataReader{mockLogQry{}}
+		since := Tip{Rev: 1, Node: "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef"}
+		out := make(chan Results, 10)
+
+		// SUT
+		err := dr.ObtainStream(context.Background(), testErrorRepo, since, 1, out)
+
+		assert(t, err, errTest)
+		_, open := <-out
+		assert(t, open, false)
+	})
+}
+
+func TestObtainCancelled(t *testing.T) {
+	t.Run("can keep logs read before cancellation", func(t *testing.T) {
+		dr := DataReader{mockStreamQry{out: testRepoLog, closeErr: errTest}}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		// SUT
+		got, err := dr.Obtain(ctx, testRepo, Tip{})
+
+		assert(t, err, context.Canceled)
+		assert(t, len(got.LogRecs), 1)
+		assert(t, len(got.ErrEvents), 0)
+	})
+}
+
+func TestDecodeLogEntry(t *testing.T) {
+	t.Run("can decode file changes", func(t *testing.T) {
+		le := logEntry{
+			Node:     testLogRecord.NodeID,
+			FileMods: []string{"my notes.txt", "old.bin"},
+			FileDels: []string{"gone.txt"},
+			Numstat:  map[string][2]int{"my notes.txt": {2, 1}, "old.bin": {0, 0}, "gone.txt": {0, 1}},
+		}
+		want := []FileChange{
+			{Path: "my notes.txt", Action: "modified", Added: 2, Removed: 1},
+			{Path: "old.bin", Action: "modified"},
+			{Path: "gone.txt", Action: "removed", Removed: 1},
+		}
+
+		// SUT
+		got := le.record(testRepo)
+
+		assertDeep(t, got.FileChanges, want)
+	})
+
+	t.Run("can decode typed values", func(t *testing.T) {
+		le := logEntry{
+			TS:       "2022-06-10 16:43:47 -0700",
+			Rev:      42,
+			DiffStat: "3: +120/-7",
+		}
+
+		// SUT
+		got := le.record(testRepo)
+
+		assert(t, got.Time.Unix(), testLogRecord.Time.Unix())
+		_, off := got.Time.Zone()
+		assert(t, off, -7*60*60)
+		assert(t, got.Rev, 42)
+		assertDeep(t, []int{got.FilesChanged, got.LinesAdded, got.LinesRemoved}, []int{3, 120, 7})
+	})
+
+	t.Run("can decode parent nodes without the null node", func(t *testing.T) {
+		le := logEntry{P1Node: testLogRecord.NodeID, P2Node: nullNode}
+
+		// SUT
+		got := le.record(testRepo)
+
+		assert(t, got.P1Node, testLogRecord.NodeID)
+		assert(t, got.P2Node, "")
+	})
+
+	t.Run("can decode unparsable typed values as zero", func(t *testing.T) {
+		le := logEntry{TS: "yesterday", DiffStat: "lots"}
+
+		// SUT
+		got := le.record(testRepo)
+
+		assert(t, got.Time.IsZero(), true)
+		assertDeep(t, []int{got.FilesChanged, got.LinesAdded, got.LinesRemoved}, []int{0, 0, 0})
+	})
+
+	fields := map[string]string{
+		"tabs":        "summary\twith\ttabs",
+		"quotes":      `it's "quoted" and 'single' \ escaped`,
+		"blank lines": "summary\n\nbody paragraph one\n\n\nbody paragraph two",
+		"markup":      "fix <script> & </script> handling\r\n\u00e9t\u00e9",
+	}
+	for name, field := range fields {
+		t.Run("can decode fields with "+name, func(t *testing.T) {
+			// encoded like hg's json filter, with a second entry following
+			line := strings.Replace(testRepoLog, `"initial commit"`, hgJSON(field), 1)
+			line = strings.Replace(line, `"Some User \u003csome.user@email.com\u003e"`, hgJSON(field), 1)
+			mq := mockStreamQry{out: line + testRepoLog}
+			dr := DataReader{mq}
+
+			// SUT
+			got, err := dr.Obtain(context.Background(), testRepo, Tip{})
+
+			assert(t, err, nil)
+			assert(t, len(got.ErrEvents), 0)
+			assert(t, len(got.LogRecs), 2)
+			assert(t, got.LogRecs[0].Description, field)
+			assert(t, got.LogRecs[0].Author, field)
+			assert(t, got.LogRecs[1].Description, testLogRecord.Description)
+		})
+	}
+
+	t.Run("can keep entries before a decoding error", func(t *testing.T) {
+		mq := mockStreamQry{out: testRepoLog + `{"node": "trunc`}
+		dr := DataReader{mq}
+
+		// SUT
+		got, err := dr.Obtain(context.Background(), testRepo, Tip{})
+
+		assert(t, err, nil)
+		assert(t, len(got.LogRecs), 1)
+		assert(t, len(got.ErrEvents), 1)
+	})
+
+	t.Run("can record errors when closing the stream", func(t *testing.T) {
+		mq := mockStreamQry{out: testRepoLog, closeErr: errTest}
+		dr := DataReader{mq}
+
+		// SUT
+		got, err := dr.Obtain(context.Background(), testRepo, Tip{})
+
+		assert(t, err, nil)
+		assert(t, len(got.LogRecs), 1)
+		assert(t, len(got.ErrEvents), 1)
+		assert(t, got.ErrEvents[0].Err, errTest)
 	})
 }
 
+// mockStreamQry streams fixed output, failing on close if closeErr is set.
+type mockStreamQry struct {
+	mockLogQry
+	out      string
+	closeErr error
+}
+
+func (m mockStreamQry) QueryLogs(ctx context.Context, repo string, since Tip) (io.ReadCloser, error) {
+	return mockStream{strings.NewReader(m.out), m.closeErr}, nil
+}
+
+type mockStream struct {
+	io.Reader
+	closeErr error
+}
+
+func (m mockStream) Close() error {
+	return m.closeErr
+}
+
 func TestObtainErrors(t *testing.T) {
 	t.Run("can obtain errors", func(t *testing.T) {
 		mq := mockLogQry{}
@@ -184,7 +644,7 @@ func TestObtainErrors(t *testing.T) {
 		}
 
 		// SUT
-		got, err := dr.Obtain(testErrorRepo)
+		got, err := dr.Obtain(context.Background(), testErrorRepo, Tip{})
 
 		assert(t, err, nil)
 		assert(t, len(got.LogRecs), 0)
@@ -198,6 +658,59 @@ func TestObtainErrors(t *testing.T) {
 	})
 }
 
+func TestObtainIncremental(t *testing.T) {
+	t.Run("can obtain only logs newer than tip", func(t *testing.T) {
+		mq := mockLogQry{}
+		dr := DataReader{mq}
+		since := Tip{Rev: 0, Node: testLogRecord.NodeID}
+
+		// SUT
+		got, err := dr.Obtain(context.Background(), testRepo, since)
+
+		assert(t, err, nil)
+		assert(t, got.Rewritten, false)
+		assert(t, len(got.LogRecs), 0)
+		assert(t, len(got.ErrEvents), 0)
+	})
+
+	t.Run("can detect rewritten history", func(t *testing.T) {
+		mq := mockLogQry{}
+		dr := DataReader{mq}
+		since := Tip{Rev: 3, Node: "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef"}
+
+		// SUT
+		got, err := dr.Obtain(context.Background(), testRepo, since)
+
+		assert(t, err, nil)
+		assert(t, got.Rewritten, true)
+		assert(t, len(got.LogRecs), 1)
+	})
+
+	t.Run("can detect renumbered tip", func(t *testing.T) {
+		mq := mockLogQry{}
+		dr := DataReader{mq}
+		since := Tip{Rev: 1, Node: testLogRecord.NodeID}
+
+		// SUT
+		got, err := dr.Obtain(context.Background(), testRepo, since)
+
+		assert(t, err, nil)
+		assert(t, got.Rewritten, true)
+		assert(t, len(got.LogRecs), 1)
+	})
+
+	t.Run("can return tip lookup errors", func(t *testing.T) {
+		mq := mockLogQry{}
+		dr := DataReader{mq}
+		since := Tip{Rev: 1, Node: "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef"}
+
+		// SUT
+		_, err := dr.Obtain(context.Background(), testErrorRepo, since)
+
+		assert(t, err, errTest)
+	})
+}
+
 func TestQueryLogs(t *testing.T) {
 	t.Run("can query hg command for logs", func(t *testing.T) {
 		// repo := filepath.Clean("./testdata/golden_files/test_repo2")
@@ -206,8 +719,12 @@ func TestQueryLogs(t *testing.T) {
 		want := testRepoLog
 
 		// SUT
-		got, err := proc.QueryLogs(repo)
+		rc, err := proc.QueryLogs(context.Background(), repo, Tip{})
 
+		if err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		got, err := readAllClose(t, rc)
 		assert(t, err, nil)
 		// assert(t, got, want)
 		if got != want {
@@ -216,6 +733,57 @@ func TestQueryLogs(t *testing.T) {
 	})
 }
 
+func TestHgLogReader(t *testing.T) {
+	t.Run("can replace patches with per file line counts", func(t *testing.T) {
+		out := `{"node": "a"}` + "\n" +
+			"diff -r 3c4d5e6f7a8b -r 4d5e6f7a8b9c my notes.txt\n" +
+			"--- a/my notes.txt\tFri Jun 10 23:43:47 2022 +0000\n" +
+			"+++ b/my notes.txt\tMon Jun 13 03:33:33 2022 +0000\n" +
+			"@@ -1,3 +1,3 @@\n" +
+			" keep\n" +
+			"--- removed line that looks like a header\n" +
+			"+added\n" +
+			"+++ added line that looks like a header\n" +
+			"diff -r 3c4d5e6f7a8b -r 4d5e6f7a8b9c old.bin\n" +
+			"Binary file old.bin has changed\n" +
+			"diff -r 3c4d5e6f7a8b -r 4d5e6f7a8b9c gone.txt\n" +
+			"--- a/gone.txt\tFri Jun 10 23:43:47 2022 +0000\n" +
+			"+++ /dev/null\tThu Jan 01 00:00:00 1970 +0000\n" +
+			"@@ -1,1 +0,0 @@\n" +
+			"-" + strings.Repeat("{long line}", hgLineBufSize) + "\n" +
+			"\n" +
+			`{"node": "b"}` + "\n"
+		r := strings.NewReader(out)
+		lr := &hgLogReader{po: io.NopCloser(r), out: bufio.NewReaderSize(r, hgLineBufSize)}
+		want := `{"node": "a", "numstat": {"gone.txt":[0,1],"my notes.txt":[2,1],"old.bin":[0,0]}}` + "\n" +
+			`{"node": "b", "numstat": {}}` + "\n"
+
+		// SUT
+		got, err := readAllClose(t, lr)
+
+		assert(t, err, nil)
+		assert(t, got, want)
+	})
+}
+
+func TestProcNotFound(t *testing.T) {
+	const name = "merc-log-collect-no-such-binary"
+
+	t.Run("can return a missing binary error when starting", func(t *testing.T) {
+		// SUT
+		_, err := startProc(context.Background(), name, nil)
+
+		assert(t, err, exec.ErrNotFound)
+	})
+
+	t.Run("can return a missing binary error when running", func(t *testing.T) {
+		// SUT
+		_, err := runProc(context.Background(), name)
+
+		assert(t, err, exec.ErrNotFound)
+	})
+}
+
 func TestNewStore(t *testing.T) {
 	t.Run("can init new collection service", func(t *testing.T) {
 		db, _, err := sqlmock.New()
@@ -227,9 +795,11 @@ func TestNewStore(t *testing.T) {
 		// SUT
 		got := NewStore(db)
 
-		if got.Lock == nil {
-			t.Errorf("got nil, want new store lock")
+		if got.writes == nil {
+			t.Errorf("got nil, want new store writes")
 		}
+		assert(t, got.GroupSize, defaultGroupSize)
+		assert(t, got.Close(), nil)
 	})
 }
 
@@ -243,6 +813,7 @@ func TestPersistLogs(t *testing.T) {
 
 		st := NewStore(db)
 		res := Results{
+			Repo:    testRepo,
 			LogRecs: []LogRecord{testLogRecord},
 		}
 
@@ -253,6 +824,12 @@ func TestPersistLogs(t *testing.T) {
 			mock.ExpectPrepare(`INSERT INTO logs`)
 			mock.ExpectExec(`INSERT INTO logs`).
 				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectPrepare(`INSERT INTO changeset_files`)
+			mock.ExpectExec(`INSERT INTO changeset_files`).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectPrepare(`INSERT INTO authors`)
+			mock.ExpectExec(`INSERT INTO authors`).
+				WillReturnResult(sqlmock.NewResult(1, 1))
 		}
 		if len(res.ErrEvents) > 0 {
 			expectCommit = true
@@ -265,7 +842,7 @@ func TestPersistLogs(t *testing.T) {
 		}
 
 		// SUT
-		err = st.Persist(res)
+		err = st.Persist(context.Background(), res)
 
 		assert(t, err, nil)
 		if err := mock.ExpectationsWereMet(); err != nil {
@@ -274,26 +851,728 @@ func TestPersistLogs(t *testing.T) {
 	})
 }
 
-func TestPersistErrors(t *testing.T) {
-	t.Run("can persist errors", func(t *testing.T) {
-		db, mock, err := sqlmock.New()
-		if err != nil {
-			t.Fatalf("unexepcted setup error: %v", err)
-		}
+func TestPersistTyped(t *testing.T) {
+	t.Run("can persist typed columns", func(t *testing.T) {
+		db := openTestDB(t)
 		defer db.Close()
-
 		st := NewStore(db)
-		res := Results{
-			ErrEvents: []ErrorEvent{testErrEvent},
+		r := testLogRecord
+		r.Time = r.Time.In(time.FixedZone("", 2*60*60))
+
+		// SUT
+		err := st.Persist(context.Background(), Results{Repo: testRepo, LogRecs: []LogRecord{r}})
+
+		assert(t, err, nil)
+		var got [6]int64
+		if err := db.QueryRow(
+			`SELECT ts_epoch, ts_offset, rev, files_changed, lines_added, lines_removed FROM logs`,
+		).Scan(&got[0], &got[1], &got[2], &got[3], &got[4], &got[5]); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
 		}
+		assert(t, got, [6]int64{r.Time.Unix(), 2 * 60 * 60, 0, 1, 1, 0})
+	})
 
-		var expectCommit bool
-		mock.ExpectBegin()
+	t.Run("can persist an unknown time as null", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+		st := NewStore(db)
+		r := testLogRecord
+		r.Time = time.Time{}
+
+		// SUT
+		err := st.Persist(context.Background(), Results{Repo: testRepo, LogRecs: []LogRecord{r}})
+
+		assert(t, err, nil)
+		var epoch, offset sql.NullInt64
+		if err := db.QueryRow(`SELECT ts_epoch, ts_offset FROM logs`).Scan(&epoch, &offset); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		assert(t, epoch.Valid || offset.Valid, false)
+	})
+}
+
+func TestPersistParents(t *testing.T) {
+	// a -- b -- d
+	//  \       /
+	//   `- c -'
+	recs := []LogRecord{
+		{NodeID: "a", RevID: "0", Rev: 0, RepoPath: testRepo},
+		{NodeID: "b", RevID: "1", Rev: 1, RepoPath: testRepo, P1Node: "a"},
+		{NodeID: "c", RevID: "2", Rev: 2, RepoPath: testRepo, P1Node: "a"},
+		{NodeID: "d", RevID: "3", Rev: 3, RepoPath: testRepo, P1Node: "b", P2Node: "c"},
+	}
+
+	t.Run("can persist parent edges", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+		st := NewStore(db)
+
+		// SUT
+		err := st.Persist(context.Background(), Results{Repo: testRepo, LogRecs: recs})
+
+		assert(t, err, nil)
+		rows, err := db.Query(
+			`SELECT node_id, parent_index, parent_node FROM changeset_parents ORDER BY node_id, parent_index`,
+		)
+		if err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		defer rows.Close()
+		var got []string
+		for rows.Next() {
+			var node, parent string
+			var idx int
+			if err := rows.Scan(&node, &idx, &parent); err != nil {
+				t.Fatalf("unexpected scan error: %v", err)
+			}
+			got = append(got, fmt.Sprintf("%v%v:%v", node, idx, parent))
+		}
+		assertDeep(t, got, []string{"b1:a", "c1:a", "d1:b", "d2:c"})
+	})
+
+	t.Run("can query ancestry over parent edges", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+		st := NewStore(db)
+		if err := st.Persist(context.Background(), Results{Repo: testRepo, LogRecs: recs}); err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+
+		// SUT
+		var ancestors string
+		err := db.QueryRow(`
+			WITH RECURSIVE ancestors(node) AS (
+				SELECT parent_node FROM changeset_parents WHERE repo_path = ? AND node_id = 'd'
+				UNION
+				SELECT p.parent_node FROM changeset_parents p JOIN ancestors a ON p.node_id = a.node
+				WHERE p.repo_path = ?
+			)
+			SELECT group_concat(node, '') FROM (SELECT node FROM ancestors ORDER BY node)`,
+			testRepo, testRepo,
+		).Scan(&ancestors)
+
+		assert(t, err, nil)
+		assert(t, ancestors, "abc")
+	})
+
+	t.Run("can replace parent edges of a rewritten repo", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+		st := NewStore(db)
+		if err := st.Persist(context.Background(), Results{Repo: testRepo, LogRecs: recs}); err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+
+		// SUT
+		err := st.Persist(context.Background(), Results{Repo: testRepo, Rewritten: true, LogRecs: recs[:2]})
+
+		assert(t, err, nil)
+		var cnt int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM changeset_parents`).Scan(&cnt); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		assert(t, cnt, 1)
+	})
+}
+
+func TestPersistManifest(t *testing.T) {
+	t.Run("can replace the metadata of listed repos", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+		st := NewStore(db)
+		first := Manifest{
+			{Path: testRepo, Meta: map[string][]string{"team": {"frontend"}, "tags": {"public", "js"}}},
+			{Path: testErrorRepo, Meta: map[string][]string{"team": {"backend"}}},
+		}
+		if err := st.PersistManifest(context.Background(), first); err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+		if err := st.Persist(context.Background(), Results{Repo: testRepo, LogRecs: []LogRecord{testLogRecord}}); err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+
+		// SUT
+		err := st.PersistManifest(context.Background(), Manifest{
+			{Path: testRepo, Meta: map[string][]string{"team": {"platform"}}},
+			{Path: testErrorRepo},
+		})
+
+		assert(t, err, nil)
+		var got []string
+		rows, err := db.Query(`SELECT repo_path, name, value FROM repo_metadata ORDER BY repo_path, name, value`)
+		if err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var repo, name, value string
+			if err := rows.Scan(&repo, &name, &value); err != nil {
+				t.Fatalf("unexpected scan error: %v", err)
+			}
+			got = append(got, repo+" "+name+"="+value)
+		}
+		assertDeep(t, got, []string{testErrorRepo + " team=backend", testRepo + " team=platform"})
+		var team string
+		if err := db.QueryRow(`SELECT m.value FROM logs l
+			JOIN repo_metadata m ON m.repo_path = l.repo_path AND m.name = 'team'`,
+		).Scan(&team); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		assert(t, team, "platform")
+	})
+}
+
+func TestLastTip(t *testing.T) {
+	t.Run("can find last tip", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("unexepcted setup error: %v", err)
+		}
+		defer db.Close()
+
+		st := NewStore(db)
+		mock.ExpectQuery(`SELECT rev, node_id FROM logs`).
+			WithArgs(testRepo).
+			WillReturnRows(
+				sqlmock.NewRows([]string{"rev", "node_id"}).
+					AddRow(42, testLogRecord.NodeID),
+			)
+
+		// SUT
+		got, err := st.LastTip(context.Background(), testRepo)
+
+		assert(t, err, nil)
+		assert(t, got, Tip{Rev: 42, Node: testLogRecord.NodeID})
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("not all sqlmock expecations were met: %v", err)
+		}
+	})
+
+	t.Run("can find no tip for new repo", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("unexepcted setup error: %v", err)
+		}
+		defer db.Close()
+
+		st := NewStore(db)
+		mock.ExpectQuery(`SELECT rev, node_id FROM logs`).
+			WithArgs(testRepo).
+			WillReturnRows(sqlmock.NewRows([]string{"rev", "node_id"}))
+
+		// SUT
+		got, err := st.LastTip(context.Background(), testRepo)
+
+		assert(t, err, nil)
+		assert(t, got, Tip{})
+	})
+}
+
+func TestStoredRevs(t *testing.T) {
+	t.Run("can find the rev of every stored node", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+		st := NewStore(db)
+		res := Results{Repo: testRepo, LogRecs: []LogRecord{testLogRecord}}
+		if err := st.Persist(context.Background(), res); err != nil {
+			t.Fatalf("unexpected persist error: %v", err)
+		}
+
+		// SUT
+		got, err := st.StoredRevs(context.Background(), testRepo)
+
+		assert(t, err, nil)
+		assertDeep(t, got, map[string]int{testLogRecord.NodeID: 0})
+	})
+
+	t.Run("can find no revs for new repo", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+
+		// SUT
+		got, err := NewStore(db).StoredRevs(context.Background(), testRepo)
+
+		assert(t, err, nil)
+		assertDeep(t, got, map[string]int{})
+	})
+}
+
+func TestPersistRewritten(t *testing.T) {
+	t.Run("can replace logs of rewritten repo", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("unexepcted setup error: %v", err)
+		}
+		defer db.Close()
+
+		st := NewStore(db)
+		res := Results{
+			Repo:      testRepo,
+			Rewritten: true,
+			LogRecs:   []LogRecord{testLogRecord},
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectExec(`DELETE FROM logs`).
+			WithArgs(testRepo).
+			WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectExec(`DELETE FROM changeset_files`).
+			WithArgs(testRepo).
+			WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectExec(`DELETE FROM changeset_parents`).
+			WithArgs(testRepo).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectPrepare(`INSERT INTO logs`)
+		mock.ExpectExec(`INSERT INTO logs`).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectPrepare(`INSERT INTO changeset_files`)
+		mock.ExpectExec(`INSERT INTO changeset_files`).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectPrepare(`INSERT INTO authors`)
+		mock.ExpectExec(`INSERT INTO authors`).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		// SUT
+		err = st.Persist(context.Background(), res)
+
+		assert(t, err, nil)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("not all sqlmock expecations were met: %v", err)
+		}
+	})
+}
+
+func TestPersistIdempotent(t *testing.T) {
+	t.Run("can persist the same logs twice without duplicates", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+
+		st := NewStore(db)
+		res := Results{
+			Repo:    testRepo,
+			LogRecs: []LogRecord{testLogRecord},
+		}
+
+		// SUT
+		for i := 0; i < 2; i++ {
+			if err := st.Persist(context.Background(), res); err != nil {
+				t.Fatalf("unexpected persist error on run %v: %v", i+1, err)
+			}
+		}
+
+		var cnt int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM logs`).Scan(&cnt); err != nil {
+			t.Fatalf("unexpected count error: %v", err)
+		}
+		assert(t, cnt, 1)
+	})
+
+	t.Run("can refresh the revs of logs already present", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+
+		st := NewStore(db)
+		res := Results{
+			Repo:    testRepo,
+			LogRecs: []LogRecord{testLogRecord},
+		}
+		if err := st.Persist(context.Background(), res); err != nil {
+			t.Fatalf("unexpected persist error: %v", err)
+		}
+		renumbered := testLogRecord
+		renumbered.Rev = 7
+		res.LogRecs = []LogRecord{renumbered}
+
+		// SUT
+		err := st.Persist(context.Background(), res)
+
+		assert(t, err, nil)
+		var rev int
+		if err := db.QueryRow(`SELECT rev FROM logs`).Scan(&rev); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		assert(t, rev, 7)
+	})
+}
+
+func TestPersistHostileStrings(t *testing.T) {
+	hostile := LogRecord{
+		TS:        "2022-06-10 23:43:47 +0000",
+		NodeID:    "'); DROP TABLE logs; --",
+		RevID:     "0",
+		ParentIDs: `"quoted"`,
+		Author:    "Pat O'Brien <pat@example.com>",
+		Tags:      "it's",
+		Branch:    "don't-merge",
+		DiffStat:  "1: +1/-0",
+		Files:     "don't.txt",
+		GraphNode: "@",
+		RepoPath:  "/repos/o'brien's repo",
+
+		Description: "don't\n\n'quote' me",
+		AuthorName:  "Pat O'Brien",
+		AuthorEmail: "pat@example.com",
+		VCS:         "hg",
+	}
+
+	t.Run("can bind hostile strings as parameters", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("unexepcted setup error: %v", err)
+		}
+		defer db.Close()
+
+		st := NewStore(db)
+		res := Results{
+			Repo:      hostile.RepoPath,
+			LogRecs:   []LogRecord{hostile},
+			ErrEvents: []ErrorEvent{{TS: hostile.TS, Err: errTest, Path: hostile.RepoPath, Kind: ErrKindError}},
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectPrepare(`INSERT INTO logs`)
+		mock.ExpectExec(`INSERT INTO logs`).
+			WithArgs(
+				hostile.TS, hostile.NodeID, hostile.RevID, hostile.ParentIDs,
+				hostile.Author, hostile.Tags, hostile.Branch, hostile.DiffStat,
+				hostile.Files, hostile.GraphNode, hostile.RepoPath, hostile.Description, nil,
+				nil, nil, 0, 0, 0, 0, hostile.AuthorName, hostile.AuthorEmail, hostile.VCS,
+			).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectPrepare(`INSERT INTO authors`)
+		mock.ExpectExec(`INSERT INTO authors`).
+			WithArgs(hostile.AuthorName, hostile.AuthorEmail, hostile.AuthorName, hostile.AuthorEmail).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectPrepare(`INSERT INTO errs`)
+		mock.ExpectExec(`INSERT INTO errs`).
+			WithArgs(hostile.TS, errTest.Error(), hostile.RepoPath, ErrKindError, 0, nil).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		// SUT
+		err = st.Persist(context.Background(), res)
+
+		assert(t, err, nil)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("not all sqlmock expecations were met: %v", err)
+		}
+	})
+
+	t.Run("can store hostile strings unchanged", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+
+		st := NewStore(db)
+		res := Results{
+			Repo:    hostile.RepoPath,
+			LogRecs: []LogRecord{hostile},
+		}
+
+		// SUT
+		err := st.Persist(context.Background(), res)
+
+		assert(t, err, nil)
+		var author, files string
+		if err := db.QueryRow(`SELECT author, files FROM logs`).Scan(&author, &files); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		assert(t, author, hostile.Author)
+		assert(t, files, hostile.Files)
+		var canon string
+		if err := db.QueryRow(`SELECT canonical_name FROM authors`).Scan(&canon); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		assert(t, canon, hostile.AuthorName)
+	})
+}
+
+func TestPersistChunked(t *testing.T) {
+	t.Run("can persist logs in chunks under the variable limit", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("unexepcted setup error: %v", err)
+		}
+		defer db.Close()
+
+		st := NewStore(db)
+		res := Results{Repo: testRepo}
+		for i := 0; i < 200; i++ {
+			r := testLogRecord
+			r.NodeID = fmt.Sprintf("%040d", i)
+			res.LogRecs = append(res.LogRecs, r)
+		}
+
+		// 22 columns allows 45 rows per chunk: 45 + 45 + 45 + 45 + 20
+		mock.ExpectBegin()
+		mock.ExpectPrepare(`INSERT INTO logs`)
+		for i := 1; i <= 4; i++ {
+			mock.ExpectExec(`INSERT INTO logs`).
+				WillReturnResult(sqlmock.NewResult(int64(45*i), 45))
+		}
+		mock.ExpectPrepare(`INSERT INTO logs`)
+		mock.ExpectExec(`INSERT INTO logs`).
+			WillReturnResult(sqlmock.NewResult(200, 20))
+		// 6 columns allows 166 file change rows per chunk: 166 + 34
+		mock.ExpectPrepare(`INSERT INTO changeset_files`)
+		mock.ExpectExec(`INSERT INTO changeset_files`).
+			WillReturnResult(sqlmock.NewResult(166, 166))
+		mock.ExpectPrepare(`INSERT INTO changeset_files`)
+		mock.ExpectExec(`INSERT INTO changeset_files`).
+			WillReturnResult(sqlmock.NewResult(200, 34))
+		mock.ExpectPrepare(`INSERT INTO authors`)
+		mock.ExpectExec(`INSERT INTO authors`).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		// SUT
+		err = st.Persist(context.Background(), res)
+
+		assert(t, err, nil)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("not all sqlmock expecations were met: %v", err)
+		}
+	})
+}
+
+func TestRuns(t *testing.T) {
+	t.Run("can attribute persisted rows to a run", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+		st := NewStore(db)
+		run := &Run{StartedAt: testLogRecord.TS, Flags: "-n=4", Host: "host", Version: "v1"}
+		res := Results{
+			Repo:      testRepo,
+			LogRecs:   []LogRecord{testLogRecord},
+			ErrEvents: []ErrorEvent{testErrEvent},
+		}
+
+		// SUT
+		err := st.StartRun(context.Background(), run)
+		assert(t, err, nil)
+		err = st.Persist(context.Background(), res)
+		assert(t, err, nil)
+		run.EndedAt = testErrEvent.TS
+		run.ReposAttempted, run.ReposSucceeded, run.ReposFailed = 2, 1, 1
+		err = st.EndRun(context.Background(), run)
+		assert(t, err, nil)
+
+		assert(t, run.RowsInserted, 1)
+		var got Run
+		if err := db.QueryRow(
+			`SELECT id, started_at, ended_at, flags, host, version, repos_attempted,
+			repos_succeeded, repos_failed, rows_inserted FROM runs`,
+		).Scan(
+			&got.ID, &got.StartedAt, &got.EndedAt, &got.Flags, &got.Host, &got.Version,
+			&got.ReposAttempted, &got.ReposSucceeded, &got.ReposFailed, &got.RowsInserted,
+		); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		assertDeep(t, got, *run)
+		for _, table := range []string{"logs", "errs"} {
+			var id int64
+			if err := db.QueryRow(`SELECT run_id FROM ` + table).Scan(&id); err != nil {
+				t.Fatalf("unexpected query error: %v", err)
+			}
+			assert(t, id, run.ID)
+		}
+	})
+
+	t.Run("can count only newly inserted rows", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+		st := NewStore(db)
+		res := Results{Repo: testRepo, LogRecs: []LogRecord{testLogRecord}}
+		if err := st.Persist(context.Background(), res); err != nil {
+			t.Fatalf("unexpected persist error: %v", err)
+		}
+		run := &Run{StartedAt: testLogRecord.TS}
+
+		// SUT
+		err := st.StartRun(context.Background(), run)
+		assert(t, err, nil)
+		err = st.Persist(context.Background(), res)
+		assert(t, err, nil)
+		err = st.EndRun(context.Background(), run)
+		assert(t, err, nil)
+
+		assert(t, run.RowsInserted, 0)
+	})
+}
+
+func TestRedactDSN(t *testing.T) {
+	tests := []struct {
+		dsn, want string
+	}{
+		{"postgres://merc:s3cret@db:5432/logs?sslmode=disable", "postgres://merc:xxxxx@db:5432/logs?sslmode=disable"},
+		{"postgres://merc@db/logs", "postgres://merc@db/logs"},
+		{"postgres://db/logs?user=merc&password=s3cret&sslmode=disable", "postgres://db/logs?user=merc&password=xxxxx&sslmode=disable"},
+		{"host=db user=merc password=s3cret dbname=logs", "host=db user=merc password=xxxxx dbname=logs"},
+		{`host=db password = 'it\'s s3cret' dbname=logs`, "host=db password = xxxxx dbname=logs"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("can redact %#v", tt.dsn), func(t *testing.T) {
+			// SUT
+			got := redactDSN(tt.dsn)
+
+			assert(t, got, tt.want)
+		})
+	}
+}
+
+func TestRepoStatus(t *testing.T) {
+	type status struct {
+		attempted, success, lastErr, lastErrTS, tipNode sql.NullString
+		changesets, duration                            sql.NullInt64
+	}
+	query := func(t *testing.T, db *sql.DB, repo string) status {
+		t.Helper()
+		var s status
+		if err := db.QueryRow(
+			`SELECT last_attempted, last_success, last_error, last_error_ts, tip_node, changesets, duration_ms
+			FROM repos WHERE repo_path = ?`, repo,
+		).Scan(&s.attempted, &s.success, &s.lastErr, &s.lastErrTS, &s.tipNode, &s.changesets, &s.duration); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		return s
+	}
+
+	t.Run("can track collected and failed repos", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+		cs := NewCollSrvc(DataReader{mockLogQry{}}, NewStore(db), 2)
+
+		// SUT
+		cs.CollectLogs(context.Background(), RepoList{testRepo, testErrorRepo})
+		cs.WG.Wait()
+
+		got := query(t, db, testRepo)
+		assert(t, got.attempted.Valid, true)
+		assert(t, got.success.Valid, true)
+		assert(t, got.lastErr.Valid, false)
+		assert(t, got.tipNode.String, testLogRecord.NodeID)
+		assert(t, got.changesets.Int64, int64(1))
+		assert(t, got.duration.Valid, true)
+
+		got = query(t, db, testErrorRepo)
+		assert(t, got.attempted.Valid, true)
+		assert(t, got.success.Valid, false)
+		assert(t, got.lastErr.String, errTest.Error())
+		assert(t, got.tipNode.Valid, false)
+		assert(t, got.changesets.Int64, int64(0))
+		assert(t, got.duration.Valid, true)
+	})
+
+	t.Run("can keep the last success after a failure", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+		st := NewStore(db)
+		started := time.Now()
+		ok := Results{Repo: testRepo, Status: &RepoStatus{Started: started, Finished: started}}
+		failed := Results{
+			Repo:      testRepo,
+			ErrEvents: []ErrorEvent{testErrEvent},
+			Status:    &RepoStatus{Started: started, Finished: started, Failed: true, LastErr: &testErrEvent},
+		}
+
+		// SUT
+		err := st.Persist(context.Background(), ok)
+		assert(t, err, nil)
+		err = st.Persist(context.Background(), failed)
+		assert(t, err, nil)
+
+		got := query(t, db, testRepo)
+		assert(t, got.success.String, started.Format(Log.tsfmt))
+		assert(t, got.lastErr.String, errTest.Error())
+		assert(t, got.lastErrTS.String, testErrEvent.TS)
+	})
+
+	t.Run("can clear the last error after a success", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+		st := NewStore(db)
+		started := time.Now()
+		failed := Results{
+			Repo:      testRepo,
+			ErrEvents: []ErrorEvent{testErrEvent},
+			Status:    &RepoStatus{Started: started, Finished: started, Failed: true, LastErr: &testErrEvent},
+		}
+		ok := Results{Repo: testRepo, Status: &RepoStatus{Started: started, Finished: started}}
+
+		// SUT
+		err := st.Persist(context.Background(), failed)
+		assert(t, err, nil)
+		err = st.Persist(context.Background(), ok)
+		assert(t, err, nil)
+
+		got := query(t, db, testRepo)
+		assert(t, got.success.String, started.Format(Log.tsfmt))
+		assert(t, got.lastErr.Valid, false)
+		assert(t, got.lastErrTS.Valid, false)
+	})
+
+	t.Run("can store afternoon times on the 24-hour clock", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+		st := NewStore(db)
+		started := time.Date(2022, 9, 19, 15, 4, 5, 0, time.UTC)
+		res := Results{Repo: testRepo, Status: &RepoStatus{Started: started, Finished: started}}
+
+		// SUT
+		err := st.Persist(context.Background(), res)
+		assert(t, err, nil)
+
+		got := query(t, db, testRepo)
+		assert(t, got.attempted.String, "2022-09-19 15:04:05 +0000")
+		assert(t, got.success.String, "2022-09-19 15:04:05 +0000")
+	})
+}
+
+func TestPersistErrors(t *testing.T) {
+	t.Run("can persist error kinds", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+		st := NewStore(db)
+		e := testErrEvent
+		e.Kind = ErrKindTimeout
+		res := Results{Repo: testErrorRepo, ErrEvents: []ErrorEvent{e}}
+
+		// SUT
+		err := st.Persist(context.Background(), res)
+
+		assert(t, err, nil)
+		var got string
+		if err := db.QueryRow(`SELECT kind FROM errs`).Scan(&got); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		assert(t, got, ErrKindTimeout)
+	})
+
+	t.Run("can persist errors", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("unexepcted setup error: %v", err)
+		}
+		defer db.Close()
+
+		st := NewStore(db)
+		res := Results{
+			ErrEvents: []ErrorEvent{testErrEvent},
+		}
+
+		var expectCommit bool
+		mock.ExpectBegin()
 		if len(res.LogRecs) > 0 {
 			expectCommit = true
 			mock.ExpectPrepare(`INSERT INTO logs`)
 			mock.ExpectExec(`INSERT INTO logs`).
 				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectPrepare(`INSERT INTO changeset_files`)
+			mock.ExpectExec(`INSERT INTO changeset_files`).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectPrepare(`INSERT INTO authors`)
+			mock.ExpectExec(`INSERT INTO authors`).
+				WillReturnResult(sqlmock.NewResult(1, 1))
 		}
 		if len(res.ErrEvents) > 0 {
 			expectCommit = true
@@ -306,7 +1585,7 @@ func TestPersistErrors(t *testing.T) {
 		}
 
 		// SUT
-		err = st.Persist(res)
+		err = st.Persist(context.Background(), res)
 
 		assert(t, err, nil)
 		if err := mock.ExpectationsWereMet(); err != nil {
@@ -314,3 +1593,113 @@ func TestPersistErrors(t *testing.T) {
 		}
 	})
 }
+
+func TestStoreWriter(t *testing.T) {
+	t.Run("can group commit results from concurrent workers", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+		st := NewStore(db)
+
+		// SUT
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				r := testLogRecord
+				r.NodeID = fmt.Sprintf("%040d", i)
+				res := Results{Repo: testRepo, LogRecs: []LogRecord{r}}
+				if err := st.Persist(context.Background(), res); err != nil {
+					t.Errorf("unexpected persist error: %v", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		err := st.Close()
+
+		assert(t, err, nil)
+		assert(t, st.inserted, 20)
+		var cnt int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM logs`).Scan(&cnt); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		assert(t, cnt, 20)
+	})
+
+	t.Run("can fail only the bad results of a group", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+		st := NewStore(db)
+		cancelled, cancel := context.WithCancel(context.Background())
+		cancel()
+		var group []storeWrite
+		for i, ctx := range []context.Context{context.Background(), cancelled, context.Background()} {
+			r := testLogRecord
+			r.NodeID = fmt.Sprintf("%040d", i)
+			group = append(group, storeWrite{
+				ctx:  ctx,
+				res:  Results{Repo: testRepo, LogRecs: []LogRecord{r}},
+				errc: make(chan error, 1),
+			})
+		}
+
+		// SUT
+		st.commit(group)
+
+		assert(t, <-group[0].errc, nil)
+		assert(t, <-group[1].errc, context.Canceled)
+		assert(t, <-group[2].errc, nil)
+		assert(t, st.inserted, 2)
+	})
+}
+
+// BenchmarkCollectDatagen collects the 1000 repos generated by cmd/datagen
+// (make datagen) into a SQLite file with the native backend, at each
+// synchronous level and with each Results committed alone or in groups.
+func BenchmarkCollectDatagen(b *testing.B) {
+	data := filepath.Join(os.TempDir(), "data-gen-copies")
+	dir, err := os.ReadDir(data)
+	if err != nil {
+		b.Skipf("no datagen data set, run make datagen: %v", err)
+	}
+	var rl RepoList
+	for _, d := range dir {
+		if d.IsDir() {
+			rl = append(rl, filepath.Join(data, d.Name()))
+		}
+	}
+
+	defer func(l appLog) { Log = l }(Log)
+	Log = appLog{tsfmt: Log.tsfmt, logger: log.New(io.Discard, "", 0)}
+
+	for _, sync := range []string{"OFF", "NORMAL", "FULL"} {
+		for _, group := range []int{1, defaultGroupSize} {
+			b.Run(fmt.Sprintf("sync=%v/group=%v", sync, group), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					db, err := sql.Open("sqlite3", sqliteDSN(filepath.Join(b.TempDir(), "log.db"), sync))
+					if err != nil {
+						b.Fatalf("unexpected database open error: %v", err)
+					}
+					if _, _, err := Migrate(context.Background(), db, sqliteDialect); err != nil {
+						b.Fatalf("unexpected migration error: %v", err)
+					}
+					st := NewStore(db)
+					st.GroupSize = group
+					cs := NewCollSrvc(NewDataReader(NewRevlogReader()), st, 8)
+					b.StartTimer()
+
+					cs.CollectLogs(context.Background(), rl)
+					cs.WG.Wait()
+
+					b.StopTimer()
+					if sum := cs.Summary(); len(sum.Collected) != len(rl) {
+						b.Fatalf("got %v repos collected, want %v", len(sum.Collected), len(rl))
+					}
+					st.Close()
+					db.Close()
+				}
+			})
+		}
+	}
+}
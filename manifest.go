@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//// Repo manifests
+
+// Repo is a repo listed by a manifest, with the metadata given for it.
+type Repo struct {
+	Path string
+	Meta map[string][]string // values by name, e.g. team or tags
+}
+
+// Manifest is the repos to collect as listed by an inventory, in order.
+type Manifest []Repo
+
+// RepoList lists the paths of the repos of a Manifest.
+func (m Manifest) RepoList() RepoList {
+	rl := make(RepoList, 0, len(m))
+	for _, r := range m {
+		rl = append(rl, r.Path)
+	}
+
+	return rl
+}
+
+// LoadManifest reads the manifest file at path, or stdin if path is -.
+func LoadManifest(path string) (Manifest, error) {
+	if path == "-" {
+		return ReadManifest(os.Stdin)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m, err := ReadManifest(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w - reading manifest: %v", err, path)
+	}
+
+	return m, nil
+}
+
+var errNoRepoPath = errors.New("repo without a path")
+
+// ReadManifest reads repos in any of these formats, told apart by content:
+//
+//   - JSON, either an array of objects or one object per line, each with a
+//     path and any other fields as metadata. Arrays give many values.
+//   - CSV with a header row naming a path column, the other columns being
+//     metadata. Columns of the same name give many values.
+//   - One path per line, skipping blank lines and lines starting with #.
+//
+// Each repo may only be listed once.
+func ReadManifest(r io.Reader) (Manifest, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(512)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if bom := "\ufeff"; bytes.HasPrefix(head, []byte(bom)) {
+		br.Discard(len(bom))
+		head = head[len(bom):]
+	}
+	head = bytes.TrimLeft(head, " \t\r\n")
+
+	var m Manifest
+	switch {
+	case len(head) > 0 && (head[0] == '[' || head[0] == '{'):
+		m, err = readJSONManifest(br)
+	case isCSVHeader(head):
+		m, err = readCSVManifest(br)
+	default:
+		m, err = readLinesManifest(br)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, r := range m {
+		if seen[r.Path] {
+			return nil, fmt.Errorf("repo listed twice: %#v", r.Path)
+		}
+		seen[r.Path] = true
+	}
+
+	return m, nil
+}
+
+func readJSONManifest(r io.Reader) (Manifest, error) {
+	var objs []map[string]json.RawMessage
+	dec := json.NewDecoder(r)
+	for {
+		t, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if t == json.Delim('[') || t == json.Delim(']') {
+			continue
+		}
+		if t != json.Delim('{') {
+			return nil, fmt.Errorf("unexpected JSON %v, want an object per repo", t)
+		}
+
+		// decode the rest of the object the token started
+		obj := map[string]json.RawMessage{}
+		for dec.More() {
+			k, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			var v json.RawMessage
+			if err := dec.Decode(&v); err != nil {
+				return nil, err
+			}
+			obj[k.(string)] = v
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		objs = append(objs, obj)
+	}
+
+	var m Manifest
+	for i, obj := range objs {
+		var path string
+		if err := json.Unmarshal(obj["path"], &path); err != nil || path == "" {
+			return nil, fmt.Errorf("%w - object %v", errNoRepoPath, i+1)
+		}
+
+		repo := Repo{Path: cleanRepo(path), Meta: map[string][]string{}}
+		for k, v := range obj {
+			if k == "path" {
+				continue
+			}
+			vals, err := jsonMetaValues(v)
+			if err != nil {
+				return nil, fmt.Errorf("%w - field %v of object %v", err, k, i+1)
+			}
+			if len(vals) > 0 {
+				repo.Meta[k] = vals
+			}
+		}
+		m = append(m, repo)
+	}
+
+	return m, nil
+}
+
+// jsonMetaValues are the values of a metadata field, strings as they are and
+// other values as JSON, with arrays giving a value per element.
+func jsonMetaValues(v json.RawMessage) ([]string, error) {
+	var elems []json.RawMessage
+	if err := json.Unmarshal(v, &elems); err != nil {
+		elems = []json.RawMessage{v}
+	}
+
+	var vals []string
+	for _, e := range elems {
+		var s string
+		switch {
+		case string(e) == "null":
+			continue
+		case json.Unmarshal(e, &s) == nil:
+			vals = append(vals, s)
+		default:
+			var c bytes.Buffer
+			if err := json.Compact(&c, e); err != nil {
+				return nil, err
+			}
+			vals = append(vals, c.String())
+		}
+	}
+
+	return vals, nil
+}
+
+// isCSVHeader reports whether the first line of head is a CSV header with a
+// path column.
+func isCSVHeader(head []byte) bool {
+	line := head
+	if i := bytes.IndexByte(head, '\n'); i != -1 {
+		line = head[:i]
+	}
+	fields, err := csv.NewReader(bytes.NewReader(line)).Read()
+	if err != nil {
+		return false
+	}
+	for _, f := range fields {
+		if strings.TrimSpace(f) == "path" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func readCSVManifest(r io.Reader) (Manifest, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1 // ragged rows are checked below
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	var m Manifest
+	for ln := 2; ; ln++ {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) != len(header) {
+			return nil, fmt.Errorf("%v fields, want %v - line %v", len(rec), len(header), ln)
+		}
+
+		repo := Repo{Meta: map[string][]string{}}
+		for i, v := range rec {
+			switch {
+			case header[i] == "path":
+				repo.Path = strings.TrimSpace(v)
+			case v != "":
+				repo.Meta[header[i]] = append(repo.Meta[header[i]], v)
+			}
+		}
+		if repo.Path == "" {
+			return nil, fmt.Errorf("%w - line %v", errNoRepoPath, ln)
+		}
+		repo.Path = cleanRepo(repo.Path)
+		m = append(m, repo)
+	}
+
+	return m, nil
+}
+
+func readLinesManifest(r io.Reader) (Manifest, error) {
+	var m Manifest
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m = append(m, Repo{Path: cleanRepo(line)})
+	}
+
+	return m, sc.Err()
+}
+
+// cleanRepo cleans the path of a local repo, leaving URLs as they are.
+func cleanRepo(repo string) string {
+	if isRemote(repo) {
+		return repo
+	}
+
+	return filepath.Clean(repo)
+}
+
+// metaRows flattens the metadata of a repo to a row per value, in order of
+// name.
+func (r Repo) metaRows() [][2]string {
+	var names []string
+	for n := range r.Meta {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var rows [][2]string
+	for _, n := range names {
+		for _, v := range r.Meta[n] {
+			rows = append(rows, [2]string{n, v})
+		}
+	}
+
+	return rows
+}
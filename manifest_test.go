@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReadManifest(t *testing.T) {
+	want := Manifest{
+		{Path: "/repos/web", Meta: map[string][]string{"team": {"frontend"}, "tags": {"public", "js"}}},
+		{Path: "/repos/api", Meta: map[string][]string{"team": {"backend"}}},
+	}
+
+	for name, manifest := range map[string]string{
+		"a JSON array": `[
+			{"path": "/repos/web", "team": "frontend", "tags": ["public", "js"]},
+			{"path": "/repos/api/", "team": "backend", "tags": [], "owner": null}
+		]`,
+		"JSON lines": `{"path": "/repos/web", "team": "frontend", "tags": ["public", "js"]}
+			{"path": "/repos/api", "team": "backend"}`,
+		"CSV": "path,team,tags,tags\n" +
+			"/repos/web,frontend,public,js\n" +
+			"/repos/api,backend,,\n",
+		"CSV with a byte order mark": "\ufeffpath,team,tags,tags\r\n" +
+			"/repos/web,frontend,public,js\r\n" +
+			"/repos/api,backend,,\r\n",
+	} {
+		t.Run("can read "+name, func(t *testing.T) {
+			// SUT
+			got, err := ReadManifest(strings.NewReader(manifest))
+
+			assert(t, err, nil)
+			assertDeep(t, got, want)
+		})
+	}
+
+	t.Run("can read paths one per line", func(t *testing.T) {
+		// SUT
+		got, err := ReadManifest(strings.NewReader("# inventory export\n/repos/web\n\n  /repos/api  \n"))
+
+		assert(t, err, nil)
+		assertDeep(t, got, Manifest{{Path: "/repos/web"}, {Path: "/repos/api"}})
+		assertDeep(t, got.RepoList(), RepoList{"/repos/web", "/repos/api"})
+	})
+
+	t.Run("can read non-string JSON metadata as JSON", func(t *testing.T) {
+		// SUT
+		got, err := ReadManifest(strings.NewReader(`{"path": "/repos/web", "tier": 1, "owners": {"a": [1, 2]}}`))
+
+		assert(t, err, nil)
+		assertDeep(t, got[0].Meta, map[string][]string{"tier": {"1"}, "owners": {`{"a":[1,2]}`}})
+	})
+
+	t.Run("can read an empty manifest", func(t *testing.T) {
+		// SUT
+		got, err := ReadManifest(strings.NewReader(""))
+
+		assert(t, err, nil)
+		assert(t, len(got), 0)
+	})
+
+	for name, tc := range map[string]struct {
+		manifest string
+		want     string
+	}{
+		"a JSON repo without a path": {`[{"path": "/repos/web"}, {"team": "backend"}]`, "object 2"},
+		"a CSV repo without a path":  {"path,team\n/repos/web,frontend\n,backend\n", "line 3"},
+		"a ragged CSV row":           {"path,team\n/repos/web\n", "line 2"},
+		"a repo listed twice":        {"/repos/web\n/repos/api\n/repos/web/\n", "listed twice"},
+		"JSON other than objects":    {`["/repos/web"]`, "want an object"},
+	} {
+		t.Run("can reject "+name, func(t *testing.T) {
+			// SUT
+			_, err := ReadManifest(strings.NewReader(tc.manifest))
+
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got error %v, want an error with %#v", err, tc.want)
+			}
+		})
+	}
+
+	t.Run("can report a repo without a path", func(t *testing.T) {
+		// SUT
+		_, err := ReadManifest(strings.NewReader(`{"team": "backend"}`))
+
+		assert(t, errors.Is(err, errNoRepoPath), true)
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//// Versioned database schema
+
+// migrationFS holds the schema migrations, named NNNN_description.sql and
+// applied in order of NNNN. They are written for SQLite and adapted to other
+// databases by their dialect.
+//
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+func loadMigrations() ([]migration, error) {
+	files, err := migrationFS.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var ms []migration
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), ".sql")
+		v, err := strconv.Atoi(strings.SplitN(name, "_", 2)[0])
+		if err != nil {
+			return nil, fmt.Errorf("%w - migration version: %v", err, f.Name())
+		}
+		b, err := migrationFS.ReadFile(path.Join("migrations", f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, migration{Version: v, Name: name, SQL: string(b)})
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+
+	for i, m := range ms {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %v is out of sequence, want version %v", m.Name, i+1)
+		}
+	}
+
+	return ms, nil
+}
+
+// legacyProbes detect each migration's change in SQLite databases created
+// before versioned migrations, by the single create script that evolved with
+// them. A probe counts more than zero rows if its migration is present.
+var legacyProbes = map[int]string{
+	1: `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'logs'`,
+	2: `SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'logs_repo_node'`,
+	3: `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'changeset_files'`,
+	4: `SELECT COUNT(*) FROM pragma_table_info('logs') WHERE name = 'description'`,
+	5: `SELECT COUNT(*) FROM pragma_table_info('errs') WHERE name = 'kind'`,
+	6: `SELECT COUNT(*) FROM pragma_table_info('errs') WHERE name = 'attempt'`,
+	7: `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'runs'`,
+	8: `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'repos'`,
+}
+
+// errSchemaNewer means the database was migrated by a newer version of the
+// collector, which this one may write incorrectly.
+var errSchemaNewer = errors.New("database schema is newer than supported")
+
+// errSchemaOlder means the database must be upgraded with the migrate
+// subcommand before use.
+var errSchemaOlder = errors.New("database schema is older than supported, upgrade it with the migrate subcommand")
+
+// schemaVersion reports the version of a database schema and whether it was
+// inferred from a database created before versioned migrations. A new, empty
+// database is version 0.
+func schemaVersion(ctx context.Context, db *sql.DB, d dialect) (int, bool, error) {
+	var n int
+	if err := db.QueryRowContext(ctx, d.SQL(d.TableSQL), "schema_version").Scan(&n); err != nil {
+		return 0, false, fmt.Errorf("%w - finding schema_version table", err)
+	}
+
+	if n > 0 {
+		var v sql.NullInt64
+		if err := db.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_version`).Scan(&v); err != nil {
+			return 0, false, fmt.Errorf("%w - reading schema version", err)
+		}
+		return int(v.Int64), false, nil
+	}
+	if !d.Legacy {
+		return 0, false, nil
+	}
+
+	// changes were only ever added in order, so the version is the last of
+	// the unbroken run of probes that find their change
+	var v int
+	for ; v < len(legacyProbes); v++ {
+		var cnt int
+		if err := db.QueryRowContext(ctx, legacyProbes[v+1]).Scan(&cnt); err != nil {
+			return 0, false, fmt.Errorf("%w - probing legacy schema for migration %v", err, v+1)
+		}
+		if cnt == 0 {
+			break
+		}
+	}
+
+	return v, v > 0, nil
+}
+
+// CheckSchema prepares a database for collection, creating the schema of a
+// new database but refusing one that is older or newer than supported.
+func CheckSchema(ctx context.Context, db *sql.DB, d dialect) error {
+	ms, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	v, _, err := schemaVersion(ctx, db, d)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case v > len(ms):
+		return fmt.Errorf("%w - database version %v, supported version %v", errSchemaNewer, v, len(ms))
+	case v == 0:
+		_, _, err := Migrate(ctx, db, d)
+		return err
+	case v < len(ms):
+		return fmt.Errorf("%w - database version %v, supported version %v", errSchemaOlder, v, len(ms))
+	}
+
+	return nil
+}
+
+// Migrate upgrades a database in place to the latest schema version, each
+// migration in its own transaction, returning the versions before and after.
+func Migrate(ctx context.Context, db *sql.DB, d dialect) (int, int, error) {
+	ms, err := loadMigrations()
+	if err != nil {
+		return 0, 0, err
+	}
+	from, legacy, err := schemaVersion(ctx, db, d)
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > len(ms) {
+		return from, from, fmt.Errorf("%w - database version %v, supported version %v", errSchemaNewer, from, len(ms))
+	}
+
+	if _, err := db.ExecContext(ctx, d.ddl(`CREATE TABLE IF NOT EXISTS schema_version(
+		version INTEGER PRIMARY KEY,
+		name CHAR(255) NOT NULL,
+		applied_at CHAR(100) NOT NULL
+	)`)); err != nil {
+		return from, from, fmt.Errorf("%w - creating schema_version table", err)
+	}
+
+	vSQL := d.SQL(`INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)`)
+	if legacy {
+		Log.Infof("recording inferred schema version %v of legacy database", from)
+		for _, m := range ms[:from] {
+			if _, err := db.ExecContext(ctx, vSQL, m.Version, m.Name, time.Now().Format(Log.tsfmt)); err != nil {
+				return from, from, fmt.Errorf("%w - recording legacy migration: %v", err, m.Name)
+			}
+		}
+	}
+
+	to := from
+	for _, m := range ms[from:] {
+		Log.Infof("applying migration: %v", m.Name)
+		if err := applyMigration(ctx, db, d, m, vSQL); err != nil {
+			return from, to, err
+		}
+		to = m.Version
+	}
+
+	return from, to, nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, d dialect, m migration, vSQL string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, d.ddl(m.SQL)); err != nil {
+		return fmt.Errorf("%w - applying migration: %v", err, m.Name)
+	}
+	if _, err := tx.ExecContext(ctx, vSQL, m.Version, m.Name, time.Now().Format(Log.tsfmt)); err != nil {
+		return fmt.Errorf("%w - recording migration: %v", err, m.Name)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// openEmptyDB opens an in-memory SQLite database without any schema.
+func openEmptyDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("unexpected database open error: %v", err)
+	}
+	db.SetMaxOpenConns(1) // every connection would be a separate database
+
+	return db
+}
+
+func TestLoadMigrations(t *testing.T) {
+	t.Run("can load migrations in order", func(t *testing.T) {
+		// SUT
+		got, err := loadMigrations()
+
+		assert(t, err, nil)
+		assert(t, len(got) >= len(legacyProbes), true) // later migrations postdate legacy databases
+		for i, m := range got {
+			assert(t, m.Version, i+1)
+		}
+		assert(t, got[0].Name, "0001_initial")
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	ms, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("unexpected migration load error: %v", err)
+	}
+	latest := len(ms)
+
+	t.Run("can migrate a new database", func(t *testing.T) {
+		db := openEmptyDB(t)
+		defer db.Close()
+
+		// SUT
+		from, to, err := Migrate(context.Background(), db, sqliteDialect)
+
+		assert(t, err, nil)
+		assert(t, from, 0)
+		assert(t, to, latest)
+		v, legacy, err := schemaVersion(context.Background(), db, sqliteDialect)
+		assert(t, err, nil)
+		assert(t, v, latest)
+		assert(t, legacy, false)
+	})
+
+	t.Run("can migrate an up to date database without changes", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+
+		// SUT
+		from, to, err := Migrate(context.Background(), db, sqliteDialect)
+
+		assert(t, err, nil)
+		assert(t, from, latest)
+		assert(t, to, latest)
+	})
+
+	t.Run("can upgrade a legacy database in place", func(t *testing.T) {
+		db := openEmptyDB(t)
+		defer db.Close()
+		// the original create script, with duplicates from repeated runs
+		if _, err := db.Exec(ms[0].SQL); err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := db.Exec(
+				`INSERT INTO logs (ts, node_id, rev_id, repo_path) VALUES (?, ?, ?, ?)`,
+				testLogRecord.TS, testLogRecord.NodeID, testLogRecord.RevID, testRepo,
+			); err != nil {
+				t.Fatalf("unexpected setup error: %v", err)
+			}
+		}
+
+		// SUT
+		from, to, err := Migrate(context.Background(), db, sqliteDialect)
+
+		assert(t, err, nil)
+		assert(t, from, 1)
+		assert(t, to, latest)
+		var cnt int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM logs`).Scan(&cnt); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		assert(t, cnt, 1)
+		if err := db.QueryRow(`SELECT COUNT(*) FROM schema_version`).Scan(&cnt); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		assert(t, cnt, latest)
+	})
+
+	t.Run("can backfill typed columns of existing logs", func(t *testing.T) {
+		db := openEmptyDB(t)
+		defer db.Close()
+		for _, m := range ms[:8] {
+			if _, err := db.Exec(m.SQL); err != nil {
+				t.Fatalf("unexpected setup error: %v", err)
+			}
+		}
+		if _, err := db.Exec(
+			`INSERT INTO logs (ts, node_id, rev_id, diffstat, repo_path) VALUES (?, ?, ?, ?, ?)`,
+			"2022-06-10 16:43:47 -0730", testLogRecord.NodeID, "42", "3: +120/-7", testRepo,
+		); err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+
+		// SUT
+		_, _, err := Migrate(context.Background(), db, sqliteDialect)
+
+		assert(t, err, nil)
+		var got [6]int64
+		if err := db.QueryRow(
+			`SELECT ts_epoch, ts_offset, rev, files_changed, lines_added, lines_removed FROM logs`,
+		).Scan(&got[0], &got[1], &got[2], &got[3], &got[4], &got[5]); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		ts := time.Date(2022, 6, 10, 16, 43, 47, 0, time.FixedZone("", -(7*60+30)*60))
+		assert(t, got, [6]int64{ts.Unix(), -(7*60 + 30) * 60, 42, 3, 120, 7})
+	})
+
+	t.Run("can backfill parent edges of existing logs", func(t *testing.T) {
+		db := openEmptyDB(t)
+		defer db.Close()
+		for _, m := range ms[:8] {
+			if _, err := db.Exec(m.SQL); err != nil {
+				t.Fatalf("unexpected setup error: %v", err)
+			}
+		}
+		// linear from 0 to 2, 3 branching off 0 and 4 merging 2 and 3
+		for _, l := range [][]string{
+			{"0", "n0", ""},
+			{"1", "n1", ""},
+			{"2", "n2", ""},
+			{"3", "n3", "0:n0"},
+			{"4", "n4", "2:n2 3:n3"},
+		} {
+			if _, err := db.Exec(
+				`INSERT INTO logs (ts, rev_id, node_id, parent_ids, repo_path) VALUES ('', ?, ?, ?, ?)`,
+				l[0], l[1], l[2], testRepo,
+			); err != nil {
+				t.Fatalf("unexpected setup error: %v", err)
+			}
+		}
+
+		// SUT
+		_, _, err := Migrate(context.Background(), db, sqliteDialect)
+
+		assert(t, err, nil)
+		var edges string
+		if err := db.QueryRow(
+			`SELECT group_concat(edge, ' ') FROM (SELECT node_id || parent_index || ':' || parent_node AS edge
+			FROM changeset_parents ORDER BY node_id, parent_index)`,
+		).Scan(&edges); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		assert(t, edges, "n11:n0 n21:n1 n31:n0 n41:n2 n42:n3")
+	})
+
+	t.Run("can backfill author names and emails of existing logs", func(t *testing.T) {
+		db := openEmptyDB(t)
+		defer db.Close()
+		for _, m := range ms[:8] {
+			if _, err := db.Exec(m.SQL); err != nil {
+				t.Fatalf("unexpected setup error: %v", err)
+			}
+		}
+		for i, a := range []string{testLogRecord.Author, testLogRecord.Author, " Just A Name "} {
+			if _, err := db.Exec(
+				`INSERT INTO logs (ts, node_id, author, repo_path) VALUES ('', ?, ?, ?)`,
+				i, a, testRepo,
+			); err != nil {
+				t.Fatalf("unexpected setup error: %v", err)
+			}
+		}
+
+		// SUT
+		_, _, err := Migrate(context.Background(), db, sqliteDialect)
+
+		assert(t, err, nil)
+		rows, err := db.Query(`SELECT name, email, canonical_name, canonical_email FROM authors ORDER BY name`)
+		if err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		defer rows.Close()
+		var got [][4]string
+		for rows.Next() {
+			var a [4]string
+			if err := rows.Scan(&a[0], &a[1], &a[2], &a[3]); err != nil {
+				t.Fatalf("unexpected scan error: %v", err)
+			}
+			got = append(got, a)
+		}
+		name, email := splitAuthor(testLogRecord.Author)
+		assertDeep(t, got, [][4]string{
+			{"Just A Name", "", "Just A Name", ""},
+			{name, email, name, email},
+		})
+	})
+
+	t.Run("can default logs to being collected from hg", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+
+		// SUT
+		_, err := db.Exec(`INSERT INTO logs (ts, node_id, repo_path) VALUES ('', 'n0', ?)`, testRepo)
+
+		assert(t, err, nil)
+		var vcs string
+		if err := db.QueryRow(`SELECT vcs FROM logs`).Scan(&vcs); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		assert(t, vcs, vcsHg)
+	})
+
+	t.Run("can infer the version of a partly evolved legacy database", func(t *testing.T) {
+		db := openEmptyDB(t)
+		defer db.Close()
+		for _, m := range ms[:4] {
+			if _, err := db.Exec(m.SQL); err != nil {
+				t.Fatalf("unexpected setup error: %v", err)
+			}
+		}
+
+		// SUT
+		v, legacy, err := schemaVersion(context.Background(), db, sqliteDialect)
+
+		assert(t, err, nil)
+		assert(t, v, 4)
+		assert(t, legacy, true)
+	})
+
+	t.Run("can refuse a newer database", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+		if _, err := db.Exec(
+			`INSERT INTO schema_version (version, name, applied_at) VALUES (?, 'from_the_future', '')`,
+			latest+1,
+		); err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+
+		// SUT
+		_, _, err := Migrate(context.Background(), db, sqliteDialect)
+
+		assert(t, err, errSchemaNewer)
+	})
+}
+
+func TestCheckSchema(t *testing.T) {
+	t.Run("can create the schema of a new database", func(t *testing.T) {
+		db := openEmptyDB(t)
+		defer db.Close()
+
+		// SUT
+		err := CheckSchema(context.Background(), db, sqliteDialect)
+
+		assert(t, err, nil)
+		var cnt int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM logs`).Scan(&cnt); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+	})
+
+	t.Run("can refuse an older database", func(t *testing.T) {
+		db := openEmptyDB(t)
+		defer db.Close()
+		ms, _ := loadMigrations()
+		if _, err := db.Exec(ms[0].SQL); err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+
+		// SUT
+		err := CheckSchema(context.Background(), db, sqliteDialect)
+
+		assert(t, err, errSchemaOlder)
+	})
+
+	t.Run("can accept an up to date database", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+
+		// SUT
+		err := CheckSchema(context.Background(), db, sqliteDialect)
+
+		assert(t, err, nil)
+	})
+}
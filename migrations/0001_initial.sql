@@ -1,4 +1,4 @@
-CREATE TABLE IF NOT EXISTS logs(
+CREATE TABLE logs(
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     ts CHAR(100) NOT NULL,
     node_id CHAR(100),
@@ -13,7 +13,7 @@ CREATE TABLE IF NOT EXISTS logs(
     repo_path CHAR(255)
 );
 
-CREATE TABLE IF NOT EXISTS errs(
+CREATE TABLE errs(
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     ts CHAR(100) NOT NULL,
     err TEXT,
@@ -0,0 +1,6 @@
+-- remove duplicates left by runs from before logs were unique per repo
+DELETE FROM logs WHERE id NOT IN (
+    SELECT MIN(id) FROM logs GROUP BY repo_path, node_id
+);
+
+CREATE UNIQUE INDEX logs_repo_node ON logs(repo_path, node_id);
@@ -0,0 +1,12 @@
+CREATE TABLE changeset_files(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    repo_path CHAR(255) NOT NULL,
+    node_id CHAR(100) NOT NULL,
+    path TEXT NOT NULL,
+    action CHAR(10) NOT NULL, -- added, modified or removed
+    lines_added INTEGER,
+    lines_removed INTEGER,
+    UNIQUE(repo_path, node_id, path)
+);
+
+CREATE INDEX changeset_files_path ON changeset_files(path);
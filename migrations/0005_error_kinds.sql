@@ -0,0 +1 @@
+ALTER TABLE errs ADD COLUMN kind CHAR(20); -- error or timeout
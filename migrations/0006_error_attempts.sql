@@ -0,0 +1 @@
+ALTER TABLE errs ADD COLUMN attempt INTEGER;
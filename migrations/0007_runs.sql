@@ -0,0 +1,15 @@
+CREATE TABLE runs(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    started_at CHAR(100) NOT NULL,
+    ended_at CHAR(100),
+    flags TEXT,
+    host CHAR(255),
+    version CHAR(100),
+    repos_attempted INTEGER,
+    repos_succeeded INTEGER,
+    repos_failed INTEGER,
+    rows_inserted INTEGER
+);
+
+ALTER TABLE logs ADD COLUMN run_id INTEGER REFERENCES runs(id);
+ALTER TABLE errs ADD COLUMN run_id INTEGER REFERENCES runs(id);
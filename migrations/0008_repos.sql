@@ -0,0 +1,11 @@
+CREATE TABLE repos(
+    repo_path CHAR(255) PRIMARY KEY,
+    last_attempted CHAR(100),
+    last_success CHAR(100),
+    last_error TEXT,
+    last_error_ts CHAR(100),
+    tip_rev CHAR(100),
+    tip_node CHAR(100),
+    changesets INTEGER,
+    duration_ms INTEGER -- of the last finished collection, retries included
+);
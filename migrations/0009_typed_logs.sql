@@ -0,0 +1,26 @@
+-- typed copies of logs columns, backfilled from the string columns which are
+-- kept for compatibility
+ALTER TABLE logs ADD COLUMN ts_epoch BIGINT; -- seconds since the Unix epoch, UTC
+ALTER TABLE logs ADD COLUMN ts_offset INTEGER; -- of the commit's timezone, seconds east of UTC
+ALTER TABLE logs ADD COLUMN rev INTEGER;
+ALTER TABLE logs ADD COLUMN files_changed INTEGER;
+ALTER TABLE logs ADD COLUMN lines_added INTEGER;
+ALTER TABLE logs ADD COLUMN lines_removed INTEGER;
+
+UPDATE logs SET rev = CAST(rev_id AS INTEGER);
+
+-- ts is like 2022-06-10 23:43:47 +0000
+UPDATE logs SET ts_offset = (CASE substr(ts, 21, 1) WHEN '-' THEN -1 ELSE 1 END) *
+    (CAST(substr(ts, 22, 2) AS INTEGER) * 3600 + CAST(substr(ts, 24, 2) AS INTEGER) * 60)
+WHERE ts LIKE '____-__-__ __:__:__ _____';
+UPDATE logs SET ts_epoch = CAST(strftime('%s', substr(ts, 1, 19)) AS BIGINT) - ts_offset
+WHERE ts_offset IS NOT NULL;
+
+-- diffstat is like 1: +1/-0
+UPDATE logs SET
+    files_changed = CAST(substr(diffstat, 1, instr(diffstat, ':') - 1) AS INTEGER),
+    lines_added = CAST(substr(diffstat, instr(diffstat, '+') + 1, instr(diffstat, '/') - instr(diffstat, '+') - 1) AS INTEGER),
+    lines_removed = CAST(substr(diffstat, instr(diffstat, '/-') + 2) AS INTEGER)
+WHERE diffstat LIKE '%: +%/-%';
+
+CREATE INDEX logs_repo_rev ON logs (repo_path, rev);
@@ -0,0 +1,33 @@
+CREATE TABLE changeset_parents(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    repo_path CHAR(255) NOT NULL,
+    node_id CHAR(100) NOT NULL,
+    parent_index INTEGER NOT NULL, -- 1 for the first parent, 2 for the second of a merge
+    parent_node CHAR(100) NOT NULL,
+    UNIQUE(repo_path, node_id, parent_index)
+);
+
+CREATE INDEX changeset_parents_parent ON changeset_parents(repo_path, parent_node);
+
+-- backfill from the revs of existing logs, the casts guarded for databases
+-- that evaluate joins before filtering. parent_ids is empty when the only
+-- parent is the previous rev and otherwise like 12:3c4d5e6f7a8b 14:...
+INSERT INTO changeset_parents (repo_path, node_id, parent_index, parent_node)
+SELECT c.repo_path, c.node_id, 1, p.node_id
+FROM logs c JOIN logs p ON p.repo_path = c.repo_path AND p.rev = c.rev - 1
+WHERE c.parent_ids = '' AND c.rev > 0;
+
+INSERT INTO changeset_parents (repo_path, node_id, parent_index, parent_node)
+SELECT c.repo_path, c.node_id, 1, p.node_id
+FROM logs c JOIN logs p ON p.repo_path = c.repo_path
+    AND p.rev = CASE WHEN c.parent_ids LIKE '%:%'
+        THEN CAST(substr(c.parent_ids, 1, instr(c.parent_ids, ':') - 1) AS INTEGER) END
+WHERE c.parent_ids LIKE '%:%';
+
+INSERT INTO changeset_parents (repo_path, node_id, parent_index, parent_node)
+SELECT c.repo_path, c.node_id, 2, p.node_id
+FROM logs c JOIN logs p ON p.repo_path = c.repo_path
+    AND p.rev = CASE WHEN c.parent_ids LIKE '%:% %:%'
+        THEN CAST(substr(c.parent_ids, instr(c.parent_ids, ' ') + 1,
+            instr(substr(c.parent_ids, instr(c.parent_ids, ' ') + 1), ':') - 1) AS INTEGER) END
+WHERE c.parent_ids LIKE '%:% %:%';
@@ -0,0 +1,27 @@
+-- author split into its name and email, author is like Name <email>
+ALTER TABLE logs ADD COLUMN author_name CHAR(255);
+ALTER TABLE logs ADD COLUMN author_email CHAR(255);
+
+UPDATE logs SET
+    author_name = CASE WHEN author LIKE '%<%>'
+        THEN trim(substr(author, 1, instr(author, '<') - 1)) ELSE trim(coalesce(author, '')) END,
+    author_email = CASE WHEN author LIKE '%<%>'
+        THEN substr(author, instr(author, '<') + 1, length(author) - instr(author, '<') - 1) ELSE '' END;
+
+CREATE INDEX logs_author ON logs (author_email, author_name);
+
+-- each identity authors are seen under, with the canonical identity an alias
+-- mapping merges it into, or the identity itself if unmapped
+CREATE TABLE authors(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name CHAR(255) NOT NULL,
+    email CHAR(255) NOT NULL,
+    canonical_name CHAR(255) NOT NULL,
+    canonical_email CHAR(255) NOT NULL,
+    UNIQUE(name, email)
+);
+
+CREATE INDEX authors_canonical ON authors (canonical_email, canonical_name);
+
+INSERT INTO authors (name, email, canonical_name, canonical_email)
+SELECT DISTINCT author_name, author_email, author_name, author_email FROM logs;
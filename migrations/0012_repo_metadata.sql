@@ -0,0 +1,11 @@
+-- metadata of repos given by a manifest, e.g. their team, with a row per
+-- value of names with many, e.g. tags
+CREATE TABLE repo_metadata(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    repo_path CHAR(255) NOT NULL,
+    name CHAR(255) NOT NULL,
+    value TEXT NOT NULL,
+    UNIQUE(repo_path, name, value)
+);
+
+CREATE INDEX repo_metadata_name ON repo_metadata (name, value);
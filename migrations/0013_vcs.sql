@@ -0,0 +1,5 @@
+-- version control system each changeset was collected from, hg or git, all
+-- collected before this being hg
+ALTER TABLE logs ADD COLUMN vcs CHAR(8) NOT NULL DEFAULT 'hg';
+
+CREATE INDEX logs_vcs ON logs (vcs);
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+//// Remote repos mirrored to a local cache
+
+// MirrorQueryer is a LogQueryer of remote repos given by URL, such as those
+// served by hgweb. Each is cloned to a mirror in Dir when first seen and
+// pulled into it once per run after that, with logs then queried from the
+// mirror by the wrapped LogQueryer. Repos given by a local path are queried
+// directly.
+//
+// Mirrors are cloned and pulled with hg whatever the wrapped LogQueryer, so
+// hg must be installed even when logs are read natively. Mirrors only ever
+// gain changesets, so history rewritten on the server is not detected as it
+// is for local repos.
+type MirrorQueryer struct {
+	LogQueryer
+	Dir string
+
+	mu     sync.Mutex
+	synced map[string]bool // URLs pulled this run
+
+	// run runs hg, replaced in tests
+	run func(ctx context.Context, args ...string) (string, error)
+}
+
+// PullError is a failure to clone or pull the mirror of a remote repo, as
+// opposed to one querying logs from the mirror.
+type PullError struct {
+	URL string
+	Err error
+}
+
+func (e *PullError) Error() string {
+	return fmt.Sprintf("%v - pulling mirror of %v", e.Err, e.URL)
+}
+
+func (e *PullError) Unwrap() error { return e.Err }
+
+// NewMirrorQueryer mirrors remote repos to dir, creating it if needed.
+func NewMirrorQueryer(lq LogQueryer, dir string) (*MirrorQueryer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &MirrorQueryer{
+		LogQueryer: lq,
+		Dir:        dir,
+		synced:     map[string]bool{},
+		run:        NewProc().run,
+	}, nil
+}
+
+func (mq *MirrorQueryer) QueryLogs(ctx context.Context, repo string, since Tip) (io.ReadCloser, error) {
+	dir, err := mq.mirror(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	return mq.LogQueryer.QueryLogs(ctx, dir, since)
+}
+
+func (mq *MirrorQueryer) LookupRev(ctx context.Context, repo, node string) (int, bool, error) {
+	dir, err := mq.mirror(ctx, repo)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return mq.LogQueryer.LookupRev(ctx, dir, node)
+}
+
+// mirror returns the directory to query for a repo, syncing the mirror of a
+// remote repo first unless it already was this run.
+func (mq *MirrorQueryer) mirror(ctx context.Context, repo string) (string, error) {
+	if !isRemote(repo) {
+		return repo, nil
+	}
+	dir := filepath.Join(mq.Dir, mirrorName(repo))
+
+	mq.mu.Lock()
+	synced := mq.synced[repo]
+	mq.mu.Unlock()
+	if synced {
+		return dir, nil
+	}
+
+	if err := mq.sync(ctx, repo, dir); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", &PullError{URL: repo, Err: err}
+	}
+
+	mq.mu.Lock()
+	mq.synced[repo] = true
+	mq.mu.Unlock()
+
+	return dir, nil
+}
+
+// sync pulls into the mirror of a repo, or clones it under a partial name
+// renamed into place once complete, so an interrupted clone is started over
+// rather than pulled into.
+func (mq *MirrorQueryer) sync(ctx context.Context, repo, dir string) error {
+	if isRepo(dir) {
+		Log.Debugf("pulling mirror %#v of: %v", dir, repo)
+		_, err := mq.run(ctx, "pull", "--repository", dir, "--", repo)
+		return err
+	}
+
+	Log.Infof("cloning mirror %#v of: %v", dir, repo)
+	partial := dir + partialExt
+	if err := os.RemoveAll(partial); err != nil {
+		return err
+	}
+	if _, err := mq.run(ctx, "clone", "--noupdate", "--", repo, partial); err != nil {
+		return err
+	}
+
+	return os.Rename(partial, dir)
+}
+
+// isRemote reports whether a repo is given by URL rather than local path.
+func isRemote(repo string) bool {
+	u, err := url.Parse(repo)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+// mirrorName names the mirror of a repo URL by its host and path, made safe
+// for a file name, and a hash of the whole URL so none share a mirror.
+func mirrorName(repo string) string {
+	name := repo
+	if u, err := url.Parse(repo); err == nil {
+		name = u.Host + u.Path
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, strings.Trim(name, "/"))
+	sum := sha256.Sum256([]byte(repo))
+
+	return name + "-" + hex.EncodeToString(sum[:6])
+}
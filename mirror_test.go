@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testRemote = "http://hg.example.com/team/web"
+
+// mockMirrorQry records the repos it is queried for, giving the logs of the
+// test repo for all of them.
+type mockMirrorQry struct {
+	mu      sync.Mutex
+	queried []string
+	log     string
+}
+
+func (m *mockMirrorQry) QueryLogs(ctx context.Context, repo string, since Tip) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queried = append(m.queried, repo)
+
+	return io.NopCloser(strings.NewReader(m.log)), nil
+}
+
+func (m *mockMirrorQry) LookupRev(ctx context.Context, repo, node string) (int, bool, error) {
+	return 0, true, nil
+}
+
+// mockHg stands in for hg, cloning by creating an empty repo and failing
+// with err if set.
+type mockHg struct {
+	calls [][]string
+	err   error
+}
+
+func (m *mockHg) run(ctx context.Context, args ...string) (string, error) {
+	m.calls = append(m.calls, args)
+	if m.err != nil {
+		return "", m.err
+	}
+	if args[0] == "clone" {
+		dest := args[len(args)-1]
+		if err := os.MkdirAll(filepath.Join(dest, ".hg"), 0o755); err != nil {
+			return "", err
+		}
+		return "", os.WriteFile(filepath.Join(dest, ".hg", "requires"), nil, 0o644)
+	}
+
+	return "", nil
+}
+
+func newTestMirror(t *testing.T, dir string, hg *mockHg, qry *mockMirrorQry) *MirrorQueryer {
+	t.Helper()
+	mq, err := NewMirrorQueryer(qry, dir)
+	if err != nil {
+		t.Fatalf("unexpected mirror error: %v", err)
+	}
+	mq.run = hg.run
+
+	return mq
+}
+
+func TestMirrorQueryer(t *testing.T) {
+	t.Run("can clone a remote repo when first seen", func(t *testing.T) {
+		dir := t.TempDir()
+		hg, qry := &mockHg{}, &mockMirrorQry{log: testRepoLog}
+		dr := NewDataReader(newTestMirror(t, dir, hg, qry))
+		mirror := filepath.Join(dir, mirrorName(testRemote))
+
+		// SUT
+		res, err := dr.Obtain(context.Background(), testRemote, Tip{})
+
+		assert(t, err, nil)
+		assert(t, res.Repo, testRemote)
+		assert(t, len(res.LogRecs), 1)
+		assert(t, res.LogRecs[0].RepoPath, testRemote)
+		assertDeep(t, hg.calls, [][]string{{"clone", "--noupdate", "--", testRemote, mirror + partialExt}})
+		assertDeep(t, qry.queried, []string{mirror})
+		assert(t, isRepo(mirror), true)
+	})
+
+	t.Run("can pull a mirror once per run", func(t *testing.T) {
+		dir := t.TempDir()
+		qry := &mockMirrorQry{log: testRepoLog}
+		first := newTestMirror(t, dir, &mockHg{}, qry)
+		if _, err := NewDataReader(first).Obtain(context.Background(), testRemote, Tip{}); err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+		hg := &mockHg{}
+		dr := NewDataReader(newTestMirror(t, dir, hg, qry))
+		mirror := filepath.Join(dir, mirrorName(testRemote))
+
+		// SUT
+		for i := 0; i < 2; i++ {
+			_, err := dr.Obtain(context.Background(), testRemote, testLogRecordTip())
+			assert(t, err, nil)
+		}
+
+		assertDeep(t, hg.calls, [][]string{{"pull", "--repository", mirror, "--", testRemote}})
+	})
+
+	t.Run("can query local repos directly", func(t *testing.T) {
+		hg, qry := &mockHg{}, &mockMirrorQry{log: testRepoLog}
+		dr := NewDataReader(newTestMirror(t, t.TempDir(), hg, qry))
+
+		// SUT
+		_, err := dr.Obtain(context.Background(), testRepo, Tip{})
+
+		assert(t, err, nil)
+		assert(t, len(hg.calls), 0)
+		assertDeep(t, qry.queried, []string{testRepo})
+	})
+
+	t.Run("can report pull failures apart from parse failures", func(t *testing.T) {
+		dir := t.TempDir()
+		hg := &mockHg{err: errors.New("abort: HTTP Error 503: Service Unavailable")}
+		dr := NewDataReader(newTestMirror(t, dir, hg, &mockMirrorQry{log: testRepoLog}))
+		garbled := NewDataReader(newTestMirror(t, dir, &mockHg{}, &mockMirrorQry{log: "{not json"}))
+
+		// SUT
+		res, err := dr.Obtain(context.Background(), testRemote, Tip{})
+		assert(t, err, nil)
+		_, statErr := os.Stat(filepath.Join(dir, mirrorName(testRemote)))
+		gres, err := garbled.Obtain(context.Background(), testRemote, Tip{})
+		assert(t, err, nil)
+
+		assert(t, len(res.ErrEvents), 1)
+		var pe *PullError
+		assert(t, errors.As(res.ErrEvents[0].Err, &pe), true)
+		assert(t, pe.URL, testRemote)
+		assert(t, res.ErrEvents[0].Kind, ErrKindPull)
+		assert(t, isTransient(res.ErrEvents[0].Err), true)
+		assert(t, os.IsNotExist(statErr), true)
+		assert(t, len(gres.ErrEvents), 1)
+		assert(t, gres.ErrEvents[0].Kind, ErrKindError)
+	})
+
+	t.Run("can name mirrors apart", func(t *testing.T) {
+		// SUT
+		got := []string{
+			mirrorName("https://hg.example.com/team/web"),
+			mirrorName("https://hg.example.com/team/web/"),
+			mirrorName("https://hg.example.com:8000/team/web?style=raw"),
+		}
+
+		assert(t, strings.HasPrefix(got[0], "hg.example.com_team_web-"), true)
+		assert(t, strings.HasPrefix(got[2], "hg.example.com_8000_team_web-"), true)
+		if got[0] == got[1] || got[0] == got[2] {
+			t.Errorf("got mirror names sharing a mirror: %v", got)
+		}
+	})
+
+	t.Run("can collect from hg serve", func(t *testing.T) {
+		if _, err := exec.LookPath("hg"); err != nil {
+			t.Skip("hg not installed")
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected listen error: %v", err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		srv := exec.CommandContext(ctx, "hg", "serve", "--repository", testRepo,
+			"--address", "127.0.0.1", "--port", fmt.Sprint(port))
+		if err := srv.Start(); err != nil {
+			t.Fatalf("unexpected hg serve error: %v", err)
+		}
+		defer srv.Wait()
+		url := fmt.Sprintf("http://127.0.0.1:%v/", port)
+		for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+			resp, err := http.Get(url)
+			if err == nil {
+				resp.Body.Close()
+				break
+			}
+			if time.Since(start) > 10*time.Second {
+				t.Fatalf("hg serve not up: %v", err)
+			}
+		}
+		mq, err := NewMirrorQueryer(NewProc(), t.TempDir())
+		if err != nil {
+			t.Fatalf("unexpected mirror error: %v", err)
+		}
+
+		// SUT
+		res, err := NewDataReader(mq).Obtain(context.Background(), url, Tip{})
+
+		assert(t, err, nil)
+		assert(t, len(res.ErrEvents), 0)
+		assert(t, len(res.LogRecs), 1)
+		assert(t, res.LogRecs[0].NodeID, testLogRecord.NodeID)
+	})
+}
+
+// testLogRecordTip is the tip of the test repo once collected.
+func testLogRecordTip() Tip {
+	return Tip{Rev: 0, Node: testLogRecord.NodeID}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+//// Native Parquet writing
+
+// parquetWriter writes flat row structs of string and int64 fields as a
+// Parquet file of required columns, named by their json tags. Rows are
+// buffered into row groups of about parquetRowGroupSize, each column of a
+// group written as a single Snappy compressed data page of PLAIN values.
+type parquetWriter struct {
+	w      io.Writer
+	offset int64 // bytes written so far
+
+	cols   []parquetColumn
+	rows   int64 // rows buffered for the next row group
+	size   int   // bytes buffered for the next row group
+	groups []parquetRowGroup
+}
+
+// parquetRowGroupSize bounds the bytes of rows buffered in memory for each
+// table before they are written out as a row group.
+const parquetRowGroupSize = 16 * 1024 * 1024
+
+const parquetMagic = "PAR1"
+
+type parquetColumn struct {
+	name string
+	typ  int32 // parquet physical type
+	utf8 bool
+	buf  []byte // PLAIN encoded values of the buffered rows
+}
+
+type parquetRowGroup struct {
+	rows   int64
+	size   int64 // uncompressed size of all its column chunks
+	chunks []parquetChunk
+}
+
+type parquetChunk struct {
+	offset       int64 // of the data page
+	uncompressed int64
+	compressed   int64
+}
+
+// Parquet enum values, as in the format's thrift definitions.
+const (
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetRequired = 0
+	parquetUTF8     = 0
+	parquetPlain    = 0
+	parquetRLE      = 3
+	parquetSnappy   = 1
+	parquetDataPage = 0
+)
+
+func newParquetWriter(w io.Writer, row interface{}) (rowWriter, error) {
+	pw := &parquetWriter{w: w}
+
+	t := reflect.TypeOf(row).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		col := parquetColumn{name: f.Tag.Get("json")}
+		switch f.Type.Kind() {
+		case reflect.String:
+			col.typ, col.utf8 = parquetByteArray, true
+		case reflect.Int64:
+			col.typ = parquetInt64
+		default:
+			return nil, fmt.Errorf("unsupported parquet column type: %v", f.Type)
+		}
+		pw.cols = append(pw.cols, col)
+	}
+
+	return pw, pw.write([]byte(parquetMagic))
+}
+
+func (pw *parquetWriter) Write(row interface{}) error {
+	v := reflect.ValueOf(row).Elem()
+	for i := range pw.cols {
+		col := &pw.cols[i]
+		n := len(col.buf)
+		switch col.typ {
+		case parquetByteArray:
+			s := v.Field(i).String()
+			col.buf = appendUint32(col.buf, uint32(len(s)))
+			col.buf = append(col.buf, s...)
+		case parquetInt64:
+			col.buf = appendUint64(col.buf, uint64(v.Field(i).Int()))
+		}
+		pw.size += len(col.buf) - n
+	}
+	pw.rows++
+
+	if pw.size >= parquetRowGroupSize {
+		return pw.flush()
+	}
+
+	return nil
+}
+
+// Close writes any buffered rows and the file footer.
+func (pw *parquetWriter) Close() error {
+	if err := pw.flush(); err != nil {
+		return err
+	}
+
+	meta := pw.footer()
+	if err := pw.write(meta); err != nil {
+		return err
+	}
+
+	return pw.write(append(appendUint32(nil, uint32(len(meta))), parquetMagic...))
+}
+
+// flush writes the buffered rows as a row group.
+func (pw *parquetWriter) flush() error {
+	if pw.rows == 0 {
+		return nil
+	}
+
+	rg := parquetRowGroup{rows: pw.rows}
+	for i := range pw.cols {
+		col := &pw.cols[i]
+		data := snappy.Encode(nil, col.buf)
+
+		var tw thriftWriter
+		tw.begin() // PageHeader
+		tw.i32(1, parquetDataPage)
+		tw.i32(2, int32(len(col.buf)))
+		tw.i32(3, int32(len(data)))
+		tw.structField(5) // DataPageHeader
+		tw.i32(1, int32(pw.rows))
+		tw.i32(2, parquetPlain)
+		tw.i32(3, parquetRLE)
+		tw.i32(4, parquetRLE)
+		tw.end()
+		tw.end()
+
+		chunk := parquetChunk{
+			offset:       pw.offset,
+			uncompressed: int64(len(tw.buf) + len(col.buf)),
+			compressed:   int64(len(tw.buf) + len(data)),
+		}
+		if err := pw.write(tw.buf); err != nil {
+			return err
+		}
+		if err := pw.write(data); err != nil {
+			return err
+		}
+		rg.chunks = append(rg.chunks, chunk)
+		rg.size += chunk.uncompressed
+		col.buf = col.buf[:0]
+	}
+	pw.groups = append(pw.groups, rg)
+	pw.rows, pw.size = 0, 0
+
+	return nil
+}
+
+// footer encodes the FileMetaData of the row groups written.
+func (pw *parquetWriter) footer() []byte {
+	var rows int64
+	for _, rg := range pw.groups {
+		rows += rg.rows
+	}
+
+	var tw thriftWriter
+	tw.begin() // FileMetaData
+	tw.i32(1, 1)
+	tw.list(2, thriftStruct, len(pw.cols)+1)
+	tw.begin() // root SchemaElement
+	tw.binary(4, "schema")
+	tw.i32(5, int32(len(pw.cols)))
+	tw.end()
+	for _, col := range pw.cols {
+		tw.begin()
+		tw.i32(1, col.typ)
+		tw.i32(3, parquetRequired)
+		tw.binary(4, col.name)
+		if col.utf8 {
+			tw.i32(6, parquetUTF8)
+		}
+		tw.end()
+	}
+	tw.i64(3, rows)
+	tw.list(4, thriftStruct, len(pw.groups))
+	for _, rg := range pw.groups {
+		tw.begin() // RowGroup
+		tw.list(1, thriftStruct, len(rg.chunks))
+		for i, ch := range rg.chunks {
+			tw.begin() // ColumnChunk
+			tw.i64(2, ch.offset)
+			tw.structField(3) // ColumnMetaData
+			tw.i32(1, pw.cols[i].typ)
+			tw.list(2, thriftI32, 1)
+			tw.varint(parquetPlain)
+			tw.list(3, thriftBinary, 1)
+			tw.str(pw.cols[i].name)
+			tw.i32(4, parquetSnappy)
+			tw.i64(5, rg.rows)
+			tw.i64(6, ch.uncompressed)
+			tw.i64(7, ch.compressed)
+			tw.i64(9, ch.offset)
+			tw.end()
+			tw.end()
+		}
+		tw.i64(2, rg.size)
+		tw.i64(3, rg.rows)
+		tw.end()
+	}
+	tw.binary(6, "merc-log-collect")
+	tw.end()
+
+	return tw.buf
+}
+
+func (pw *parquetWriter) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.offset += int64(n)
+	return err
+}
+
+// thriftWriter encodes the structs of Parquet metadata with the thrift
+// compact protocol.
+type thriftWriter struct {
+	buf  []byte
+	last []int16 // last field id of each struct being written
+}
+
+// thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// begin starts a struct, either at the top level or as a list element.
+func (tw *thriftWriter) begin() {
+	tw.last = append(tw.last, 0)
+}
+
+func (tw *thriftWriter) end() {
+	tw.buf = append(tw.buf, 0)
+	tw.last = tw.last[:len(tw.last)-1]
+}
+
+func (tw *thriftWriter) field(id int16, typ byte) {
+	last := &tw.last[len(tw.last)-1]
+	if d := id - *last; d > 0 && d <= 15 {
+		tw.buf = append(tw.buf, byte(d)<<4|typ)
+	} else {
+		tw.buf = append(tw.buf, typ)
+		tw.varint(int64(id))
+	}
+	*last = id
+}
+
+// varint appends a zigzag encoded integer, as the values of i16, i32 and
+// i64 fields and list elements are.
+func (tw *thriftWriter) varint(v int64) {
+	tw.buf = appendUvarint(tw.buf, uint64(v<<1^v>>63))
+}
+
+func (tw *thriftWriter) str(s string) {
+	tw.buf = appendUvarint(tw.buf, uint64(len(s)))
+	tw.buf = append(tw.buf, s...)
+}
+
+func (tw *thriftWriter) i32(id int16, v int32) {
+	tw.field(id, thriftI32)
+	tw.varint(int64(v))
+}
+
+func (tw *thriftWriter) i64(id int16, v int64) {
+	tw.field(id, thriftI64)
+	tw.varint(v)
+}
+
+func (tw *thriftWriter) binary(id int16, s string) {
+	tw.field(id, thriftBinary)
+	tw.str(s)
+}
+
+// list starts a list field of n elements, which are written next.
+func (tw *thriftWriter) list(id int16, elem byte, n int) {
+	tw.field(id, thriftList)
+	if n < 15 {
+		tw.buf = append(tw.buf, byte(n)<<4|elem)
+		return
+	}
+	tw.buf = append(tw.buf, 0xf0|elem)
+	tw.buf = appendUvarint(tw.buf, uint64(n))
+}
+
+// structField starts a struct field, ended like any struct.
+func (tw *thriftWriter) structField(id int16) {
+	tw.field(id, thriftStruct)
+	tw.begin()
+}
+
+// append helpers of encoding/binary, which only has them from Go 1.19
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var vb [binary.MaxVarintLen64]byte
+	return append(b, vb[:binary.PutUvarint(vb[:], v)]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var vb [4]byte
+	binary.LittleEndian.PutUint32(vb[:], v)
+	return append(b, vb[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var vb [8]byte
+	binary.LittleEndian.PutUint64(vb[:], v)
+	return append(b, vb[:]...)
+}
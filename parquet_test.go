@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+func TestParquetWriter(t *testing.T) {
+	rows := []fileRow{
+		{RepoPath: testRepo, NodeID: "71efee29", Path: "hi.txt", Action: "added", LinesAdded: 1},
+		{RepoPath: testRepo, NodeID: "d3adb33f", Path: "a/b,c \"d\".txt", Action: "modified", LinesAdded: 20, LinesRemoved: 300},
+		{RepoPath: testRepo, NodeID: "d3adb33f", Path: "ünïcode", Action: "removed", LinesRemoved: -1},
+	}
+
+	t.Run("can write rows readable by their metadata", func(t *testing.T) {
+		var buf bytes.Buffer
+		pw, err := newParquetWriter(&buf, &fileRow{})
+		if err != nil {
+			t.Fatalf("unexpected writer error: %v", err)
+		}
+
+		// SUT
+		for i := range rows {
+			err := pw.Write(&rows[i])
+			assert(t, err, nil)
+		}
+		err = pw.Close()
+		assert(t, err, nil)
+
+		names, cols := readParquet(t, buf.Bytes(), int64(len(rows)))
+		assertDeep(t, names, []string{"repo_path", "node_id", "path", "action", "lines_added", "lines_removed"})
+		var want [6][]interface{}
+		for _, r := range rows {
+			for i, v := range []interface{}{r.RepoPath, r.NodeID, r.Path, r.Action, r.LinesAdded, r.LinesRemoved} {
+				want[i] = append(want[i], v)
+			}
+		}
+		assertDeep(t, cols, want[:])
+	})
+
+	t.Run("can write a table without rows", func(t *testing.T) {
+		var buf bytes.Buffer
+		pw, err := newParquetWriter(&buf, &errRow{})
+		if err != nil {
+			t.Fatalf("unexpected writer error: %v", err)
+		}
+
+		// SUT
+		err = pw.Close()
+
+		assert(t, err, nil)
+		names, _ := readParquet(t, buf.Bytes(), 0)
+		assertDeep(t, names, []string{"ts", "err", "repo_path", "kind", "attempt"})
+	})
+
+	t.Run("can write a file store table", func(t *testing.T) {
+		dir := t.TempDir()
+		fs, err := NewFileStore(dir, "parquet")
+		if err != nil {
+			t.Fatalf("unexpected file store error: %v", err)
+		}
+
+		// SUT
+		err = fs.Persist(context.Background(), Results{Repo: testRepo, LogRecs: []LogRecord{testLogRecord}})
+		assert(t, err, nil)
+		err = fs.Close()
+		assert(t, err, nil)
+
+		b, err := os.ReadFile(filepath.Join(dir, "logs.parquet"))
+		if err != nil {
+			t.Fatalf("unexpected read error: %v", err)
+		}
+		_, cols := readParquet(t, b, 1)
+		assertDeep(t, cols[1], []interface{}{testLogRecord.NodeID})
+	})
+}
+
+// readParquet checks the framing and row count of a Parquet file as written
+// by parquetWriter, returning its column names and values.
+func readParquet(t *testing.T, b []byte, wantRows int64) ([]string, [][]interface{}) {
+	t.Helper()
+	if !bytes.HasPrefix(b, []byte(parquetMagic)) || !bytes.HasSuffix(b, []byte(parquetMagic)) {
+		t.Fatalf("missing parquet magic")
+	}
+	n := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	meta := (&thriftReader{b: b[len(b)-8-n : len(b)-8]}).strct()
+	assert(t, meta[3], wantRows)
+
+	var names []string
+	for _, se := range meta[2].([]interface{})[1:] {
+		names = append(names, se.(map[int16]interface{})[4].(string))
+	}
+
+	cols := make([][]interface{}, len(names))
+	for _, rg := range meta[4].([]interface{}) {
+		for i, cc := range rg.(map[int16]interface{})[1].([]interface{}) {
+			cm := cc.(map[int16]interface{})[3].(map[int16]interface{})
+			tr := &thriftReader{b: b[cm[9].(int64):]}
+			ph := tr.strct()
+			vals, err := snappy.Decode(nil, tr.b[:ph[3].(int64)])
+			if err != nil {
+				t.Fatalf("unexpected page decompression error: %v", err)
+			}
+			assert(t, int64(len(vals)), ph[2])
+
+			for len(vals) > 0 {
+				switch cm[1] {
+				case int64(parquetByteArray):
+					l := binary.LittleEndian.Uint32(vals)
+					cols[i] = append(cols[i], string(vals[4:4+l]))
+					vals = vals[4+l:]
+				case int64(parquetInt64):
+					cols[i] = append(cols[i], int64(binary.LittleEndian.Uint64(vals)))
+					vals = vals[8:]
+				default:
+					t.Fatalf("unexpected column type: %v", cm[1])
+				}
+			}
+		}
+	}
+
+	return names, cols
+}
+
+// thriftReader decodes thrift compact structs as maps by field id, with
+// integers as int64, binaries as strings and lists as slices.
+type thriftReader struct {
+	b []byte
+}
+
+func (tr *thriftReader) byte() byte {
+	v := tr.b[0]
+	tr.b = tr.b[1:]
+	return v
+}
+
+func (tr *thriftReader) varint() int64 {
+	u, n := binary.Uvarint(tr.b)
+	tr.b = tr.b[n:]
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+func (tr *thriftReader) strct() map[int16]interface{} {
+	m := map[int16]interface{}{}
+	var id int16
+	for {
+		h := tr.byte()
+		if h == 0 {
+			return m
+		}
+		if d := h >> 4; d != 0 {
+			id += int16(d)
+		} else {
+			id = int16(tr.varint())
+		}
+		m[id] = tr.value(h & 0xf)
+	}
+}
+
+func (tr *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftI32, thriftI64:
+		return tr.varint()
+	case thriftBinary:
+		n, l := binary.Uvarint(tr.b)
+		s := string(tr.b[l : l+int(n)])
+		tr.b = tr.b[l+int(n):]
+		return s
+	case thriftList:
+		h := tr.byte()
+		n := int(h >> 4)
+		if n == 15 {
+			u, l := binary.Uvarint(tr.b)
+			n, tr.b = int(u), tr.b[l:]
+		}
+		vs := make([]interface{}, n)
+		for i := range vs {
+			vs[i] = tr.value(h & 0xf)
+		}
+		return vs
+	case thriftStruct:
+		return tr.strct()
+	}
+	panic("unexpected thrift type")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// testPostgresDSNEnv names the environment variable with a DSN of a local
+// Postgres instance to test against, such as one started by
+// `make test-postgres`. Postgres tests are skipped without it.
+const testPostgresDSNEnv = "MERC_TEST_POSTGRES_DSN"
+
+// openTestPostgres opens a Postgres database with all migrations applied in
+// a schema of its own, which is dropped when the test ends.
+func openTestPostgres(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv(testPostgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%v not set", testPostgresDSNEnv)
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("unexpected database open error: %v", err)
+	}
+	db.SetMaxOpenConns(1) // keep the search_path of the only connection
+
+	schema := fmt.Sprintf("merc_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatalf("unexpected schema error: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+		db.Close()
+	})
+	if _, err := db.Exec(`SET search_path TO ` + schema); err != nil {
+		t.Fatalf("unexpected schema error: %v", err)
+	}
+
+	if _, _, err := Migrate(context.Background(), db, postgresDialect); err != nil {
+		t.Fatalf("unexpected migration error: %v", err)
+	}
+
+	return db
+}
+
+func TestPostgresStore(t *testing.T) {
+	t.Run("can migrate and check the schema", func(t *testing.T) {
+		db := openTestPostgres(t)
+
+		// SUT
+		err := CheckSchema(context.Background(), db, postgresDialect)
+
+		assert(t, err, nil)
+		v, legacy, err := schemaVersion(context.Background(), db, postgresDialect)
+		assert(t, err, nil)
+		assert(t, v, len(legacyProbes))
+		assert(t, legacy, false)
+	})
+
+	t.Run("can persist and find the last tip", func(t *testing.T) {
+		db := openTestPostgres(t)
+		st := NewPostgresStore(db)
+		ctx := context.Background()
+		run := &Run{StartedAt: testLogRecord.TS}
+		res := Results{
+			Repo:      testRepo,
+			LogRecs:   []LogRecord{testLogRecord},
+			ErrEvents: []ErrorEvent{testErrEvent},
+			Status:    &RepoStatus{Started: time.Now(), Finished: time.Now()},
+		}
+
+		// SUT
+		err := st.StartRun(ctx, run)
+		assert(t, err, nil)
+		err = st.Persist(ctx, res)
+		assert(t, err, nil)
+		err = st.Persist(ctx, res)
+		assert(t, err, nil)
+		err = st.EndRun(ctx, run)
+		assert(t, err, nil)
+		got, err := st.LastTip(ctx, testRepo)
+		assert(t, err, nil)
+
+		assert(t, got, Tip{Rev: 0, Node: testLogRecord.NodeID})
+		assert(t, run.RowsInserted, 1)
+		var logs, files, changesets int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM logs`).Scan(&logs); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		if err := db.QueryRow(`SELECT COUNT(*) FROM changeset_files`).Scan(&files); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		if err := db.QueryRow(`SELECT changesets FROM repos`).Scan(&changesets); err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+		assert(t, logs, 1)
+		assert(t, files, 1)
+		assert(t, changesets, 1)
+	})
+
+	t.Run("can persist logs in chunks", func(t *testing.T) {
+		db := openTestPostgres(t)
+		st := NewPostgresStore(db)
+		res := Results{Repo: testRepo}
+		for i := 0; i < 6000; i++ {
+			r := testLogRecord
+			r.NodeID = fmt.Sprintf("%040d", i)
+			r.RevID = fmt.Sprint(i)
+			res.LogRecs = append(res.LogRecs, r)
+		}
+
+		// SUT
+		err := st.Persist(context.Background(), res)
+
+		assert(t, err, nil)
+		got, err := st.LastTip(context.Background(), testRepo)
+		assert(t, err, nil)
+		assert(t, got.Rev, 5999)
+	})
+}
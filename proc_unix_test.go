@@ -0,0 +1,38 @@
+//go:build !windows
+
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestKillProcGroup(t *testing.T) {
+	t.Run("can kill spawned children with the process", func(t *testing.T) {
+		// the child keeps stdout open, so Wait returns only once it is killed
+		cmd := exec.Command("sh", "-c", "sleep 60 & sleep 60")
+		setProcGroup(cmd)
+		if _, err := cmd.StdoutPipe(); err != nil {
+			t.Fatalf("unexpected pipe error: %v", err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("unexpected start error: %v", err)
+		}
+
+		// SUT
+		err := killProcGroup(cmd)
+
+		assert(t, err, nil)
+		done := make(chan struct{})
+		go func() {
+			cmd.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("process group still running after kill")
+		}
+	})
+}
@@ -0,0 +1,16 @@
+//go:build windows
+
+package main
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// setProcGroup is a no-op, taskkill finds the process tree by parent.
+func setProcGroup(cmd *exec.Cmd) {}
+
+// killProcGroup kills the process tree of a started cmd.
+func killProcGroup(cmd *exec.Cmd) error {
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+}
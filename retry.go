@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// RetryPolicy is how many times a repo is collected when it has transient
+// errors, waiting with exponential backoff and jitter between attempts.
+type RetryPolicy struct {
+	Attempts int           // total attempts, 1 means no retries
+	Base     time.Duration // wait before the first retry
+	Max      time.Duration // cap on the wait before any retry
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	Attempts: 3,
+	Base:     time.Second,
+	Max:      time.Minute,
+}
+
+// backoff is the wait after an attempt, doubling each time up to Max, with
+// up to half of it replaced by jitter so repos failing together (such as on
+// a shared NFS hiccup) do not all retry at once.
+func (rp RetryPolicy) backoff(attempt int) time.Duration {
+	d := rp.Base
+	for i := 1; i < attempt && (rp.Max <= 0 || d < rp.Max); i++ {
+		d *= 2
+	}
+	if rp.Max > 0 && d > rp.Max {
+		d = rp.Max
+	}
+	if half := int64(d / 2); half > 0 {
+		d = time.Duration(half + rand.Int63n(half+1))
+	}
+
+	return d
+}
+
+// transientErrs are fragments of errors, mostly hg aborts and OS errors on
+// network filesystems or with hg servers, that may not happen again on a
+// later attempt.
+var transientErrs = []string{
+	"repository is locked",
+	"lock held",
+	"waiting for lock",
+	"resource temporarily unavailable",
+	"stale file handle",
+	"stale nfs file handle",
+	"interrupted system call",
+	"connection reset",
+	"connection timed out",
+	"input/output error",
+	"too many open files",
+	"http error 502",
+	"http error 503",
+	"http error 504",
+	"temporary failure in name resolution",
+}
+
+// isTransient reports whether an error is worth retrying. Timeouts are not,
+// a repo that hung once is likely to hang again and would hold up the run.
+func isTransient(err error) bool {
+	if err == nil || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, te := range transientErrs {
+		if strings.Contains(msg, te) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// markAttempt numbers error events with the attempt they happened on,
+// reporting whether any of them are transient.
+func markAttempt(evs []ErrorEvent, attempt int) bool {
+	var transient bool
+	for i := range evs {
+		evs[i].Attempt = attempt
+		transient = transient || isTransient(evs[i].Err)
+	}
+
+	return transient
+}
+
+// sleepCtx waits for d, reporting false if ctx is done first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
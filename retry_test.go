@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("exit status 255 - abort: repository is locked"), true},
+		{errors.New("waiting for lock on repository /r held by process 12"), true},
+		{errors.New("read .hg/store/00changelog.i: resource temporarily unavailable"), true},
+		{errors.New("open .hg/dirstate: Stale NFS file handle"), true},
+		{errors.New("exit status 255 - abort: repository /r not found"), false},
+		{fmt.Errorf("%w - repo not obtained within 1m", context.DeadlineExceeded), false},
+		{errTest, false},
+	}
+	for _, tt := range tests {
+		t.Run("can classify "+tt.err.Error(), func(t *testing.T) {
+			// SUT
+			got := isTransient(tt.err)
+
+			assert(t, got, tt.want)
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	rp := RetryPolicy{Attempts: 5, Base: time.Second, Max: 4 * time.Second}
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{1, 500 * time.Millisecond, time.Second},
+		{2, time.Second, 2 * time.Second},
+		{3, 2 * time.Second, 4 * time.Second},
+		{4, 2 * time.Second, 4 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("can back off after attempt %v", tt.attempt), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				// SUT
+				got := rp.backoff(tt.attempt)
+
+				if got < tt.min || got > tt.max {
+					t.Fatalf("got %v, want between %v and %v", got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestCollectRetry(t *testing.T) {
+	retry := RetryPolicy{Attempts: 3, Base: time.Millisecond, Max: time.Millisecond}
+
+	t.Run("can retry transient errors until collected", func(t *testing.T) {
+		o := DataReader{&mockFlakyQry{fails: 2, err: errors.New("abort: repository is locked")}}
+		p := &mockRecPer{}
+		cs := NewCollSrvc(o, p, 1)
+		cs.Retry = retry
+
+		// SUT
+		failed := cs.collectRetry(context.Background(), testRepo)
+
+		assert(t, failed, false)
+		var attempts []int
+		var recs int
+		for _, res := range p.got {
+			for _, e := range res.ErrEvents {
+				attempts = append(attempts, e.Attempt)
+			}
+			recs += len(res.LogRecs)
+		}
+		assertDeep(t, attempts, []int{1, 2})
+		assert(t, recs, 1)
+	})
+
+	t.Run("can give up after the last attempt", func(t *testing.T) {
+		o := DataReader{&mockFlakyQry{fails: 5, err: errors.New("abort: repository is locked")}}
+		p := &mockRecPer{}
+		cs := NewCollSrvc(o, p, 1)
+		cs.Retry = retry
+
+		// SUT
+		failed := cs.collectRetry(context.Background(), testRepo)
+
+		assert(t, failed, true)
+		assert(t, len(p.got), 4) // each attempt, then the final status
+		assert(t, p.got[2].ErrEvents[0].Attempt, 3)
+	})
+
+	t.Run("can skip retrying permanent errors", func(t *testing.T) {
+		o := DataReader{&mockFlakyQry{fails: 5, err: errTest}}
+		p := &mockRecPer{}
+		cs := NewCollSrvc(o, p, 1)
+		cs.Retry = retry
+		cs.BatchSize = 0
+
+		// SUT
+		failed := cs.collectRetry(context.Background(), testRepo)
+
+		assert(t, failed, true)
+		assert(t, len(p.got), 2) // the attempt, then the final status
+		assert(t, p.got[0].ErrEvents[0].Attempt, 1)
+	})
+}
+
+// mockFlakyQry fails to query logs with err the first fails times.
+type mockFlakyQry struct {
+	mockLogQry
+	mu    sync.Mutex
+	fails int
+	err   error
+}
+
+func (m *mockFlakyQry) QueryLogs(ctx context.Context, repo string, since Tip) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fails > 0 {
+		m.fails--
+		return nil, m.err
+	}
+	return io.NopCloser(strings.NewReader(testRepoLog)), nil
+}
@@ -0,0 +1,1424 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//// Access Mercurial repositories natively, without an hg process
+
+// RevlogReader is a LogQueryer reading the changelog, manifest and filelogs
+// of a repo directly, producing the same output as Proc. Like hg, it skips
+// changesets hidden by obsolescence markers, though without detecting
+// content or phase divergence it may show an unstable one as "o" rather
+// than "*" in the graphnode.
+type RevlogReader struct{}
+
+func NewRevlogReader() RevlogReader {
+	return RevlogReader{}
+}
+
+func (rr RevlogReader) QueryLogs(ctx context.Context, repo string, since Tip) (io.ReadCloser, error) {
+	hr, err := openHgRepo(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	// ascending rev order, matching the revsets queried by Proc
+	var start int
+	if since.Node != "" {
+		start = since.Rev + 1
+	}
+
+	// write entries as they are read, until done or the reader is closed
+	pr, pw := io.Pipe()
+	go func() {
+		defer hr.Close()
+		bw := bufio.NewWriter(pw)
+		for r := start; r < hr.cl.Len(); r++ {
+			if err := ctx.Err(); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if hr.hidden[r] {
+				continue
+			}
+			le, err := hr.logEntry(r)
+			if err != nil {
+				pw.CloseWithError(fmt.Errorf("%w - reading rev %v", err, r))
+				return
+			}
+			if _, err := bw.WriteString(le + "\n"); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(bw.Flush())
+	}()
+
+	return pr, nil
+}
+
+func (rr RevlogReader) LookupRev(ctx context.Context, repo, node string) (int, bool, error) {
+	hr, err := openHgRepo(repo)
+	if err != nil {
+		return 0, false, err
+	}
+	defer hr.Close()
+
+	n, err := hex.DecodeString(node)
+	if err != nil {
+		return 0, false, fmt.Errorf("%w - invalid node: %#v", err, node)
+	}
+	rev, ok := hr.cl.Rev(n)
+	if ok && hr.hidden[rev] {
+		return 0, false, nil
+	}
+
+	return rev, ok, nil
+}
+
+// supportedReqs are the repo requirements understood by the native reader,
+// anything else (treemanifest, revlogv2, etc.) is refused.
+var supportedReqs = map[string]struct{}{
+	"revlogv1":                {},
+	"store":                   {},
+	"fncache":                 {},
+	"dotencode":               {},
+	"generaldelta":            {},
+	"sparserevlog":            {},
+	"share-safe":              {},
+	"shared":                  {},
+	"relshared":               {},
+	"revlog-compression-zstd": {},
+	"persistent-nodemap":      {},
+	"dirstate-v2":             {},
+}
+
+// hgRepo holds the open revlogs of a single repo.
+type hgRepo struct {
+	root      string
+	storePath string
+	reqs      map[string]struct{}
+	cl        *revlog
+	ml        *revlog
+	filelogs  map[string]*revlog
+	wdParents [][]byte
+	tags      map[string][]string // node to sorted tag names
+
+	// by rev, see readVisibility
+	hidden, obsolete, orphan []bool
+}
+
+func openHgRepo(root string) (*hgRepo, error) {
+	hgPath := filepath.Join(root, ".hg")
+	reqs, err := readReqs(filepath.Join(hgPath, "requires"))
+	if err != nil {
+		return nil, err
+	}
+
+	storeBase := hgPath
+	if _, ok := reqs["shared"]; ok {
+		b, err := os.ReadFile(filepath.Join(hgPath, "sharedpath"))
+		if err != nil {
+			return nil, err
+		}
+		storeBase = strings.TrimSpace(string(b))
+	}
+	if _, ok := reqs["relshared"]; ok {
+		b, err := os.ReadFile(filepath.Join(hgPath, "sharedpath"))
+		if err != nil {
+			return nil, err
+		}
+		storeBase = filepath.Join(hgPath, strings.TrimSpace(string(b)))
+	}
+
+	// with share-safe, the store requirements are kept in the store itself
+	if _, ok := reqs["share-safe"]; ok {
+		sreqs, err := readReqs(filepath.Join(storeBase, "store", "requires"))
+		if err != nil {
+			return nil, err
+		}
+		for k := range sreqs {
+			reqs[k] = struct{}{}
+		}
+	}
+	storePath := storeBase
+	if _, ok := reqs["store"]; ok {
+		storePath = filepath.Join(storeBase, "store")
+	}
+	for r := range reqs {
+		if _, ok := supportedReqs[r]; !ok {
+			return nil, fmt.Errorf("unsupported repo requirement %#v: %v", r, root)
+		}
+	}
+
+	hr := &hgRepo{
+		root:      root,
+		storePath: storePath,
+		reqs:      reqs,
+		filelogs:  map[string]*revlog{},
+	}
+	if hr.cl, err = openRevlog(filepath.Join(storePath, "00changelog.i")); err != nil {
+		return nil, err
+	}
+	if hr.ml, err = openRevlog(filepath.Join(storePath, "00manifest.i")); err != nil {
+		hr.Close()
+		return nil, err
+	}
+	if hr.wdParents, err = readDirstateParents(filepath.Join(hgPath, "dirstate")); err != nil {
+		hr.Close()
+		return nil, err
+	}
+	if err := hr.readVisibility(); err != nil {
+		hr.Close()
+		return nil, err
+	}
+	if err := hr.readTags(); err != nil {
+		hr.Close()
+		return nil, err
+	}
+
+	return hr, nil
+}
+
+func (hr *hgRepo) Close() {
+	for _, rl := range []*revlog{hr.cl, hr.ml} {
+		if rl != nil {
+			rl.Close()
+		}
+	}
+	for _, rl := range hr.filelogs {
+		rl.Close()
+	}
+}
+
+func readReqs(path string) (map[string]struct{}, error) {
+	reqs := map[string]struct{}{}
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist): // very old repos have no requires
+		return reqs, nil
+	case err != nil:
+		return nil, err
+	}
+	for _, r := range strings.Split(string(b), "\n") {
+		if r = strings.TrimSpace(r); r != "" {
+			reqs[r] = struct{}{}
+		}
+	}
+
+	return reqs, nil
+}
+
+// readDirstateParents returns the working directory parents, which are the
+// first two nodes in a v1 dirstate or follow the marker of a v2 docket.
+func readDirstateParents(path string) ([][]byte, error) {
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist): // nothing checked out
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	const v2Marker = "dirstate-v2\n"
+	size := 20
+	if bytes.HasPrefix(b, []byte(v2Marker)) {
+		b = b[len(v2Marker):]
+		size = 32
+	}
+	if len(b) < size*2 {
+		return nil, fmt.Errorf("truncated dirstate: %v", path)
+	}
+
+	return [][]byte{b[:20], b[size : size+20]}, nil
+}
+
+// readTags collects global tags from .hgtags on every visible head, later
+// heads and later lines taking precedence, then local tags and tip.
+func (hr *hgRepo) readTags() error {
+	byName := map[string][]byte{}
+	addTags := func(b []byte) {
+		sc := bufio.NewScanner(bytes.NewReader(b))
+		for sc.Scan() {
+			parts := strings.SplitN(strings.TrimSpace(sc.Text()), " ", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			n, err := hex.DecodeString(parts[0])
+			if err != nil || len(n) != 20 {
+				continue
+			}
+			byName[strings.TrimSpace(parts[1])] = n
+		}
+	}
+
+	for _, h := range hr.heads() {
+		ce, err := hr.changeset(h)
+		if err != nil {
+			return err
+		}
+		mf, err := hr.manifest(ce.manifest)
+		if err != nil {
+			return err
+		}
+		fn, ok := mf.lookup(".hgtags")
+		if !ok {
+			continue
+		}
+		b, err := hr.fileText(".hgtags", fn)
+		if err != nil {
+			return err
+		}
+		addTags(b)
+	}
+	lb, err := os.ReadFile(filepath.Join(hr.root, ".hg", "localtags"))
+	switch {
+	case err == nil:
+		addTags(lb)
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+	for tip := hr.cl.Len() - 1; tip >= 0; tip-- {
+		if !hr.hidden[tip] {
+			byName["tip"] = hr.cl.Node(tip)
+			break
+		}
+	}
+
+	hr.tags = map[string][]string{}
+	for name, n := range byName {
+		// removed tags point at nullid
+		if r, ok := hr.cl.Rev(n); !ok || hr.hidden[r] {
+			continue
+		}
+		k := string(n)
+		hr.tags[k] = append(hr.tags[k], name)
+	}
+	for _, names := range hr.tags {
+		sort.Strings(names)
+	}
+
+	return nil
+}
+
+// logEntry formats a rev like the output of Proc.QueryLogs, a JSON object
+// with sorted keys as written by hg followed by the numstat.
+func (hr *hgRepo) logEntry(rev int) (string, error) {
+	ce, err := hr.changeset(rev)
+	if err != nil {
+		return "", err
+	}
+	node := hr.cl.Node(rev)
+	p1, p2 := hr.cl.Parents(rev)
+
+	// like hg, only show parents that are not simply the previous rev
+	var parents []string
+	if p2 != -1 || p1 < rev-1 {
+		for _, p := range []int{p1, p2} {
+			parents = append(parents, fmt.Sprintf("%d:%x", p, hr.cl.Node(p)[:6]))
+		}
+		if p2 == -1 {
+			parents = parents[:1]
+		}
+	}
+
+	branch := ce.extra["branch"]
+	if branch == "" {
+		branch = "default"
+	}
+
+	rd, err := hr.diff(rev, ce)
+	if err != nil {
+		return "", err
+	}
+	numstat, err := json.Marshal(rd.numstat)
+	if err != nil {
+		return "", err
+	}
+
+	graphNode := "o"
+	_, closed := ce.extra["close"]
+	switch {
+	case len(hr.wdParents) > 0 && (bytes.Equal(node, hr.wdParents[0]) || bytes.Equal(node, hr.wdParents[1])):
+		graphNode = "@"
+	case hr.obsolete[rev]:
+		graphNode = "x"
+	case hr.orphan[rev]:
+		graphNode = "*"
+	case closed:
+		graphNode = "_"
+	}
+
+	fields := []struct{ key, val string }{
+		{"author", hgJSON(ce.user)},
+		{"branch", hgJSON(branch)},
+		{"desc", hgJSON(strings.Trim(ce.desc, " \t\n\r\v\f"))}, // like python's strip
+		{"diffstat", hgJSON(fmt.Sprintf("%d: +%d/-%d", rd.fileCnt, rd.adds, rd.removes))},
+		{"file_adds", hgJSONList(rd.added)},
+		{"file_dels", hgJSONList(rd.removed)},
+		{"file_mods", hgJSONList(rd.modified)},
+		{"files", hgJSONList(ce.files)},
+		{"graphnode", hgJSON(graphNode)},
+		{"node", hgJSON(hex.EncodeToString(node))},
+		{"p1node", hgJSON(hex.EncodeToString(hr.cl.Node(p1)))},
+		{"p2node", hgJSON(hex.EncodeToString(hr.cl.Node(p2)))},
+		{"parents", hgJSON(strings.Join(parents, " "))},
+		{"rev", strconv.Itoa(rev)},
+		{"tags", hgJSON(strings.Join(hr.tags[string(node)], " "))},
+		{"ts", hgJSON(ce.date.Format(hgDateFmt))},
+		{"numstat", string(numstat)}, // added after the template by hgLogReader
+	}
+	kvs := make([]string, 0, len(fields))
+	for _, f := range fields {
+		kvs = append(kvs, hgJSON(f.key)+": "+f.val)
+	}
+
+	return "{" + strings.Join(kvs, ", ") + "}", nil
+}
+
+// revDiff is the comparison of a rev with its first parent, like hg's
+// file_adds, file_mods and file_dels keywords and the lines its plain diff
+// adds and removes per file.
+type revDiff struct {
+	added, modified, removed []string
+
+	fileCnt, adds, removes int
+	numstat                map[string][2]int
+}
+
+// diff compares rev with its first parent, counting lines the way hg counts
+// its diff.
+func (hr *hgRepo) diff(rev int, ce changeset) (*revDiff, error) {
+	rd := &revDiff{numstat: map[string][2]int{}}
+	mf, err := hr.manifest(ce.manifest)
+	if err != nil {
+		return nil, err
+	}
+	p1, p2 := hr.cl.Parents(rev)
+	pce, err := hr.changeset(p1)
+	if err != nil {
+		return nil, err
+	}
+	pmf, err := hr.manifest(pce.manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	// merges are compared with the first parent, so files brought in from
+	// the second parent are not listed in the changeset
+	files := ce.files
+	if p2 != -1 {
+		files = mf.changed(pmf)
+	}
+
+	for _, f := range files {
+		fn, inNew := mf.lookup(f)
+		pfn, inOld := pmf.lookup(f)
+		switch {
+		case !inNew && !inOld:
+			continue
+		case !inOld:
+			rd.added = append(rd.added, f)
+		case !inNew:
+			rd.removed = append(rd.removed, f)
+		case fn == pfn:
+			continue
+		default:
+			rd.modified = append(rd.modified, f)
+		}
+
+		var a, b []byte
+		if inOld {
+			if a, err = hr.fileText(f, pfn); err != nil {
+				return nil, err
+			}
+		}
+		if inNew {
+			if b, err = hr.fileText(f, fn); err != nil {
+				return nil, err
+			}
+		}
+		if inOld && inNew && bytes.Equal(a, b) {
+			continue // flags or copy metadata only, no diff
+		}
+
+		rd.fileCnt++
+		rd.numstat[f] = [2]int{}
+		if bytes.IndexByte(a, 0) != -1 || bytes.IndexByte(b, 0) != -1 {
+			continue // binary files are counted without lines
+		}
+
+		var n [2]int
+		for _, h := range lineHunks(splitLines(a), splitLines(b)) {
+			n[0] += h.bLen
+			n[1] += h.aLen
+		}
+		rd.numstat[f] = n
+		rd.adds += n[0]
+		rd.removes += n[1]
+	}
+
+	return rd, nil
+}
+
+// fileText returns the content of a file revision without copy metadata,
+// given its manifest entry.
+func (hr *hgRepo) fileText(path, entry string) ([]byte, error) {
+	if len(entry) < 40 {
+		return nil, fmt.Errorf("malformed manifest entry %#v: %v", entry, path)
+	}
+	node, err := hex.DecodeString(entry[:40])
+	if err != nil {
+		return nil, fmt.Errorf("%w - malformed manifest entry: %v", err, path)
+	}
+
+	fl, ok := hr.filelogs[path]
+	if !ok {
+		fl, err = openRevlog(filepath.Join(hr.storePath, hr.storeFile(path)))
+		if err != nil {
+			return nil, err
+		}
+		hr.filelogs[path] = fl
+	}
+	rev, ok := fl.Rev(node)
+	if !ok {
+		return nil, fmt.Errorf("unknown file node %x: %v", node, path)
+	}
+	b, err := fl.Revision(rev)
+	if err != nil {
+		return nil, err
+	}
+
+	// strip copy metadata enclosed in "\1\n" markers
+	if bytes.HasPrefix(b, []byte("\x01\n")) {
+		if end := bytes.Index(b[2:], []byte("\x01\n")); end != -1 {
+			b = b[end+4:]
+		}
+	}
+
+	return b, nil
+}
+
+// storeFile is the encoded path of a filelog index within the store.
+func (hr *hgRepo) storeFile(path string) string {
+	p := "data/" + path + ".i"
+	_, store := hr.reqs["store"]
+	_, fncache := hr.reqs["fncache"]
+	_, dotencode := hr.reqs["dotencode"]
+	switch {
+	case fncache:
+		return hybridEncode(p, dotencode)
+	case store:
+		return encodeFilename(encodeDir(p))
+	default:
+		return p
+	}
+}
+
+//// Changeset visibility, following mercurial/repoview.py
+
+// readVisibility finds the changesets hg hides: those obsoleted by a marker,
+// unless public, pinned by the working directory, a bookmark or a local tag,
+// or an ancestor of a visible draft or secret changeset. It also finds the
+// obsolete and orphaned ones still shown. Without markers nothing is hidden.
+func (hr *hgRepo) readVisibility() error {
+	n := hr.cl.Len()
+	hr.hidden, hr.obsolete, hr.orphan = make([]bool, n), make([]bool, n), make([]bool, n)
+
+	precs, err := readObsstore(filepath.Join(hr.storePath, "obsstore"))
+	if err != nil || len(precs) == 0 {
+		return err
+	}
+	mutable, err := hr.readMutable()
+	if err != nil {
+		return err
+	}
+	pinned, err := hr.pinned()
+	if err != nil {
+		return err
+	}
+
+	for r := 0; r < n; r++ {
+		_, obs := precs[string(hr.cl.Node(r))]
+		hr.obsolete[r] = mutable[r] && obs
+		hr.hidden[r] = hr.obsolete[r] && !pinned[r]
+	}
+	// children come after parents, so revealing in descending order also
+	// reveals the ancestors of revealed changesets
+	for r := n - 1; r >= 0; r-- {
+		if !mutable[r] || hr.hidden[r] {
+			continue
+		}
+		p1, p2 := hr.cl.Parents(r)
+		for _, p := range []int{p1, p2} {
+			if p >= 0 {
+				hr.hidden[p] = false
+			}
+		}
+	}
+	for r := 0; r < n; r++ {
+		if !mutable[r] || hr.obsolete[r] {
+			continue
+		}
+		p1, p2 := hr.cl.Parents(r)
+		for _, p := range []int{p1, p2} {
+			if p >= 0 && (hr.obsolete[p] || hr.orphan[p]) {
+				hr.orphan[r] = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// readObsstore collects the nodes obsoleted by the markers of an obsstore,
+// whether pruned or replaced by successors.
+func readObsstore(path string) (map[string]struct{}, error) {
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	case len(b) == 0:
+		return nil, nil
+	}
+
+	precs := map[string]struct{}{}
+	truncated := fmt.Errorf("truncated obsstore: %v", path)
+	switch version, b := b[0], b[1:]; version {
+	case 0:
+		// numsuc:1 mdsize:4 flags:1 prec:20, then successors and metadata
+		for off := 0; off < len(b); {
+			if off+26 > len(b) {
+				return nil, truncated
+			}
+			numSuc := int(b[off])
+			mdSize := int(binary.BigEndian.Uint32(b[off+1:]))
+			precs[string(b[off+6:off+26])] = struct{}{}
+			off += 26 + numSuc*20 + mdSize
+		}
+	case 1:
+		// size:4 date:8 tz:2 flags:2 numsuc:1 numpar:1 nummeta:1 prec, then
+		// successors, parents and metadata within size
+		for off := 0; off < len(b); {
+			if off+19 > len(b) {
+				return nil, truncated
+			}
+			size := int(binary.BigEndian.Uint32(b[off:]))
+			nodeSize := 20
+			if binary.BigEndian.Uint16(b[off+14:])&obsUsingSHA256 != 0 {
+				nodeSize = 32
+			}
+			if size < 19+nodeSize || off+size > len(b) {
+				return nil, truncated
+			}
+			precs[string(b[off+19:off+19+nodeSize])] = struct{}{}
+			off += size
+		}
+	default:
+		return nil, fmt.Errorf("unsupported obsstore version %v: %v", version, path)
+	}
+
+	return precs, nil
+}
+
+// obsUsingSHA256 flags obsstore markers with 32 byte nodes.
+const obsUsingSHA256 = 1 << 2
+
+// readMutable marks the draft and secret changesets, descendants of the
+// roots of those phases. Without phase roots all changesets are public.
+func (hr *hgRepo) readMutable() ([]bool, error) {
+	mutable := make([]bool, hr.cl.Len())
+	b, err := os.ReadFile(filepath.Join(hr.storePath, "phaseroots"))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return mutable, nil
+	case err != nil:
+		return nil, err
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		f := strings.Fields(l)
+		if len(f) != 2 || f[0] == "0" {
+			continue
+		}
+		n, err := hex.DecodeString(f[1])
+		if err != nil {
+			continue
+		}
+		if r, ok := hr.cl.Rev(n); ok {
+			mutable[r] = true
+		}
+	}
+	for r := range mutable {
+		p1, p2 := hr.cl.Parents(r)
+		mutable[r] = mutable[r] || (p1 >= 0 && mutable[p1]) || (p2 >= 0 && mutable[p2])
+	}
+
+	return mutable, nil
+}
+
+// pinned marks the changesets kept visible even when obsolete: parents of
+// the working directory and those with a bookmark or a local tag.
+func (hr *hgRepo) pinned() ([]bool, error) {
+	pinned := make([]bool, hr.cl.Len())
+	pin := func(n []byte) {
+		if r, ok := hr.cl.Rev(n); ok {
+			pinned[r] = true
+		}
+	}
+	for _, n := range hr.wdParents {
+		pin(n)
+	}
+	for _, name := range []string{"bookmarks", "localtags"} {
+		b, err := os.ReadFile(filepath.Join(hr.root, ".hg", name))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			continue
+		case err != nil:
+			return nil, err
+		}
+		for _, l := range strings.Split(string(b), "\n") {
+			if n, err := hex.DecodeString(strings.SplitN(l, " ", 2)[0]); err == nil {
+				pin(n)
+			}
+		}
+	}
+
+	return pinned, nil
+}
+
+// heads are the visible revs without visible children.
+func (hr *hgRepo) heads() []int {
+	hasChild := make([]bool, hr.cl.Len())
+	for r := range hasChild {
+		if hr.hidden[r] {
+			continue
+		}
+		p1, p2 := hr.cl.Parents(r)
+		for _, p := range []int{p1, p2} {
+			if p >= 0 {
+				hasChild[p] = true
+			}
+		}
+	}
+	var heads []int
+	for r, c := range hasChild {
+		if !c && !hr.hidden[r] {
+			heads = append(heads, r)
+		}
+	}
+
+	return heads
+}
+
+//// Changelog and manifest entries
+
+type changeset struct {
+	manifest []byte
+	user     string
+	date     time.Time
+	extra    map[string]string
+	files    []string
+	desc     string
+}
+
+func (hr *hgRepo) changeset(rev int) (changeset, error) {
+	b, err := hr.cl.Revision(rev)
+	if err != nil {
+		return changeset{}, err
+	}
+
+	return parseChangeset(b)
+}
+
+func parseChangeset(b []byte) (changeset, error) {
+	ce := changeset{extra: map[string]string{}}
+	text := string(b)
+	if text == "" { // the null revision
+		return ce, nil
+	}
+
+	head, desc := text, ""
+	if i := strings.Index(text, "\n\n"); i != -1 {
+		head, desc = text[:i], text[i+2:]
+	}
+	ce.desc = desc
+	lines := strings.Split(head, "\n")
+	if len(lines) < 3 {
+		return ce, fmt.Errorf("malformed changeset: %#v", head)
+	}
+
+	mn, err := hex.DecodeString(lines[0])
+	if err != nil {
+		return ce, fmt.Errorf("%w - malformed changeset manifest: %#v", err, lines[0])
+	}
+	ce.manifest = mn
+	ce.user = lines[1]
+	ce.files = lines[3:]
+
+	dl := strings.SplitN(lines[2], " ", 3)
+	if len(dl) < 2 {
+		return ce, fmt.Errorf("malformed changeset date: %#v", lines[2])
+	}
+	secs, err := strconv.ParseFloat(dl[0], 64)
+	if err != nil {
+		return ce, fmt.Errorf("%w - malformed changeset date: %#v", err, lines[2])
+	}
+	tz, err := strconv.Atoi(dl[1])
+	if err != nil {
+		return ce, fmt.Errorf("%w - malformed changeset date: %#v", err, lines[2])
+	}
+	// hg offsets are seconds west of UTC
+	ce.date = time.Unix(int64(secs), 0).In(time.FixedZone("", -tz))
+
+	if len(dl) == 3 {
+		for _, kv := range strings.Split(dl[2], "\x00") {
+			kv = unescapeExtra(kv)
+			if i := strings.Index(kv, ":"); i != -1 {
+				ce.extra[kv[:i]] = kv[i+1:]
+			}
+		}
+	}
+
+	return ce, nil
+}
+
+func unescapeExtra(s string) string {
+	r := strings.NewReplacer(`\\`, `\`, `\0`, "\x00", `\n`, "\n", `\r`, "\r")
+	return r.Replace(s)
+}
+
+// manifest is the raw text of a flat manifest, sorted by path.
+type manifest []byte
+
+func (hr *hgRepo) manifest(node []byte) (manifest, error) {
+	rev, ok := hr.ml.Rev(node)
+	if !ok {
+		return manifest{}, nil // the null manifest
+	}
+	b, err := hr.ml.Revision(rev)
+
+	return manifest(b), err
+}
+
+// lookup finds the file node and flags of path, as stored in hex.
+func (m manifest) lookup(path string) (string, bool) {
+	key := []byte(path + "\x00")
+	b := []byte(m)
+	for off := 0; off < len(b); {
+		i := bytes.Index(b[off:], key)
+		if i == -1 {
+			return "", false
+		}
+		i += off
+		if i == 0 || b[i-1] == '\n' {
+			start := i + len(key)
+			end := bytes.IndexByte(b[start:], '\n')
+			if end == -1 {
+				end = len(b) - start
+			}
+			return string(b[start : start+end]), true
+		}
+		off = i + 1
+	}
+
+	return "", false
+}
+
+// entries maps each path to its node and flags.
+func (m manifest) entries() map[string]string {
+	ents := map[string]string{}
+	for _, l := range strings.Split(string(m), "\n") {
+		if i := strings.IndexByte(l, 0); i != -1 {
+			ents[l[:i]] = l[i+1:]
+		}
+	}
+	return ents
+}
+
+// changed lists the sorted paths added, removed or modified from m to o.
+func (m manifest) changed(o manifest) []string {
+	me, oe := m.entries(), o.entries()
+	var paths []string
+	for p, e := range me {
+		if oe[p] != e {
+			paths = append(paths, p)
+		}
+	}
+	for p := range oe {
+		if _, ok := me[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+//// Revlog v1 storage
+
+const (
+	revlogIndexSize   = 64
+	revlogInline      = 1 << 16
+	revlogGeneralDlta = 1 << 17
+)
+
+type revlogEntry struct {
+	offset  int64
+	compLen int
+	base    int
+	p1, p2  int
+	node    []byte
+}
+
+// revlog is an open revlog index with its data, either inline in the index
+// file or split into a separate data file.
+type revlog struct {
+	path         string
+	entries      []revlogEntry
+	nodes        map[string]int
+	inline       bool
+	generalDelta bool
+	index        []byte
+	data         *os.File
+
+	cacheRev  int
+	cacheText []byte
+}
+
+func openRevlog(path string) (*revlog, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rl := &revlog{path: path, nodes: map[string]int{}, cacheRev: -1, index: b}
+	if len(b) == 0 {
+		return rl, nil
+	}
+	if len(b) < 4 {
+		return nil, fmt.Errorf("truncated revlog: %v", path)
+	}
+
+	hdr := binary.BigEndian.Uint32(b[:4])
+	if v := hdr & 0xffff; v != 1 {
+		return nil, fmt.Errorf("unsupported revlog version %v: %v", v, path)
+	}
+	rl.inline = hdr&revlogInline != 0
+	rl.generalDelta = hdr&revlogGeneralDlta != 0
+
+	for off := 0; off < len(b); {
+		if off+revlogIndexSize > len(b) {
+			return nil, fmt.Errorf("truncated revlog index: %v", path)
+		}
+		e := b[off : off+revlogIndexSize]
+		offFlags := binary.BigEndian.Uint64(e[0:8])
+		if len(rl.entries) == 0 {
+			offFlags &= 0xffffffff // first offset is the version header
+		}
+		entry := revlogEntry{
+			offset:  int64(offFlags >> 16),
+			compLen: int(int32(binary.BigEndian.Uint32(e[8:12]))),
+			base:    int(int32(binary.BigEndian.Uint32(e[16:20]))),
+			p1:      int(int32(binary.BigEndian.Uint32(e[24:28]))),
+			p2:      int(int32(binary.BigEndian.Uint32(e[28:32]))),
+			node:    e[32:52],
+		}
+		rl.nodes[string(entry.node)] = len(rl.entries)
+		rl.entries = append(rl.entries, entry)
+
+		off += revlogIndexSize
+		if rl.inline {
+			off += entry.compLen
+		}
+	}
+
+	if !rl.inline {
+		if rl.data, err = os.Open(strings.TrimSuffix(path, ".i") + ".d"); err != nil {
+			return nil, err
+		}
+	}
+
+	return rl, nil
+}
+
+func (rl *revlog) Close() {
+	if rl.data != nil {
+		rl.data.Close()
+	}
+}
+
+func (rl *revlog) Len() int {
+	return len(rl.entries)
+}
+
+// Node returns the node of rev, the null node for -1.
+func (rl *revlog) Node(rev int) []byte {
+	if rev < 0 || rev >= len(rl.entries) {
+		return make([]byte, 20)
+	}
+	return rl.entries[rev].node
+}
+
+func (rl *revlog) Rev(node []byte) (int, bool) {
+	rev, ok := rl.nodes[string(node)]
+	return rev, ok
+}
+
+func (rl *revlog) Parents(rev int) (int, int) {
+	e := rl.entries[rev]
+	return e.p1, e.p2
+}
+
+// Revision rebuilds the full text of rev from its delta chain.
+func (rl *revlog) Revision(rev int) ([]byte, error) {
+	if rev < 0 {
+		return nil, nil
+	}
+	if rev == rl.cacheRev {
+		return rl.cacheText, nil
+	}
+
+	// walk back to a full text, stopping early at a cached one
+	var chain []int
+	var text []byte
+	var cached bool
+	for r := rev; ; {
+		if r == rl.cacheRev {
+			text, cached = rl.cacheText, true
+			break
+		}
+		chain = append(chain, r)
+		base := rl.entries[r].base
+		if base == r {
+			break
+		}
+		if rl.generalDelta {
+			r = base
+		} else {
+			r--
+		}
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		chunk, err := rl.chunk(chain[i])
+		if err != nil {
+			return nil, err
+		}
+		if !cached && i == len(chain)-1 {
+			text = chunk
+			continue
+		}
+		if text, err = applyPatch(text, chunk); err != nil {
+			return nil, fmt.Errorf("%w - rev %v of %v", err, chain[i], rl.path)
+		}
+	}
+
+	rl.cacheRev, rl.cacheText = rev, text
+
+	return text, nil
+}
+
+// chunk reads and decompresses the stored data of rev.
+func (rl *revlog) chunk(rev int) ([]byte, error) {
+	e := rl.entries[rev]
+	var raw []byte
+	switch {
+	case rl.inline:
+		start := e.offset + int64((rev+1)*revlogIndexSize)
+		end := start + int64(e.compLen)
+		if end > int64(len(rl.index)) {
+			return nil, fmt.Errorf("truncated revlog data: %v", rl.path)
+		}
+		raw = rl.index[start:end]
+	default:
+		raw = make([]byte, e.compLen)
+		if _, err := rl.data.ReadAt(raw, e.offset); err != nil {
+			return nil, fmt.Errorf("%w - reading revlog data: %v", err, rl.path)
+		}
+	}
+
+	return decompress(raw)
+}
+
+var zstdDec, _ = zstd.NewReader(nil)
+
+func decompress(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return b, nil
+	}
+	switch b[0] {
+	case 0:
+		return b, nil
+	case 'u':
+		return b[1:], nil
+	case 'x':
+		zr, err := zlib.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	case '(': // zstd frame magic starts with 0x28
+		return zstdDec.DecodeAll(b, nil)
+	default:
+		return nil, fmt.Errorf("unknown revlog compression: %#x", b[0])
+	}
+}
+
+// applyPatch applies an mpatch delta, a sequence of big-endian start, end and
+// length headers each followed by replacement data.
+func applyPatch(text, delta []byte) ([]byte, error) {
+	var out []byte
+	last := 0
+	for pos := 0; pos < len(delta); {
+		if pos+12 > len(delta) {
+			return nil, errors.New("truncated patch header")
+		}
+		start := int(binary.BigEndian.Uint32(delta[pos:]))
+		end := int(binary.BigEndian.Uint32(delta[pos+4:]))
+		n := int(binary.BigEndian.Uint32(delta[pos+8:]))
+		pos += 12
+		if start < last || end < start || end > len(text) || pos+n > len(delta) {
+			return nil, errors.New("invalid patch hunk")
+		}
+		out = append(out, text[last:start]...)
+		out = append(out, delta[pos:pos+n]...)
+		pos += n
+		last = end
+	}
+
+	return append(out, text[last:]...), nil
+}
+
+//// Store path encoding, following mercurial/store.py
+
+const maxStorePathLen = 120
+
+func encodeDir(path string) string {
+	if !strings.Contains(path, ".hg/") && !strings.Contains(path, ".i/") && !strings.Contains(path, ".d/") {
+		return path
+	}
+	r := strings.NewReplacer(".hg/", ".hg.hg/", ".i/", ".i.hg/", ".d/", ".d.hg/")
+	return r.Replace(path)
+}
+
+func encodeChar(c byte, doubleUnderscore bool) string {
+	switch {
+	case c == '_' && doubleUnderscore:
+		return "__"
+	case c >= 'A' && c <= 'Z':
+		if doubleUnderscore {
+			return "_" + string(c+('a'-'A'))
+		}
+		return string(c + ('a' - 'A'))
+	case c < 32 || c >= 126 || strings.IndexByte(`\:*?"<>|`, c) != -1:
+		return fmt.Sprintf("~%02x", c)
+	default:
+		return string(c)
+	}
+}
+
+func encodeFilename(path string) string {
+	var sb strings.Builder
+	for i := 0; i < len(path); i++ {
+		sb.WriteString(encodeChar(path[i], true))
+	}
+	return sb.String()
+}
+
+func lowerEncode(path string) string {
+	var sb strings.Builder
+	for i := 0; i < len(path); i++ {
+		sb.WriteString(encodeChar(path[i], false))
+	}
+	return sb.String()
+}
+
+func auxEncode(parts []string, dotencode bool) []string {
+	isWinRes := func(n string) bool {
+		l := strings.IndexByte(n, '.')
+		if l == -1 {
+			l = len(n)
+		}
+		switch {
+		case l == 3:
+			switch n[:3] {
+			case "aux", "con", "prn", "nul":
+				return true
+			}
+		case l == 4 && n[3] >= '1' && n[3] <= '9':
+			switch n[:3] {
+			case "com", "lpt":
+				return true
+			}
+		}
+		return false
+	}
+
+	for i, n := range parts {
+		if n == "" {
+			continue
+		}
+		switch {
+		case dotencode && (n[0] == '.' || n[0] == ' '):
+			n = fmt.Sprintf("~%02x", n[0]) + n[1:]
+		case isWinRes(n):
+			n = n[:2] + fmt.Sprintf("~%02x", n[2]) + n[3:]
+		}
+		if last := n[len(n)-1]; last == '.' || last == ' ' {
+			n = n[:len(n)-1] + fmt.Sprintf("~%02x", last)
+		}
+		parts[i] = n
+	}
+
+	return parts
+}
+
+func hybridEncode(path string, dotencode bool) string {
+	path = encodeDir(path)
+	res := strings.Join(auxEncode(strings.Split(encodeFilename(path), "/"), dotencode), "/")
+	if len(res) > maxStorePathLen {
+		res = hashEncode(path, dotencode)
+	}
+	return res
+}
+
+// hashEncode shortens store paths too long for some filesystems by keeping
+// only a prefix of each directory and the sha1 of the full path.
+func hashEncode(path string, dotencode bool) string {
+	const (
+		dirPrefixLen    = 8
+		maxShortDirsLen = 8*(dirPrefixLen+1) - 4
+	)
+
+	digest := fmt.Sprintf("%x", sha1.Sum([]byte(path)))
+	parts := auxEncode(strings.Split(lowerEncode(path[len("data/"):]), "/"), dotencode)
+	basename := parts[len(parts)-1]
+	ext := filepath.Ext(basename)
+
+	var sdirs []string
+	sdirsLen := 0
+	for _, p := range parts[:len(parts)-1] {
+		d := p
+		if len(d) > dirPrefixLen {
+			d = d[:dirPrefixLen]
+		}
+		if last := d[len(d)-1]; last == '.' || last == ' ' {
+			d = d[:len(d)-1] + "_"
+		}
+		t := len(d)
+		if sdirsLen != 0 {
+			t = sdirsLen + 1 + len(d)
+			if t > maxShortDirsLen {
+				break
+			}
+		}
+		sdirs = append(sdirs, d)
+		sdirsLen = t
+	}
+	dirs := strings.Join(sdirs, "/")
+	if dirs != "" {
+		dirs += "/"
+	}
+
+	res := "dh/" + dirs + digest + ext
+	if spaceLeft := maxStorePathLen - len(res); spaceLeft > 0 {
+		filler := basename
+		if len(filler) > spaceLeft {
+			filler = filler[:spaceLeft]
+		}
+		res = "dh/" + dirs + filler + digest + ext
+	}
+
+	return res
+}
+
+//// Line diff counting
+
+func splitLines(b []byte) []string {
+	if len(b) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// maxDiffCost bounds the edit distance searched by lineHunks before it
+// treats the remaining difference as a single replacement, keeping
+// pathological rewrites fast.
+const maxDiffCost = 2048
+
+// lineHunk is a run of lines replaced in a by lines in b, by zero based
+// starting index.
+type lineHunk struct {
+	aStart, aLen int
+	bStart, bLen int
+}
+
+// lineHunks finds the changed lines going from a to b using the Myers
+// shortest edit script.
+func lineHunks(a, b []string) []lineHunk {
+	// trim the common prefix and suffix, which are never changed
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	ta, tb := a[pre:len(a)-suf], b[pre:len(b)-suf]
+	n, m := len(ta), len(tb)
+	switch {
+	case n == 0 && m == 0:
+		return nil
+	case n == 0 || m == 0:
+		return []lineHunk{{pre, n, pre, m}}
+	}
+
+	// forward pass, keeping the furthest x of each diagonal k per step d
+	maxD := n + m
+	if maxD > maxDiffCost {
+		maxD = maxDiffCost
+	}
+	off := maxD + 1
+	v := make([]int, 2*maxD+3)
+	var trace [][]int
+	found := -1
+	for d := 0; d <= maxD && found == -1; d++ {
+		trace = append(trace, append([]int(nil), v[off-d-1:off+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && ta[x] == tb[y] {
+				x, y = x+1, y+1
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				found = d
+				break
+			}
+		}
+	}
+	if found == -1 {
+		return []lineHunk{{pre, n, pre, m}}
+	}
+
+	// walk the trace back, marking removed lines of a and added lines of b
+	removed, added := make([]bool, n), make([]bool, m)
+	x, y := n, m
+	for d := found; d > 0; d-- {
+		prev := trace[d] // furthest x per diagonal after step d-1
+		at := func(k int) int { return prev[k+d+1] }
+		k := x - y
+		var pk int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			pk = k + 1
+		} else {
+			pk = k - 1
+		}
+		px := at(pk)
+		py := px - pk
+		if pk == k+1 {
+			added[py] = true
+		} else {
+			removed[px] = true
+		}
+		x, y = px, py
+	}
+
+	// group changed lines into hunks between runs of common lines
+	var hunks []lineHunk
+	i, j := 0, 0
+	for i < n || j < m {
+		if i < n && j < m && !removed[i] && !added[j] {
+			i, j = i+1, j+1
+			continue
+		}
+		h := lineHunk{aStart: pre + i, bStart: pre + j}
+		for i < n && removed[i] {
+			i, h.aLen = i+1, h.aLen+1
+		}
+		for j < m && added[j] {
+			j, h.bLen = j+1, h.bLen+1
+		}
+		hunks = append(hunks, h)
+	}
+
+	return hunks
+}
+
+//// JSON output, following hg's paranoid json template filter
+
+// hgJSON encodes s as a JSON string the way hg does, escaping '<' and '>'
+// and all non-ASCII characters.
+func hgJSON(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"':
+			sb.WriteString(`\"`)
+		case r == '\\':
+			sb.WriteString(`\\`)
+		case r == '\b':
+			sb.WriteString(`\b`)
+		case r == '\f':
+			sb.WriteString(`\f`)
+		case r == '\n':
+			sb.WriteString(`\n`)
+		case r == '\r':
+			sb.WriteString(`\r`)
+		case r == '\t':
+			sb.WriteString(`\t`)
+		case r < 0x20 || r == '<' || r == '>' || r == 0x7f:
+			fmt.Fprintf(&sb, "\\u%04x", r)
+		case r > 0x7f:
+			for _, u := range utf16.Encode([]rune{r}) {
+				fmt.Fprintf(&sb, "\\u%04x", u)
+			}
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+
+	return sb.String()
+}
+
+func hgJSONList(ss []string) string {
+	enc := make([]string, 0, len(ss))
+	for _, s := range ss {
+		enc = append(enc, hgJSON(s))
+	}
+	return "[" + strings.Join(enc, ", ") + "]"
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRevlogQueryLogs(t *testing.T) {
+	t.Run("can read logs matching hg output", func(t *testing.T) {
+		rr := NewRevlogReader()
+		want := testRepoLog
+
+		// SUT
+		rc, err := rr.QueryLogs(context.Background(), testRepo, Tip{})
+
+		assert(t, err, nil)
+		got, err := readAllClose(t, rc)
+		assert(t, err, nil)
+		if got != want {
+			t.Errorf("got\n%#v\nwant\n%#v", got, want)
+		}
+	})
+
+	t.Run("can read no logs newer than tip", func(t *testing.T) {
+		rr := NewRevlogReader()
+		since := Tip{Rev: 0, Node: testLogRecord.NodeID}
+
+		// SUT
+		rc, err := rr.QueryLogs(context.Background(), testRepo, since)
+
+		assert(t, err, nil)
+		got, err := readAllClose(t, rc)
+		assert(t, err, nil)
+		assert(t, got, "")
+	})
+
+	t.Run("can stop reading when closed early", func(t *testing.T) {
+		rr := NewRevlogReader()
+		rc, err := rr.QueryLogs(context.Background(), testRepo, Tip{})
+		if err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+
+		// SUT
+		err = rc.Close()
+
+		assert(t, err, nil)
+	})
+
+	t.Run("can stop reading when cancelled", func(t *testing.T) {
+		rr := NewRevlogReader()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		rc, err := rr.QueryLogs(ctx, testRepo, Tip{})
+		if err != nil {
+			t.Fatalf("unexpected query error: %v", err)
+		}
+
+		// SUT
+		_, err = readAllClose(t, rc)
+
+		assert(t, err, context.Canceled)
+	})
+
+	t.Run("can be obtained like hg output", func(t *testing.T) {
+		dr := NewDataReader(NewRevlogReader())
+
+		// SUT
+		got, err := dr.Obtain(context.Background(), testRepo, Tip{})
+
+		assert(t, err, nil)
+		assert(t, len(got.ErrEvents), 0)
+		assertDeep(t, got.LogRecs, []LogRecord{testLogRecord})
+	})
+}
+
+func TestRevlogLookupRev(t *testing.T) {
+	t.Run("can find existing node", func(t *testing.T) {
+		rr := NewRevlogReader()
+
+		// SUT
+		rev, found, err := rr.LookupRev(context.Background(), testRepo, testLogRecord.NodeID)
+
+		assert(t, err, nil)
+		assert(t, found, true)
+		assert(t, rev, 0)
+	})
+
+	t.Run("can miss stripped node", func(t *testing.T) {
+		rr := NewRevlogReader()
+
+		// SUT
+		_, found, err := rr.LookupRev(context.Background(), testRepo, "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+
+		assert(t, err, nil)
+		assert(t, found, false)
+	})
+}
+
+func TestDecompress(t *testing.T) {
+	var zb bytes.Buffer
+	zw := zlib.NewWriter(&zb)
+	zw.Write([]byte("hello world\n"))
+	zw.Close()
+
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"uncompressed", []byte("uhello world\n"), "hello world\n"},
+		{"raw", []byte("\x00hello world\n"), "\x00hello world\n"},
+		{"zlib", zb.Bytes(), "hello world\n"},
+	}
+	for _, tt := range tests {
+		t.Run("can decompress "+tt.name, func(t *testing.T) {
+			// SUT
+			got, err := decompress(tt.in)
+
+			assert(t, err, nil)
+			assert(t, string(got), tt.want)
+		})
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	t.Run("can apply delta hunks", func(t *testing.T) {
+		var delta []byte
+		hunk := func(start, end int, data string) {
+			h := make([]byte, 12)
+			binary.BigEndian.PutUint32(h[0:], uint32(start))
+			binary.BigEndian.PutUint32(h[4:], uint32(end))
+			binary.BigEndian.PutUint32(h[8:], uint32(len(data)))
+			delta = append(append(delta, h...), data...)
+		}
+		hunk(0, 5, "howdy")
+		hunk(6, 11, "there")
+
+		// SUT
+		got, err := applyPatch([]byte("hello world\n"), delta)
+
+		assert(t, err, nil)
+		assert(t, string(got), "howdy there\n")
+	})
+}
+
+func TestStoreEncoding(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"data/hi.txt.i", "data/hi.txt.i"},
+		{"data/README_Notes.i", "data/_r_e_a_d_m_e___notes.i"},
+		{"data/.hgtags.i", "data/~2ehgtags.i"},
+		{"data/aux.c.i", "data/au~78.c.i"},
+		{"data/x.i/y.i", "data/x.i.hg/y.i"},
+		{"data/what?.i", "data/what~3f.i"},
+	}
+	for _, tt := range tests {
+		t.Run("can encode "+tt.path, func(t *testing.T) {
+			// SUT
+			got := hybridEncode(tt.path, true)
+
+			assert(t, got, tt.want)
+		})
+	}
+
+	t.Run("can hash encode long paths", func(t *testing.T) {
+		long := "data/" + string(bytes.Repeat([]byte("directory/"), 12)) + "file.txt.i"
+
+		// SUT
+		got := hybridEncode(long, true)
+
+		if len(got) > maxStorePathLen {
+			t.Errorf("got %v bytes, want at most %v", len(got), maxStorePathLen)
+		}
+		assert(t, got[:3], "dh/")
+		assert(t, got[len(got)-2:], ".i")
+	})
+}
+
+func TestLineHunks(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []lineHunk
+	}{
+		{"added file", "", "a\nb\n", []lineHunk{{0, 0, 0, 2}}},
+		{"removed file", "a\nb\n", "", []lineHunk{{0, 2, 0, 0}}},
+		{"changed line", "a\nb\nc\n", "a\nB\nc\n", []lineHunk{{1, 1, 1, 1}}},
+		{"inserted line", "a\nc\n", "a\nb\nc\n", []lineHunk{{1, 0, 1, 1}}},
+		{"missing newline", "a", "a\n", []lineHunk{{0, 1, 0, 1}}},
+		{"separate changes", "a\nb\nc\nd\ne\n", "a\nX\nc\nd\n", []lineHunk{{1, 1, 1, 1}, {4, 1, 4, 0}}},
+		{"unchanged", "a\nb\n", "a\nb\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run("can find "+tt.name, func(t *testing.T) {
+			// SUT
+			got := lineHunks(splitLines([]byte(tt.a)), splitLines([]byte(tt.b)))
+
+			assertDeep(t, got, tt.want)
+		})
+	}
+}
+
+func TestHgJSON(t *testing.T) {
+	t.Run("can escape like hg", func(t *testing.T) {
+		// SUT
+		got := hgJSON("tab\t\"quote\" <a@b.c> caf\u00e9 \U0001F600")
+
+		assert(t, got, `"tab\t\"quote\" \u003ca@b.c\u003e caf\u00e9 \ud83d\ude00"`)
+	})
+
+	t.Run("can encode lists like hg", func(t *testing.T) {
+		assert(t, hgJSONList(nil), "[]")
+		assert(t, hgJSONList([]string{"a", "b"}), `["a", "b"]`)
+	})
+}
+
+// testRevlogOpts is how a test revlog is stored.
+type testRevlogOpts struct {
+	inline       bool // data in the index file rather than a .d file
+	generalDelta bool // deltas against any rev rather than the previous one
+	deltas       bool // revs stored as deltas, with a full text every third
+}
+
+// testRevlog collects revisions to write as a revlog, with their nodes
+// hashed the way hg does.
+type testRevlog struct {
+	texts  [][]byte
+	parent [][2]int
+	nodes  [][]byte
+}
+
+func (rl *testRevlog) node(rev int) []byte {
+	if rev < 0 {
+		return make([]byte, 20)
+	}
+	return rl.nodes[rev]
+}
+
+func (rl *testRevlog) add(text []byte, p1, p2 int) int {
+	a, b := rl.node(p1), rl.node(p2)
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	h := sha1.New()
+	h.Write(a)
+	h.Write(b)
+	h.Write(text)
+	rl.texts = append(rl.texts, text)
+	rl.parent = append(rl.parent, [2]int{p1, p2})
+	rl.nodes = append(rl.nodes, h.Sum(nil))
+
+	return len(rl.texts) - 1
+}
+
+// write stores the revlog at path, every chunk zlib compressed.
+func (rl *testRevlog) write(t *testing.T, path string, opts testRevlogOpts) {
+	t.Helper()
+	var index, data []byte
+	base := 0
+	for rev, text := range rl.texts {
+		chunk := text
+		switch {
+		case !opts.deltas || rev%3 == 0:
+			base = rev
+		default:
+			chunk = testDelta(rl.texts[rev-1], text)
+		}
+		var zb bytes.Buffer
+		zw := zlib.NewWriter(&zb)
+		zw.Write(chunk)
+		zw.Close()
+
+		deltaBase := base
+		if opts.generalDelta && base != rev {
+			deltaBase = rev - 1
+		}
+		e := make([]byte, revlogIndexSize)
+		binary.BigEndian.PutUint64(e[0:], uint64(len(data))<<16)
+		if rev == 0 {
+			hdr := uint32(1)
+			if opts.inline {
+				hdr |= revlogInline
+			}
+			if opts.generalDelta {
+				hdr |= revlogGeneralDlta
+			}
+			binary.BigEndian.PutUint32(e[0:], hdr)
+		}
+		binary.BigEndian.PutUint32(e[8:], uint32(zb.Len()))
+		binary.BigEndian.PutUint32(e[12:], uint32(len(text)))
+		binary.BigEndian.PutUint32(e[16:], uint32(deltaBase))
+		binary.BigEndian.PutUint32(e[20:], uint32(rev))
+		binary.BigEndian.PutUint32(e[24:], uint32(int32(rl.parent[rev][0])))
+		binary.BigEndian.PutUint32(e[28:], uint32(int32(rl.parent[rev][1])))
+		copy(e[32:], rl.nodes[rev])
+
+		index = append(index, e...)
+		if opts.inline {
+			index = append(index, zb.Bytes()...)
+		}
+		data = append(data, zb.Bytes()...)
+	}
+
+	writeTestFile(t, path, index)
+	if !opts.inline {
+		writeTestFile(t, strings.TrimSuffix(path, ".i")+".d", data)
+	}
+}
+
+// testDelta is an mpatch delta from a to b, replacing what lies between
+// their common prefix and suffix.
+func testDelta(a, b []byte) []byte {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	mid := b[pre : len(b)-suf]
+	h := make([]byte, 12)
+	binary.BigEndian.PutUint32(h[0:], uint32(pre))
+	binary.BigEndian.PutUint32(h[4:], uint32(len(a)-suf))
+	binary.BigEndian.PutUint32(h[8:], uint32(len(mid)))
+
+	return append(h, mid...)
+}
+
+func writeTestFile(t *testing.T, path string, b []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("unexpected mkdir error: %v", err)
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+}
+
+// testHgRepo builds a repo commit by commit, for revlog layouts and
+// histories the golden repo does not have.
+type testHgRepo struct {
+	cl, ml testRevlog
+	files  map[string]*testRevlog
+	mfs    []map[string]int // file revs by path, per changeset
+}
+
+func newTestHgRepo() *testHgRepo {
+	return &testHgRepo{files: map[string]*testRevlog{}}
+}
+
+// commit adds a changeset on p1, merging in the files of p2 if not -1, with
+// files set to their content or removed if empty. It returns the rev.
+func (tr *testHgRepo) commit(p1, p2 int, desc string, files map[string]string) int {
+	mf := map[string]int{}
+	var pmf map[string]int
+	if p1 >= 0 {
+		pmf = tr.mfs[p1]
+		for p, r := range pmf {
+			mf[p] = r
+		}
+	}
+	if p2 >= 0 {
+		for p, r := range tr.mfs[p2] {
+			if _, ok := mf[p]; !ok {
+				mf[p] = r
+			}
+		}
+	}
+
+	var changed []string
+	for p, content := range files {
+		changed = append(changed, p)
+		if content == "" {
+			delete(mf, p)
+			continue
+		}
+		fl, ok := tr.files[p]
+		if !ok {
+			fl = &testRevlog{}
+			tr.files[p] = fl
+		}
+		fp := -1
+		if r, ok := pmf[p]; ok {
+			fp = r
+		}
+		mf[p] = fl.add([]byte(content), fp, -1)
+	}
+	sort.Strings(changed)
+
+	var paths []string
+	for p := range mf {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var mtext strings.Builder
+	for _, p := range paths {
+		fmt.Fprintf(&mtext, "%s\x00%x\n", p, tr.files[p].node(mf[p]))
+	}
+	mrev := tr.ml.add([]byte(mtext.String()), p1, p2)
+
+	rev := len(tr.mfs)
+	text := fmt.Sprintf("%x\nSome User <some.user@email.com>\n%d 0\n%s\n\n%s",
+		tr.ml.node(mrev), 1654904627+rev*60, strings.Join(changed, "\n"), desc)
+	tr.cl.add([]byte(text), p1, p2)
+	tr.mfs = append(tr.mfs, mf)
+
+	return rev
+}
+
+// node is the hex node of a changeset.
+func (tr *testHgRepo) node(rev int) string {
+	return hex.EncodeToString(tr.cl.node(rev))
+}
+
+// write stores the repo in a new directory, returning its root.
+func (tr *testHgRepo) write(t *testing.T, opts testRevlogOpts) string {
+	t.Helper()
+	root := t.TempDir()
+	store := filepath.Join(root, ".hg", "store")
+	reqs := "dotencode\nfncache\nrevlogv1\nstore\n"
+	if opts.generalDelta {
+		reqs += "generaldelta\n"
+	}
+	writeTestFile(t, filepath.Join(root, ".hg", "requires"), []byte(reqs))
+	tr.cl.write(t, filepath.Join(store, "00changelog.i"), opts)
+	tr.ml.write(t, filepath.Join(store, "00manifest.i"), opts)
+	for p, fl := range tr.files {
+		fl.write(t, filepath.Join(store, hybridEncode("data/"+p+".i", true)), opts)
+	}
+
+	return root
+}
+
+func TestRevlogRevision(t *testing.T) {
+	var rl testRevlog
+	for i := 0; i < 8; i++ {
+		rl.add([]byte(fmt.Sprintf("header\nline %d\n%s\nfooter\n", i, strings.Repeat("x", i))), i-1, -1)
+	}
+
+	for _, opts := range []testRevlogOpts{
+		{inline: true},
+		{inline: false},
+		{inline: true, deltas: true},
+		{inline: false, deltas: true},
+		{inline: false, deltas: true, generalDelta: true},
+	} {
+		t.Run(fmt.Sprintf("can rebuild revs stored with %+v", opts), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "00changelog.i")
+			rl.write(t, path, opts)
+			r, err := openRevlog(path)
+			if err != nil {
+				t.Fatalf("unexpected open error: %v", err)
+			}
+			defer r.Close()
+
+			// SUT, in both orders so chains are walked with and without
+			// a cached text to start from
+			for _, order := range [][]int{{0, 1, 2, 3, 4, 5, 6, 7}, {7, 5, 6, 2, 1, 4, 3, 0}} {
+				for _, rev := range order {
+					got, err := r.Revision(rev)
+
+					assert(t, err, nil)
+					assert(t, string(got), string(rl.texts[rev]))
+				}
+			}
+			assert(t, r.Len(), 8)
+			assert(t, hex.EncodeToString(r.Node(7)), hex.EncodeToString(rl.nodes[7]))
+		})
+	}
+}
+
+func TestRevlogHistory(t *testing.T) {
+	tr := newTestHgRepo()
+	tr.commit(-1, -1, "add a and b", map[string]string{"a.txt": "a1\n", "b.txt": "b1\nb2\n"})
+	tr.commit(0, -1, "change a", map[string]string{"a.txt": "a1\na2\n"})
+	tr.commit(0, -1, "add c on another head", map[string]string{"c.txt": "c1\n"})
+	tr.commit(1, 2, "merge, changing b", map[string]string{"b.txt": "b1\nB2\nb3\n"})
+	tr.commit(3, -1, "remove a", map[string]string{"a.txt": ""})
+
+	for _, opts := range []testRevlogOpts{
+		{inline: true},
+		{inline: false, deltas: true},
+		{inline: false, deltas: true, generalDelta: true},
+	} {
+		t.Run(fmt.Sprintf("can read history stored with %+v", opts), func(t *testing.T) {
+			repo := tr.write(t, opts)
+			dr := NewDataReader(NewRevlogReader())
+
+			// SUT
+			got, err := dr.Obtain(context.Background(), repo, Tip{})
+
+			assert(t, err, nil)
+			assert(t, len(got.ErrEvents), 0)
+			assert(t, len(got.LogRecs), 5)
+			head, merge := got.LogRecs[2], got.LogRecs[3]
+			assert(t, head.ParentIDs, "0:"+tr.node(0)[:12])
+			assertDeep(t, head.FileChanges, []FileChange{{Path: "c.txt", Action: "added", Added: 1}})
+			assert(t, merge.ParentIDs, "1:"+tr.node(1)[:12]+" 2:"+tr.node(2)[:12])
+			assert(t, merge.P1Node, tr.node(1))
+			assert(t, merge.P2Node, tr.node(2))
+			// compared with the first parent, c.txt came in from the second
+			assertDeep(t, merge.FileChanges, []FileChange{
+				{Path: "c.txt", Action: "added", Added: 1},
+				{Path: "b.txt", Action: "modified", Added: 2, Removed: 1},
+			})
+			assert(t, merge.DiffStat, "2: +3/-1")
+			assertDeep(t, got.LogRecs[4].FileChanges, []FileChange{{Path: "a.txt", Action: "removed", Removed: 2}})
+			assert(t, got.LogRecs[4].Tags, "tip")
+		})
+	}
+}
+
+// testObsMarker is an obsstore v1 marker, pruning prec if there are no succs.
+func testObsMarker(prec []byte, succs ...[]byte) []byte {
+	// size, date and tz are left zero until the size is known
+	m := make([]byte, 19)
+	m[16], m[17] = byte(len(succs)), 3 // numsuc, numpar of 3 for none recorded
+	m = append(m, prec...)
+	for _, s := range succs {
+		m = append(m, s...)
+	}
+	binary.BigEndian.PutUint32(m[0:], uint32(len(m)))
+
+	return m
+}
+
+func TestRevlogHidden(t *testing.T) {
+	// 0 public, 1 amended as 2, 3 an orphan left on 1, 4 pruned
+	tr := newTestHgRepo()
+	tr.commit(-1, -1, "public", map[string]string{"a.txt": "a\n"})
+	tr.commit(0, -1, "draft", map[string]string{"a.txt": "a\nb\n"})
+	tr.commit(0, -1, "draft, amended", map[string]string{"a.txt": "a\nB\n"})
+	tr.commit(1, -1, "draft on the old one", map[string]string{"c.txt": "c\n"})
+	tr.commit(2, -1, "pruned", map[string]string{"d.txt": "d\n"})
+	writeHidden := func(t *testing.T, markers ...[]byte) string {
+		t.Helper()
+		repo := tr.write(t, testRevlogOpts{inline: true, generalDelta: true})
+		store := filepath.Join(repo, ".hg", "store")
+		writeTestFile(t, filepath.Join(store, "phaseroots"), []byte("1 "+tr.node(1)+"\n1 "+tr.node(2)+"\n"))
+		obs := []byte{1}
+		for _, m := range markers {
+			obs = append(obs, m...)
+		}
+		writeTestFile(t, filepath.Join(store, "obsstore"), obs)
+		return repo
+	}
+	revs := func(recs []LogRecord) (ids, graph []string) {
+		for _, r := range recs {
+			ids, graph = append(ids, r.RevID), append(graph, r.GraphNode)
+		}
+		return ids, graph
+	}
+
+	t.Run("can skip hidden changesets", func(t *testing.T) {
+		repo := writeHidden(t, testObsMarker(tr.cl.node(4)))
+		dr := NewDataReader(NewRevlogReader())
+
+		// SUT
+		got, err := dr.Obtain(context.Background(), repo, Tip{})
+
+		assert(t, err, nil)
+		ids, _ := revs(got.LogRecs)
+		assertDeep(t, ids, []string{"0", "1", "2", "3"})
+		assert(t, got.LogRecs[3].Tags, "tip")
+		_, found, err := NewRevlogReader().LookupRev(context.Background(), repo, tr.node(4))
+		assert(t, err, nil)
+		assert(t, found, false)
+	})
+
+	t.Run("can show obsolete ancestors of visible changesets", func(t *testing.T) {
+		repo := writeHidden(t, testObsMarker(tr.cl.node(1), tr.cl.node(2)), testObsMarker(tr.cl.node(4)))
+		dr := NewDataReader(NewRevlogReader())
+
+		// SUT
+		got, err := dr.Obtain(context.Background(), repo, Tip{})
+
+		assert(t, err, nil)
+		ids, graph := revs(got.LogRecs)
+		assertDeep(t, ids, []string{"0", "1", "2", "3"})
+		assertDeep(t, graph, []string{"o", "x", "o", "*"})
+	})
+
+	t.Run("can hide obsolete changesets once nothing depends on them", func(t *testing.T) {
+		repo := writeHidden(t, testObsMarker(tr.cl.node(1), tr.cl.node(2)), testObsMarker(tr.cl.node(3)))
+		dr := NewDataReader(NewRevlogReader())
+
+		// SUT
+		got, err := dr.Obtain(context.Background(), repo, Tip{})
+
+		assert(t, err, nil)
+		ids, _ := revs(got.LogRecs)
+		assertDeep(t, ids, []string{"0", "2", "4"})
+	})
+
+	t.Run("can show bookmarked obsolete changesets", func(t *testing.T) {
+		repo := writeHidden(t, testObsMarker(tr.cl.node(4)))
+		writeTestFile(t, filepath.Join(repo, ".hg", "bookmarks"), []byte(tr.node(4)+" wip\n"))
+		dr := NewDataReader(NewRevlogReader())
+
+		// SUT
+		got, err := dr.Obtain(context.Background(), repo, Tip{})
+
+		assert(t, err, nil)
+		ids, graph := revs(got.LogRecs)
+		assertDeep(t, ids, []string{"0", "1", "2", "3", "4"})
+		assert(t, graph[4], "x")
+	})
+
+	t.Run("can never hide public changesets", func(t *testing.T) {
+		repo := writeHidden(t, testObsMarker(tr.cl.node(0)))
+		dr := NewDataReader(NewRevlogReader())
+
+		// SUT
+		got, err := dr.Obtain(context.Background(), repo, Tip{})
+
+		assert(t, err, nil)
+		assert(t, len(got.LogRecs), 5)
+		assert(t, got.LogRecs[0].GraphNode, "o")
+	})
+}
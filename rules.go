@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+//// Repo include and exclude rules
+
+// RepoFilter decides which directories a Discovery searches and which repos
+// it lists, by rules on their slash separated path relative to the root.
+//
+// Exclude rules keep directories from being searched, the last rule matching
+// a directory deciding, so a negated rule given after an exclude rule takes
+// back the exclusion of the directories matching both. As with gitignore,
+// nothing under an excluded directory can be taken back. Once any include
+// rule is given, only repos matching one are listed.
+//
+// Rules are globs on the path, where * and ? do not match a /, ** matches
+// anything and a glob without a / matches the name of a directory at any
+// depth, or regexps prefixed with re: matched anywhere in the path. Either
+// is negated by a ! prefix.
+type RepoFilter struct {
+	Include []filterRule
+	Exclude []filterRule
+}
+
+// filterRule is a parsed rule, with the flag or file line it was given by.
+type filterRule struct {
+	Source  string
+	Pattern string
+	negate  bool
+	re      *regexp.Regexp
+}
+
+func (r filterRule) String() string {
+	return fmt.Sprintf("%v: %v", r.Source, r.Pattern)
+}
+
+// AddRule parses a rule given by source, e.g. a flag.
+func (f *RepoFilter) AddRule(include bool, source, pattern string) error {
+	r, err := parseRule(source, pattern)
+	if err != nil {
+		return err
+	}
+
+	if include {
+		f.Include = append(f.Include, r)
+	} else {
+		f.Exclude = append(f.Exclude, r)
+	}
+
+	return nil
+}
+
+// AddFile parses a file of rules, one per line, skipping blank lines and
+// lines starting with #.
+func (f *RepoFilter) AddFile(include bool, path string) error {
+	fl, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fl.Close()
+
+	sc := bufio.NewScanner(fl)
+	for ln := 1; sc.Scan(); ln++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := f.AddRule(include, fmt.Sprintf("%v:%v", path, ln), line); err != nil {
+			return err
+		}
+	}
+
+	return sc.Err()
+}
+
+// Excludes reports the rule keeping a directory from being searched, if any.
+func (f *RepoFilter) Excludes(rel string) (filterRule, bool) {
+	var rule filterRule
+	var excluded bool
+	if f == nil {
+		return rule, excluded
+	}
+
+	for _, r := range f.Exclude {
+		if r.re.MatchString(rel) {
+			rule, excluded = r, !r.negate
+		}
+	}
+
+	return rule, excluded
+}
+
+// Includes reports whether a repo is listed.
+func (f *RepoFilter) Includes(rel string) bool {
+	if f == nil || len(f.Include) == 0 {
+		return true
+	}
+
+	var included bool
+	for _, r := range f.Include {
+		if r.re.MatchString(rel) {
+			included = !r.negate
+		}
+	}
+
+	return included
+}
+
+func parseRule(source, pattern string) (filterRule, error) {
+	r := filterRule{Source: source, Pattern: pattern}
+
+	p := pattern
+	if strings.HasPrefix(p, "!") {
+		r.negate, p = true, p[1:]
+	}
+	if strings.HasPrefix(p, "re:") {
+		p = p[len("re:"):]
+	} else {
+		p = globRE(p)
+	}
+
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return r, fmt.Errorf("%w - rule %v", err, r)
+	}
+	r.re = re
+
+	return r, nil
+}
+
+// globRE translates a glob rule to an anchored regexp.
+func globRE(glob string) string {
+	glob = strings.TrimSuffix(glob, "/")
+	prefix := "^"
+	if !strings.Contains(glob, "/") {
+		prefix = "(^|/)"
+	}
+	glob = strings.TrimPrefix(glob, "/")
+
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			sb.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	sb.WriteString("$")
+
+	return sb.String()
+}
+
+// ruleFlag collects the values of a flag given repeatedly.
+type ruleFlag []string
+
+func (rf *ruleFlag) String() string {
+	return strings.Join(*rf, ", ")
+}
+
+func (rf *ruleFlag) Set(v string) error {
+	*rf = append(*rf, v)
+	return nil
+}
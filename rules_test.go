@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepoFilter(t *testing.T) {
+	for _, tc := range []struct {
+		rule    string
+		matches map[string]bool
+	}{
+		{"legacy", map[string]bool{"legacy": true, "team/legacy": true, "legacy-old": false, "team/legacy/repo": false}},
+		{"/legacy", map[string]bool{"legacy": true, "team/legacy": false}},
+		{"team/*-old", map[string]bool{"team/web-old": true, "team/web-new": false, "team/a/b-old": false}},
+		{"team/**/*-old", map[string]bool{"team/web-old": true, "team/a/b-old": true, "other/web-old": false}},
+		{"**/build", map[string]bool{"build": true, "a/b/build": true, "a/build-x": false}},
+		{"team/**", map[string]bool{"team/a": true, "team/a/b": true, "team": false}},
+		{"repo-?", map[string]bool{"repo-1": true, "repo-10": false}},
+		{"repo-[0-4]", map[string]bool{"repo-3": true, "repo-5": false}},
+		{"repo-[!0-4]", map[string]bool{"repo-3": false, "repo-5": true}},
+		{`a.b\*`, map[string]bool{"a.b*": true, "axb*": false, "a.bc": false}},
+		{"re:^team/.*-(old|tmp)$", map[string]bool{"team/web-old": true, "team/a/b-tmp": true, "team/web": false}},
+		{"re:scratch", map[string]bool{"scratch": true, "a/my-scratch-repo": true}},
+	} {
+		t.Run("can match rule "+tc.rule, func(t *testing.T) {
+			f := &RepoFilter{}
+			if err := f.AddRule(false, "-x", tc.rule); err != nil {
+				t.Fatalf("unexpected rule error: %v", err)
+			}
+
+			for rel, want := range tc.matches {
+				// SUT
+				_, got := f.Excludes(rel)
+
+				if got != want {
+					t.Errorf("%v: got excluded %v, want %v", rel, got, want)
+				}
+			}
+		})
+	}
+
+	t.Run("can take back exclusions with later negated rules", func(t *testing.T) {
+		f := &RepoFilter{}
+		for _, r := range []string{"team/*", "!team/keep", "team/keep"} {
+			if err := f.AddRule(false, "-x", r); err != nil {
+				t.Fatalf("unexpected rule error: %v", err)
+			}
+		}
+		if err := f.AddRule(false, "-x", "!team/keep-too"); err != nil {
+			t.Fatalf("unexpected rule error: %v", err)
+		}
+
+		// SUT
+		rule, excluded := f.Excludes("team/keep")
+		_, excludedToo := f.Excludes("team/keep-too")
+
+		assert(t, excluded, true)
+		assert(t, rule.String(), "-x: team/keep")
+		assert(t, excludedToo, false)
+	})
+
+	t.Run("can include only repos matching include rules", func(t *testing.T) {
+		f := &RepoFilter{}
+		for _, r := range []string{"re:^team/", "!team/secret"} {
+			if err := f.AddRule(true, "-i", r); err != nil {
+				t.Fatalf("unexpected rule error: %v", err)
+			}
+		}
+
+		// SUT
+		got := []bool{f.Includes("team/web"), f.Includes("team/secret"), f.Includes("other/web")}
+
+		assertDeep(t, got, []bool{true, false, false})
+	})
+
+	t.Run("can include everything without rules", func(t *testing.T) {
+		var f *RepoFilter
+
+		// SUT
+		_, excluded := f.Excludes("a")
+		included := f.Includes("a")
+
+		assert(t, excluded, false)
+		assert(t, included, true)
+	})
+
+	t.Run("can read rule files", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "omit.file")
+		if err := os.WriteFile(path, []byte("# retired repos\n\nlegacy\n  old-*  \n"), 0o644); err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+		f := &RepoFilter{}
+
+		// SUT
+		err := f.AddFile(false, path)
+
+		assert(t, err, nil)
+		rule, excluded := f.Excludes("old-web")
+		assert(t, excluded, true)
+		assert(t, rule.String(), path+":4: old-*")
+	})
+
+	t.Run("can read an empty rule file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "omit.file")
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatalf("unexpected setup error: %v", err)
+		}
+		f := &RepoFilter{}
+
+		// SUT
+		err := f.AddFile(false, path)
+
+		assert(t, err, nil)
+		assert(t, len(f.Exclude), 0)
+	})
+
+	t.Run("can reject a bad regexp", func(t *testing.T) {
+		f := &RepoFilter{}
+
+		// SUT
+		err := f.AddRule(true, "-i", "re:team/(")
+
+		if err == nil {
+			t.Errorf("got no error, want a regexp error")
+		}
+	})
+}